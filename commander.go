@@ -2,9 +2,11 @@ package main
 
 import (
 	"bufio"
+	"context"
 	"errors"
 	"fmt"
 	"io"
+	"math/rand"
 	"sync"
 	"time"
 
@@ -12,25 +14,44 @@ import (
 )
 
 const (
-	// FIXME: don't hardcode these values, use config
-	commanderTimeout = 5 * time.Second
-	reconnectDelay   = 3 * time.Second
-	drainTimeout     = 200 * time.Millisecond
+	// the defaults for the corresponding TimingSettings
+	commanderTimeout  = 5 * time.Second
+	reconnectDelay    = 3 * time.Second
+	maxReconnectDelay = 60 * time.Second
+	drainTimeout      = 200 * time.Millisecond
 )
 
-type Connector func(port string) (io.ReadWriteCloser, error)
+type Connector func(settings *PortSettings) (io.ReadWriteCloser, error)
 
 type ConnectionWithDeadline interface {
 	SetDeadline(t time.Time) error
 }
 
+// MessageConnection is implemented by the message based connections
+// such as VXI-11 and HiSLIP ones, which mark the end of each
+// response themselves, so the framers aren't used for them
+type MessageConnection interface {
+	// ReadMessage reads the response message up to its end
+	ReadMessage() ([]byte, error)
+	// Drain discards the stale responses using device clear
+	// if the previous response wasn't read completely
+	Drain() error
+}
+
 type connectionWrapper struct {
 	*bufio.ReadWriter
-	innerConn io.ReadWriteCloser
+	innerConn      io.ReadWriteCloser
+	commandTimeout time.Duration
+	drainTimeout   time.Duration
 }
 
-func newConnectionWrapper(conn io.ReadWriteCloser) *connectionWrapper {
-	return &connectionWrapper{bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn)), conn}
+func newConnectionWrapper(conn io.ReadWriteCloser, settings *PortSettings) *connectionWrapper {
+	return &connectionWrapper{
+		ReadWriter:     bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn)),
+		innerConn:      conn,
+		commandTimeout: settings.CommandTimeout(),
+		drainTimeout:   settings.DrainTimeout(),
+	}
 }
 
 func (c connectionWrapper) SetDeadline(time time.Time) error {
@@ -44,37 +65,40 @@ func (c connectionWrapper) Close() error {
 	return c.innerConn.Close()
 }
 
-func (c connectionWrapper) readResponse(lineEnding string) (string, error) {
-	delim := lineEnding[len(lineEnding)-1]
-	resp, err := c.ReadString(delim)
-	if err == ErrTimeout {
-		return "", err
-	}
-	if err != nil {
-		return "", fmt.Errorf("failed to read response: %v", err)
+// readFrame reads the response using the framer
+func (c connectionWrapper) readFrame(framer Framer) ([]byte, error) {
+	var frame []byte
+	var err error
+	if mc, ok := c.innerConn.(MessageConnection); ok {
+		frame, err = mc.ReadMessage()
+		if lineFramer, ok := framer.(*LineFramer); ok && err == nil {
+			// the devices still terminate the responses
+			frame = lineFramer.trim(frame)
+		}
+	} else {
+		frame, err = framer.ReadFrame(c.Reader)
 	}
 	switch {
-	case len(resp) >= len(lineEnding) && resp[len(resp)-len(lineEnding):] == lineEnding:
-		return resp[:len(resp)-len(lineEnding)], nil
-	case resp[len(resp)-1] == delim:
-		// allow responses to cmd + "\r\n" to end with just "\n"
-		return resp[:len(resp)-1], nil
-	default:
-		return resp, nil
-	}
-}
-
-func (c connectionWrapper) readFixedSizeResponse(n int) (string, error) {
-	buf := make([]byte, n)
-	if _, err := io.ReadFull(c, buf); err != nil {
-		return "", fmt.Errorf("error reading fixed size response: %v", err)
+	case err == ErrTimeout:
+		return nil, err
+	case err != nil:
+		return nil, fmt.Errorf("failed to read response: %v", err)
 	}
-	return string(buf), nil
+	return frame, nil
 }
 
 func (c connectionWrapper) drain(now time.Time) error {
+	if mc, ok := c.innerConn.(MessageConnection); ok {
+		if err := c.SetDeadline(now.Add(c.commandTimeout)); err != nil {
+			return fmt.Errorf("SetDeadline error [drain]: %v", err)
+		}
+		if err := mc.Drain(); err != nil {
+			return fmt.Errorf("drain error: %v", err)
+		}
+		return nil
+	}
 	for {
-		if err := c.SetDeadline(now.Add(drainTimeout)); err != nil {
+		if err := c.SetDeadline(now.Add(c.drainTimeout)); err != nil {
 			wbgo.Debug.Printf("Query: SetDeadline error [drain]: %v", err)
 			return fmt.Errorf("SetDeadline error [drain]: %v", err)
 		}
@@ -94,12 +118,16 @@ func (c connectionWrapper) drain(now time.Time) error {
 
 func (c connectionWrapper) sendCommand(command, lineEnding string, now time.Time) error {
 	wbgo.Debug.Printf("sendCommand: %q", command)
-	if err := c.SetDeadline(now.Add(commanderTimeout)); err != nil {
+	return c.sendFrame([]byte(command+lineEnding), now)
+}
+
+func (c connectionWrapper) sendFrame(frame []byte, now time.Time) error {
+	if err := c.SetDeadline(now.Add(c.commandTimeout)); err != nil {
 		wbgo.Debug.Printf("Query: SetDeadline error: %v", err)
 		return fmt.Errorf("SetDeadline error: %v", err)
 	}
 
-	_, err := c.Write([]byte(command + lineEnding))
+	_, err := c.Write(frame)
 	if err == nil {
 		err = c.Flush()
 	}
@@ -128,10 +156,26 @@ func (c *DefaultClock) After(d time.Duration) <-chan time.Time {
 var defaultClock = &DefaultClock{}
 
 type commandItem struct {
-	command           string
-	fixedResponseSize int
-	errCh             chan error
-	responseCh        chan string
+	ctx context.Context
+	// command is the text command without the line ending.
+	// It's empty for binary requests
+	command string
+	// request is the data that's sent to the device
+	request []byte
+	// framer reads the response
+	framer   Framer
+	priority CommandPriority
+	// setupItems, if not nil, are sent instead of the command
+	setupItems []*SetupItem
+	errCh      chan error
+	responseCh chan []byte
+}
+
+func (item *commandItem) String() string {
+	if item.command == "" {
+		return fmt.Sprintf("% x", item.request)
+	}
+	return item.command
 }
 
 type commanderState interface {
@@ -144,6 +188,7 @@ type commanderState interface {
 	ConnectFailed(dc *DeviceCommander) commanderState
 	Command(dc *DeviceCommander, item *commandItem) commanderState
 	CommandFinished(dc *DeviceCommander) commanderState
+	Cancel(dc *DeviceCommander, item *commandItem) commanderState
 }
 
 type commanderStateBase struct{}
@@ -167,6 +212,9 @@ func (d *commanderStateBase) Command(dc *DeviceCommander, item *commandItem) com
 	return nil
 }
 func (d *commanderStateBase) CommandFinished(dc *DeviceCommander) commanderState { return nil }
+func (d *commanderStateBase) Cancel(dc *DeviceCommander, item *commandItem) commanderState {
+	return nil
+}
 
 type commanderStateOffline struct{ commanderStateBase }
 
@@ -183,13 +231,14 @@ type commanderStateConnecting struct {
 func (s *commanderStateConnecting) Enter(dc *DeviceCommander) commanderState {
 	s.stopCh = make(chan struct{})
 	s.doneCh = make(chan struct{})
+	safeState := dc.connectionLost && dc.settings.SafeStateOnReconnect
 	go func() {
 		defer close(s.doneCh)
 		wbgo.Debug.Printf("connecting to %s", dc.settings.Port)
 		connCh := make(chan io.ReadWriteCloser)
 		errCh := make(chan error)
 		go func() {
-			conn, err := dc.connector(dc.settings.Port)
+			conn, err := dc.connector(dc.settings)
 			if err != nil {
 				errCh <- err
 			} else {
@@ -212,9 +261,9 @@ func (s *commanderStateConnecting) Enter(dc *DeviceCommander) commanderState {
 		}
 
 		wbgo.Debug.Printf("connected to %s", dc.settings.Port)
-		wrapper := newConnectionWrapper(conn)
+		wrapper := newConnectionWrapper(conn, dc.settings)
 		go func() {
-			errCh <- dc.setup(wrapper)
+			errCh <- dc.setup(wrapper, safeState)
 		}()
 		select {
 		case <-s.stopCh:
@@ -241,6 +290,7 @@ func (s *commanderStateConnecting) Enter(dc *DeviceCommander) commanderState {
 
 func (s *commanderStateConnecting) Connected(dc *DeviceCommander, c *connectionWrapper) commanderState {
 	dc.c = c
+	dc.connectionLost = false
 	return &commanderStateOnline{}
 }
 
@@ -262,7 +312,10 @@ type commanderStateReconnect struct {
 func (s *commanderStateReconnect) Enter(dc *DeviceCommander) commanderState {
 	// acquire delay channel synchronously because this makes the tests easier
 	s.stopCh = make(chan struct{})
-	afterCh := dc.clock.After(reconnectDelay)
+	dc.reconnectBackoff = dc.settings.ReconnectBackoff(dc.reconnectAttempts, dc.random())
+	dc.reconnectAttempts++
+	wbgo.Debug.Printf("reconnecting to %s in %v (attempt %d)", dc.settings.Port, dc.reconnectBackoff, dc.reconnectAttempts)
+	afterCh := dc.clock.After(dc.reconnectBackoff)
 	go func() {
 		select {
 		case <-s.stopCh:
@@ -289,6 +342,8 @@ type commanderStateOnline struct {
 }
 
 func (s *commanderStateOnline) Enter(dc *DeviceCommander) commanderState {
+	dc.reconnectAttempts = 0
+	dc.reconnectBackoff = 0
 	for _, ch := range dc.readyChs {
 		close(ch)
 	}
@@ -323,78 +378,124 @@ func (s *commanderStateBusy) send(dc *DeviceCommander) commanderState {
 	go func() {
 		defer close(s.doneCh)
 		errCh := make(chan error)
-		respCh := make(chan string)
+		respCh := make(chan []byte)
 		go func() {
+			if err := item.ctx.Err(); err != nil {
+				errCh <- err
+				return
+			}
+
+			if item.setupItems != nil {
+				if err := dc.runSetupItems(item.ctx, c, item.setupItems); err != nil {
+					errCh <- err
+				} else {
+					respCh <- nil
+				}
+				return
+			}
+
 			err := c.drain(dc.clock.Now())
 			if err != nil {
 				errCh <- err
 				return
 			}
 
-			command := dc.settings.Prefix + item.command
-			err = c.sendCommand(command, dc.lineEnding(), dc.clock.Now())
-			if err != nil {
+			wbgo.Debug.Printf("sendFrame: %q", item)
+			if err = c.sendFrame(item.request, dc.clock.Now()); err != nil {
 				errCh <- err
 				return
 			}
+			if item.ctx.Err() != nil {
+				// the command was cancelled while it was being
+				// sent, make sure the read is aborted
+				c.SetDeadline(dc.clock.Now())
+			}
 
-			var resp string
-			if item.fixedResponseSize > 0 {
-				resp, err = c.readFixedSizeResponse(item.fixedResponseSize)
+			resp, err := c.readFrame(item.framer)
+			if flusher, ok := item.framer.(Flusher); ok && err == nil {
+				select {
+				case <-dc.clock.After(dc.settings.CommandDelay()):
+				case <-s.stopCh:
+					return
+				}
+				_, err = c.Write(flusher.FlushSequence())
 				if err == nil {
-					select {
-					case <-dc.clock.After(dc.settings.CommandDelay()):
-					case <-s.stopCh:
-						return
-					}
-					_, err = c.Write([]byte(dc.lineEnding()))
-					if err == nil {
-						err = c.Flush()
-					}
-					if err != nil {
-						err = fmt.Errorf("error writing flush sequence: %v", err)
-					}
+					err = c.Flush()
+				}
+				if err != nil {
+					err = fmt.Errorf("error writing flush sequence: %v", err)
 				}
-			} else {
-				resp, err = c.readResponse(dc.lineEnding())
 			}
-			wbgo.Debug.Printf("response for %q: %#v", command, resp)
+			wbgo.Debug.Printf("response for %q: %q", item, resp)
 			if err != nil {
 				errCh <- err
 			} else {
 				respCh <- resp
 			}
 		}()
-		select {
-		case <-s.stopCh:
-			item.errCh <- errors.New("disconnect requested")
-			return
-		case resp := <-respCh:
-			item.responseCh <- resp
-			dc.stateAction(func(s commanderState) commanderState {
-				return s.CommandFinished(dc)
-			})
-		case err := <-errCh:
-			wbgo.Error.Printf("Error executing the command: %v", err)
-			// let the following happen after s.doneCh is closed
-			go func() {
-				if err == ErrTimeout {
-					dc.stateAction(func(s commanderState) commanderState {
-						return s.CommandFinished(dc)
-					})
+		ctxDone := item.ctx.Done()
+		for {
+			select {
+			case <-s.stopCh:
+				item.errCh <- errors.New("disconnect requested")
+				return
+			case <-ctxDone:
+				// abort the read by making it time out. Still need
+				// to wait for the reading goroutine to finish so
+				// the connection isn't used concurrently
+				ctxDone = nil
+				if err := c.SetDeadline(dc.clock.Now()); err != nil {
+					wbgo.Debug.Printf("Query: SetDeadline error [cancel]: %v", err)
+				}
+			case resp := <-respCh:
+				item.responseCh <- resp
+				// let the following happen after s.doneCh is closed,
+				// otherwise Disconnect() may deadlock waiting for it
+				dc.finishers.Add(1)
+				go func() {
+					defer dc.finishers.Done()
+					s.finish(dc, false)
+				}()
+				return
+			case err := <-errCh:
+				cancelled := item.ctx.Err() != nil
+				if cancelled {
+					wbgo.Debug.Printf("command %q cancelled: %v", item, err)
+					err = item.ctx.Err()
 				} else {
-					dc.stateAction(func(s commanderState) commanderState {
-						return s.CommandFailed(dc)
-					})
+					wbgo.Error.Printf("Error executing the command: %v", err)
 				}
-				item.errCh <- err
-			}()
-			return
+				// let the following happen after s.doneCh is closed
+				dc.finishers.Add(1)
+				go func() {
+					defer dc.finishers.Done()
+					s.finish(dc, err != ErrTimeout && !cancelled)
+					item.errCh <- err
+				}()
+				return
+			}
 		}
 	}()
 	return nil
 }
 
+// finish completes the command being executed unless the
+// commander has left this state in the meantime, e.g. because
+// it was closed, so a late call doesn't pop an item that
+// belongs to another busy state
+func (s *commanderStateBusy) finish(dc *DeviceCommander, failed bool) {
+	dc.stateAction(func(state commanderState) commanderState {
+		switch {
+		case state != s:
+			return nil
+		case failed:
+			return s.CommandFailed(dc)
+		default:
+			return s.CommandFinished(dc)
+		}
+	})
+}
+
 func (s *commanderStateBusy) Enter(dc *DeviceCommander) commanderState {
 	if dc.settings.CommandDelayMs > 0 {
 		go func() {
@@ -427,7 +528,29 @@ func (s *commanderStateBusy) Disconnect(dc *DeviceCommander) commanderState {
 }
 
 func (s *commanderStateBusy) Command(dc *DeviceCommander, item *commandItem) commanderState {
-	s.queue = append(s.queue, item)
+	// queue[0] is the command being executed. The new item is
+	// placed after any pending items with the same or higher
+	// priority
+	n := len(s.queue)
+	for n > 1 && s.queue[n-1].priority < item.priority {
+		n--
+	}
+	s.queue = append(s.queue, nil)
+	copy(s.queue[n+1:], s.queue[n:])
+	s.queue[n] = item
+	return nil
+}
+
+func (s *commanderStateBusy) Cancel(dc *DeviceCommander, item *commandItem) commanderState {
+	// the command that's being executed (queue[0]) is
+	// aborted by send(), the pending ones are just removed
+	// from the queue
+	for n := 1; n < len(s.queue); n++ {
+		if s.queue[n] == item {
+			s.queue = append(s.queue[:n], s.queue[n+1:]...)
+			break
+		}
+	}
 	return nil
 }
 
@@ -449,17 +572,30 @@ func (s *commanderStateBusy) CommandFailed(dc *DeviceCommander) commanderState {
 		item.errCh <- errors.New("previously queued command failed")
 	}
 	dc.c = nil
+	dc.connectionLost = true
 	return &commanderStateReconnect{}
 }
 
 type DeviceCommander struct {
 	sync.Mutex
-	settings  *PortSettings
-	connector Connector
-	readyChs  []chan struct{}
-	c         *connectionWrapper
-	clock     Clock
-	state     commanderState
+	settings          *PortSettings
+	connector         Connector
+	readyChs          []chan struct{}
+	c                 *connectionWrapper
+	clock             Clock
+	random            func() float64
+	state             commanderState
+	reconnectAttempts int
+	reconnectBackoff  time.Duration
+	// connectionLost is set when the connection is lost
+	// due to an error and cleared after reconnecting
+	connectionLost bool
+	// safeStateFailed is set when the safe state commands
+	// fail after reconnecting
+	safeStateFailed bool
+	// finishers tracks the goroutines that complete
+	// the commands, Close() waits for them
+	finishers sync.WaitGroup
 }
 
 var _ Commander = &DeviceCommander{}
@@ -469,6 +605,7 @@ func NewCommander(connector Connector, settings *PortSettings) *DeviceCommander
 		settings:  settings,
 		connector: connector,
 		clock:     defaultClock,
+		random:    rand.Float64,
 	}
 	dc.enterState(&commanderStateOffline{})
 	return dc
@@ -488,43 +625,65 @@ func (dc *DeviceCommander) stateAction(thunk func(state commanderState) commande
 	dc.enterState(thunk(dc.state))
 }
 
-func (dc *DeviceCommander) setup(c *connectionWrapper) error {
-	for _, si := range dc.settings.Setup {
+// setup sends the setup commands after connecting. If safeState is
+// true, the safe state commands are sent after the setup commands.
+// The failure to enter the safe state doesn't fail the setup, as
+// reconnecting wouldn't help with it. Instead, it's reported via
+// the commander diagnostics
+func (dc *DeviceCommander) setup(c *connectionWrapper, safeState bool) error {
+	if err := dc.runSetupItems(context.Background(), c, dc.settings.Setup); err != nil {
+		return err
+	}
+	if safeState {
+		err := dc.runSetupItems(context.Background(), c, dc.settings.SafeState)
+		if err != nil {
+			wbgo.Error.Printf("failed to enter the safe state after reconnecting to %s: %v", dc.settings.Port, err)
+		} else {
+			wbgo.Info.Printf("entered the safe state after reconnecting to %s", dc.settings.Port)
+		}
+		dc.Lock()
+		dc.safeStateFailed = err != nil
+		dc.Unlock()
+	}
+	wbgo.Debug.Printf("setup done for %s", dc.settings.Port)
+	return nil
+}
+
+// runSetupItems sends the specified commands, verifying
+// the responses to them if they're specified
+func (dc *DeviceCommander) runSetupItems(ctx context.Context, c *connectionWrapper, items []*SetupItem) error {
+	for _, si := range items {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
 		if err := c.drain(dc.clock.Now()); err != nil {
 			return err
 		}
 
-		if err := c.sendCommand(dc.settings.Prefix+si.Command, dc.lineEnding(), dc.clock.Now()); err != nil {
+		if err := c.sendCommand(si.Command, dc.lineEnding(), dc.clock.Now()); err != nil {
 			return err
 		}
 
 		if si.Response != "" {
-			resp, err := c.readResponse(dc.lineEnding())
+			resp, err := c.readFrame(dc.lineFramer())
 			if err != nil {
 				return err
 			}
-			if resp != si.Response {
-				return fmt.Errorf("invalid response to %q: %q", resp, si.Response)
+			if string(resp) != si.Response {
+				return fmt.Errorf("invalid response to %q: %q", si.Command, resp)
 			}
 		}
 	}
-	wbgo.Debug.Printf("setup done for %s", dc.settings.Port)
 	return nil
 }
 
 func (dc *DeviceCommander) lineEnding() string {
-	switch dc.settings.LineEnding {
-	case "cr":
-		return "\r"
-	case "lf":
-		return "\n"
-	case "":
-		fallthrough
-	case "crlf":
-		return "\r\n"
-	default:
-		panic("bad line ending spec: " + dc.settings.LineEnding)
-	}
+	return dc.settings.LineTerminator()
+}
+
+func (dc *DeviceCommander) lineFramer() Framer {
+	return &LineFramer{LineEnding: dc.lineEnding()}
 }
 
 func (dc *DeviceCommander) Connect() {
@@ -547,24 +706,80 @@ func (dc *DeviceCommander) SetClock(clock Clock) {
 	dc.clock = clock
 }
 
-func (dc *DeviceCommander) Query(query string, fixedResponseSize int) (string, error) {
-	item := &commandItem{
-		command:           query,
-		fixedResponseSize: fixedResponseSize,
-		errCh:             make(chan error, 1),
-		responseCh:        make(chan string, 1),
+func (dc *DeviceCommander) Diagnostics() CommanderDiagnostics {
+	dc.Lock()
+	defer dc.Unlock()
+	return CommanderDiagnostics{
+		Connected:         dc.c != nil,
+		ReconnectAttempts: dc.reconnectAttempts,
+		ReconnectBackoff:  dc.reconnectBackoff,
+		SafeStateFailed:   dc.safeStateFailed,
+	}
+}
+
+// Query executes the command and returns the response. If ctx is
+// cancelled before the command is started, the command is removed
+// from the queue. If it's cancelled while the command is being
+// executed, reading the response is aborted
+func (dc *DeviceCommander) Query(ctx context.Context, query string, framer Framer, priority CommandPriority) (string, error) {
+	if framer == nil {
+		framer = dc.lineFramer()
+	}
+	resp, err := dc.execute(&commandItem{
+		ctx:      ctx,
+		command:  query,
+		request:  []byte(query + dc.lineEnding()),
+		framer:   framer,
+		priority: priority,
+	})
+	return string(resp), err
+}
+
+// Exchange sends the binary request frame and reads the response
+// frame using the framer. Cancellation works the same way as
+// in Query()
+func (dc *DeviceCommander) Exchange(ctx context.Context, request []byte, framer Framer, priority CommandPriority) ([]byte, error) {
+	return dc.execute(&commandItem{
+		ctx:      ctx,
+		request:  request,
+		framer:   framer,
+		priority: priority,
+	})
+}
+
+// SafeState sends the safe state commands that are specified in
+// the port settings. It does nothing if there are no such commands
+func (dc *DeviceCommander) SafeState(ctx context.Context) error {
+	if len(dc.settings.SafeState) == 0 {
+		return nil
 	}
+	_, err := dc.execute(&commandItem{
+		ctx:        ctx,
+		command:    "<safe state>",
+		priority:   PriorityInteractive,
+		setupItems: dc.settings.SafeState,
+	})
+	return err
+}
+
+func (dc *DeviceCommander) execute(item *commandItem) ([]byte, error) {
+	item.errCh = make(chan error, 1)
+	item.responseCh = make(chan []byte, 1)
 	dc.stateAction(func(s commanderState) commanderState { return s.Command(dc, item) })
 	select {
 	case err := <-item.errCh:
-		return "", err
+		return nil, err
 	case resp := <-item.responseCh:
 		return resp, nil
+	case <-item.ctx.Done():
+		dc.stateAction(func(s commanderState) commanderState { return s.Cancel(dc, item) })
+		return nil, item.ctx.Err()
 	}
 }
 
 func (dc *DeviceCommander) Close() {
 	dc.stateAction(func(s commanderState) commanderState { return s.Disconnect(dc) })
+	dc.finishers.Wait()
 	dc.Lock()
 	for dc.c != nil {
 		dc.Unlock()
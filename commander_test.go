@@ -2,14 +2,18 @@ package main
 
 import (
 	"bufio"
+	"context"
 	"errors"
 	"fmt"
 	"io"
 	"log"
+	"reflect"
 	"sort"
 	"sync"
 	"testing"
 	"time"
+
+	"github.com/contactless/wbgo/testutils"
 )
 
 const (
@@ -42,6 +46,11 @@ func (c *fakeClock) After(d time.Duration) <-chan time.Time {
 	defer c.Unlock()
 	t := c.time.Add(d)
 	ch := make(chan time.Time)
+	if d <= 0 {
+		// like time.After(), fire immediately for non-positive durations
+		close(ch)
+		return ch
+	}
 	c.deadlines = append(c.deadlines, fakeClockDeadline{t, ch})
 	return ch
 }
@@ -61,46 +70,170 @@ func (c *fakeClock) elapse(d time.Duration) {
 	}
 }
 
+type fakeReadChunk struct {
+	data []byte
+	err  error
+}
+
 type fakeConnection struct {
-	io.Reader
+	sync.Mutex // protects everything but the read buffer
 	io.Writer
 	io.Closer
 	deadline, readTime time.Time
 	pendingError       error
 	closed             bool
+	// written is set when a command is written after the last
+	// SetDeadline() call. Reads that happen before that
+	// (i.e. draining) time out immediately if there's no
+	// incoming data available
+	written bool
+	// drainDeadline is the deadline that was in effect
+	// during the last drain
+	drainDeadline time.Time
+	readCh        chan fakeReadChunk
+	// deadlineCh wakes up the blocked reads when
+	// the deadline is changed
+	deadlineCh chan struct{}
+	pending    []byte
+}
+
+func newFakeConnection(r io.Reader, w io.WriteCloser) *fakeConnection {
+	fc := &fakeConnection{
+		Writer:     w,
+		Closer:     w,
+		readCh:     make(chan fakeReadChunk, 100),
+		deadlineCh: make(chan struct{}, 1),
+	}
+	go func() {
+		for {
+			buf := make([]byte, 4096)
+			n, err := r.Read(buf)
+			fc.readCh <- fakeReadChunk{buf[:n], err}
+			if err != nil {
+				return
+			}
+		}
+	}()
+	return fc
 }
 
 func (fc *fakeConnection) SetDeadline(time time.Time) error {
+	fc.Lock()
 	fc.deadline = time
+	fc.written = false
+	fc.Unlock()
+	select {
+	case fc.deadlineCh <- struct{}{}:
+	default:
+	}
 	return nil
 }
 
+func (fc *fakeConnection) getDeadline() time.Time {
+	fc.Lock()
+	defer fc.Unlock()
+	return fc.deadline
+}
+
+func (fc *fakeConnection) getDrainDeadline() time.Time {
+	fc.Lock()
+	defer fc.Unlock()
+	return fc.drainDeadline
+}
+
+// setReadTime sets the time at which the incoming data is
+// considered to be received. Reads time out if it's after
+// the deadline
+func (fc *fakeConnection) setReadTime(t time.Time) {
+	fc.Lock()
+	defer fc.Unlock()
+	fc.readTime = t
+}
+
+// setPendingError makes the next read or write fail
+func (fc *fakeConnection) setPendingError(err error) {
+	fc.Lock()
+	defer fc.Unlock()
+	fc.pendingError = err
+}
+
+func (fc *fakeConnection) takePendingError() error {
+	fc.Lock()
+	defer fc.Unlock()
+	err := fc.pendingError
+	fc.pendingError = nil
+	return err
+}
+
+// waitForChunk waits for the incoming data. As the fake connection
+// doesn't track the time, moving the deadline to an earlier time
+// while waiting is treated as the deadline expiration
+func (fc *fakeConnection) waitForChunk(deadline time.Time) (fakeReadChunk, error) {
+	for {
+		select {
+		case chunk := <-fc.readCh:
+			return chunk, nil
+		case <-fc.deadlineCh:
+			if fc.getDeadline().Before(deadline) {
+				return fakeReadChunk{}, ErrTimeout
+			}
+		}
+	}
+}
+
 func (fc *fakeConnection) Write(p []byte) (n int, err error) {
-	if fc.pendingError != nil {
-		err = fc.pendingError
-		fc.pendingError = nil
+	if err = fc.takePendingError(); err != nil {
 		return
 	}
+	fc.Lock()
+	fc.written = true
+	fc.Unlock()
 	return fc.Writer.Write(p)
 }
 
 func (fc *fakeConnection) Read(p []byte) (n int, err error) {
-	if fc.pendingError != nil {
-		err = fc.pendingError
-		fc.pendingError = nil
+	if err = fc.takePendingError(); err != nil {
 		return
 	}
-	if fc.readTime.After(fc.deadline) {
+	fc.Lock()
+	deadline, written, readTime := fc.deadline, fc.written, fc.readTime
+	if !written {
+		fc.drainDeadline = deadline
+	}
+	fc.Unlock()
+	if readTime.After(deadline) {
 		return 0, ErrTimeout
 	}
-	return fc.Reader.Read(p)
+	if len(fc.pending) == 0 {
+		var chunk fakeReadChunk
+		if written {
+			if chunk, err = fc.waitForChunk(deadline); err != nil {
+				return 0, err
+			}
+		} else {
+			select {
+			case chunk = <-fc.readCh:
+			default:
+				return 0, ErrTimeout
+			}
+		}
+		if chunk.err != nil {
+			return 0, chunk.err
+		}
+		fc.pending = chunk.data
+	}
+	n = copy(p, fc.pending)
+	fc.pending = fc.pending[n:]
+	return n, nil
 }
 
 func (fc *fakeConnection) Close() error {
 	if err := fc.Closer.Close(); err != nil {
 		return err
 	}
+	fc.Lock()
 	fc.closed = true
+	fc.Unlock()
 	return nil
 }
 
@@ -114,6 +247,7 @@ type cmdTester struct {
 	connectCount   int
 	connectPort    string
 	connectCh      chan struct{}
+	connectError   error
 	lineEnding     string
 }
 
@@ -232,20 +366,23 @@ func (tester *cmdTester) acceptSetCommand(cmd, response string, thunk func() err
 	}
 }
 
-func (tester *cmdTester) connect(port string) (io.ReadWriteCloser, error) {
-	if port != tester.connectPort {
-		log.Panicf("bad connect() port: %q instead of %q", port, tester.connectPort)
+func (tester *cmdTester) connect(settings *PortSettings) (io.ReadWriteCloser, error) {
+	if settings.Port != tester.connectPort {
+		log.Panicf("bad connect() port: %q instead of %q", settings.Port, tester.connectPort)
+	}
+	tester.Lock()
+	connectError := tester.connectError
+	tester.Unlock()
+	if connectError != nil {
+		tester.connectCount++
+		return nil, connectError
 	}
 	ourInnerReader, theirWriter := io.Pipe()
 	theirReader, ourWriter := io.Pipe()
 	tester.ourInnerReader = ourInnerReader
 	tester.ourReader = bufio.NewReader(ourInnerReader)
 	tester.ourWriter = ourWriter
-	tester.fc = &fakeConnection{
-		Reader: theirReader,
-		Writer: theirWriter,
-		Closer: theirWriter,
-	}
+	tester.fc = newFakeConnection(theirReader, theirWriter)
 	tester.connectCount++
 	tester.connectCh <- struct{}{}
 
@@ -259,6 +396,10 @@ func (tester *cmdTester) verifyConnectCount(expectedCount int) {
 }
 
 func (tester *cmdTester) close() {
+	if tester.ourInnerReader == nil {
+		// not connected
+		return
+	}
 	tester.ourInnerReader.Close()
 	tester.ourWriter.Close()
 }
@@ -267,26 +408,27 @@ func TestCommander(t *testing.T) {
 	tester := newCmdTester(t, samplePort)
 	commander := NewCommander(tester.connect, &PortSettings{Port: samplePort})
 	commander.Connect()
+	defer commander.Close()
 	<-commander.Ready()
 	commander.SetClock(tester)
 	tester.chat("*IDN?", "IZNAKURNOZH", func() (string, error) {
-		return commander.Query("*IDN?", 0)
+		return commander.Query(context.Background(), "*IDN?", nil, PriorityBackground)
 	})
 	tester.chat("CURR?", "3.500", func() (string, error) {
-		return commander.Query("CURR?", 0)
+		return commander.Query(context.Background(), "CURR?", nil, PriorityBackground)
 	})
 	tester.chat("CURR 3.4; *OPC?", "1", func() (string, error) {
-		return commander.Query("CURR 3.4; *OPC?", 0)
+		return commander.Query(context.Background(), "CURR 3.4; *OPC?", nil, PriorityInteractive)
 	})
 	// make sure setting the value didn't break DeviceCommander
 	tester.chat("CURR?", "3.400", func() (string, error) {
-		return commander.Query("CURR?", 0)
+		return commander.Query(context.Background(), "CURR?", nil, PriorityBackground)
 	})
 
-	tester.fc.readTime = tester.time.Add(10 * time.Second)
+	tester.fc.setReadTime(tester.time.Add(10 * time.Second))
 	errCh := make(chan error)
 	go func() {
-		_, err := commander.Query("CURR?", 0)
+		_, err := commander.Query(context.Background(), "CURR?", nil, PriorityBackground)
 		errCh <- err
 	}()
 	if _, err := tester.ourReader.ReadString('\n'); err != nil {
@@ -296,11 +438,11 @@ func TestCommander(t *testing.T) {
 		t.Errorf("unexpected error value: %#v (expected ErrTimeout)", err)
 	}
 
-	tester.fc.readTime = tester.time
+	tester.fc.setReadTime(tester.time)
 
 	// make sure things didn't break, again
 	tester.chat("CURR?", "3.400", func() (string, error) {
-		return commander.Query("CURR?", 0)
+		return commander.Query(context.Background(), "CURR?", nil, PriorityBackground)
 	})
 }
 
@@ -320,30 +462,158 @@ func TestCommanderSetup(t *testing.T) {
 	})
 	commander.SetClock(tester)
 	commander.Connect()
+	defer commander.Close()
 	<-tester.connectCh
 	tester.expectCommand(":SYST:REM")
 	tester.expectCommand("WHATEVER")
 	tester.writeResponse("ORLY")
 	<-commander.Ready()
 	tester.chat("*IDN?", "IZNAKURNOZH", func() (string, error) {
-		return commander.Query("*IDN?", 0)
+		return commander.Query(context.Background(), "*IDN?", nil, PriorityBackground)
 	})
 }
 
+func TestSafeState(t *testing.T) {
+	tester := newCmdTester(t, samplePort)
+	commander := NewCommander(tester.connect, &PortSettings{
+		Port: samplePort,
+		SafeState: []*SetupItem{
+			{
+				Command: "OUTP 0",
+			},
+			{
+				Command:  "OUTP?",
+				Response: "0",
+			},
+		},
+	})
+	commander.SetClock(tester)
+	commander.Connect()
+	defer commander.Close()
+	<-commander.Ready()
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- commander.SafeState(context.Background())
+	}()
+	tester.expectCommand("OUTP 0")
+	tester.expectCommand("OUTP?")
+	tester.writeResponse("0")
+	if err := <-errCh; err != nil {
+		t.Errorf("SafeState() failed: %v", err)
+	}
+
+	go func() {
+		errCh <- commander.SafeState(context.Background())
+	}()
+	tester.expectCommand("OUTP 0")
+	tester.expectCommand("OUTP?")
+	tester.writeResponse("1")
+	if err := <-errCh; err == nil {
+		t.Errorf("SafeState() didn't fail on a bad response")
+	}
+}
+
+func TestSafeStateOnReconnect(t *testing.T) {
+	tester := newCmdTester(t, samplePort)
+	commander := NewCommander(tester.connect, &PortSettings{
+		Port: samplePort,
+		Setup: []*SetupItem{
+			{
+				Command: ":SYST:REM",
+			},
+		},
+		SafeState: []*SetupItem{
+			{
+				Command: "OUTP 0",
+			},
+		},
+		SafeStateOnReconnect: true,
+	})
+	commander.SetClock(tester)
+	commander.Connect()
+	defer commander.Close()
+	<-tester.connectCh
+	// no safe state commands on the first connection
+	tester.expectCommand(":SYST:REM")
+	<-commander.Ready()
+
+	tester.fc.setPendingError(errors.New("oops"))
+	if _, err := commander.Query(context.Background(), "*IDN?", nil, PriorityBackground); err == nil {
+		t.Errorf("Query() didn't return the expected error")
+	}
+	tester.elapse(10 * time.Second)
+	<-tester.connectCh
+	tester.expectCommand(":SYST:REM")
+	tester.expectCommand("OUTP 0")
+	<-commander.Ready()
+	tester.chat("*IDN?", "IZNAKURNOZH", func() (string, error) {
+		return commander.Query(context.Background(), "*IDN?", nil, PriorityBackground)
+	})
+}
+
+func TestSafeStateFailureOnReconnect(t *testing.T) {
+	tester := newCmdTester(t, samplePort)
+	commander := NewCommander(tester.connect, &PortSettings{
+		Port: samplePort,
+		SafeState: []*SetupItem{
+			{
+				Command:  "OUTP?",
+				Response: "0",
+			},
+		},
+		SafeStateOnReconnect: true,
+	})
+	commander.SetClock(tester)
+	commander.Connect()
+	defer commander.Close()
+	<-tester.connectCh
+	<-commander.Ready()
+
+	reconnect := func(response string) {
+		tester.fc.setPendingError(errors.New("oops"))
+		if _, err := commander.Query(context.Background(), "*IDN?", nil, PriorityBackground); err == nil {
+			t.Errorf("Query() didn't return the expected error")
+		}
+		tester.elapse(10 * time.Second)
+		<-tester.connectCh
+		tester.expectCommand("OUTP?")
+		tester.writeResponse(response)
+		<-commander.Ready()
+	}
+
+	// the failure to enter the safe state doesn't
+	// break the connection but is reported
+	reconnect("1")
+	if diag := commander.Diagnostics(); diag != (CommanderDiagnostics{Connected: true, SafeStateFailed: true}) {
+		t.Errorf("unexpected diagnostics %#v", diag)
+	}
+	tester.verifyConnectCount(2)
+	tester.chat("*IDN?", "IZNAKURNOZH", func() (string, error) {
+		return commander.Query(context.Background(), "*IDN?", nil, PriorityBackground)
+	})
+
+	reconnect("0")
+	if diag := commander.Diagnostics(); diag != (CommanderDiagnostics{Connected: true}) {
+		t.Errorf("unexpected diagnostics %#v", diag)
+	}
+}
+
 func TestReconnect(t *testing.T) {
 	tester := newCmdTester(t, samplePort)
 	commander := NewCommander(tester.connect, &PortSettings{Port: samplePort})
 	commander.SetClock(tester)
 	commander.Connect()
+	defer commander.Close()
 	readyCh := commander.Ready()
 	<-readyCh
 	tester.verifyConnectCount(1)
 	oldFc := tester.fc
 	tester.chat("*IDN?", "IZNAKURNOZH", func() (string, error) {
-		return commander.Query("*IDN?", 0)
+		return commander.Query(context.Background(), "*IDN?", nil, PriorityBackground)
 	})
-	tester.fc.pendingError = errors.New("oops")
-	if _, err := commander.Query("*IDN?", 0); err == nil {
+	tester.fc.setPendingError(errors.New("oops"))
+	if _, err := commander.Query(context.Background(), "*IDN?", nil, PriorityBackground); err == nil {
 		t.Errorf("Identify() didn't return the expected error")
 	}
 
@@ -358,8 +628,105 @@ func TestReconnect(t *testing.T) {
 		t.Errorf("The old connection was not closed")
 	}
 	tester.chat("*IDN?", "IZNAKURNOZH", func() (string, error) {
-		return commander.Query("*IDN?", 0)
+		return commander.Query(context.Background(), "*IDN?", nil, PriorityBackground)
+	})
+}
+
+func TestReconnectDelay(t *testing.T) {
+	tester := newCmdTester(t, samplePort)
+	commander := NewCommander(tester.connect, &PortSettings{
+		Port: samplePort,
+		TimingSettings: TimingSettings{
+			ReconnectDelayMs: 10000,
+		},
+	})
+	commander.SetClock(tester)
+	commander.Connect()
+	defer commander.Close()
+	<-commander.Ready()
+	tester.fc.setPendingError(errors.New("oops"))
+	if _, err := commander.Query(context.Background(), "*IDN?", nil, PriorityBackground); err == nil {
+		t.Errorf("Identify() didn't return the expected error")
+	}
+
+	readyCh := commander.Ready()
+	tester.elapse(9 * time.Second)
+	select {
+	case <-readyCh:
+		t.Fatalf("reconnected too early")
+	case <-time.After(100 * time.Millisecond):
+	}
+	tester.verifyConnectCount(1)
+
+	tester.elapse(1 * time.Second)
+	<-readyCh
+	tester.verifyConnectCount(2)
+}
+
+func TestReconnectBackoff(t *testing.T) {
+	tester := newCmdTester(t, samplePort)
+	tester.connectError = errors.New("connection refused")
+	commander := NewCommander(tester.connect, &PortSettings{
+		Port: samplePort,
+		TimingSettings: TimingSettings{
+			ReconnectDelayMs:    1000,
+			MaxReconnectDelayMs: 3000,
+		},
+	})
+	commander.SetClock(tester)
+	readyCh := commander.Ready()
+	commander.Connect()
+	defer commander.Close()
+	waitForDiagnostics := func(expected CommanderDiagnostics) {
+		testutils.WaitFor(t, func() bool {
+			return commander.Diagnostics() == expected
+		})
+	}
+	waitForDiagnostics(CommanderDiagnostics{false, 1, 1 * time.Second, false})
+	tester.elapse(1 * time.Second)
+	waitForDiagnostics(CommanderDiagnostics{false, 2, 2 * time.Second, false})
+	tester.elapse(1 * time.Second)
+	tester.verifyConnectCount(2)
+	tester.elapse(1 * time.Second)
+	// the delay is capped by MaxReconnectDelayMs
+	waitForDiagnostics(CommanderDiagnostics{false, 3, 3 * time.Second, false})
+	tester.verifyConnectCount(3)
+
+	tester.Lock()
+	tester.connectError = nil
+	tester.Unlock()
+	tester.elapse(3 * time.Second)
+	<-readyCh
+	tester.verifyConnectCount(4)
+	// the attempt counter is reset after connecting
+	waitForDiagnostics(CommanderDiagnostics{Connected: true})
+}
+
+func TestCommandAndDrainTimeouts(t *testing.T) {
+	tester := newCmdTester(t, samplePort)
+	commander := NewCommander(tester.connect, &PortSettings{
+		Port: samplePort,
+		TimingSettings: TimingSettings{
+			CommandTimeoutMs: 20000,
+			DrainTimeoutMs:   50,
+		},
 	})
+	commander.Connect()
+	defer commander.Close()
+	<-commander.Ready()
+	commander.SetClock(tester)
+
+	// 10s delay would cause a timeout with the default command timeout
+	tester.fc.setReadTime(tester.time.Add(10 * time.Second))
+	tester.chat("CURR?", "3.400", func() (string, error) {
+		return commander.Query(context.Background(), "CURR?", nil, PriorityBackground)
+	})
+	if drainDeadline, expected := tester.fc.getDrainDeadline(), tester.time.Add(50*time.Millisecond); !drainDeadline.Equal(expected) {
+		t.Errorf("bad drain deadline %v (expected %v)", drainDeadline, expected)
+	}
+	if deadline, expected := tester.fc.getDeadline(), tester.time.Add(20*time.Second); !deadline.Equal(expected) {
+		t.Errorf("bad command deadline %v (expected %v)", deadline, expected)
+	}
 }
 
 func TestAltLineEnding(t *testing.T) {
@@ -367,24 +734,36 @@ func TestAltLineEnding(t *testing.T) {
 	tester.lineEnding = "\r"
 	commander := NewCommander(tester.connect, &PortSettings{Port: samplePort, LineEnding: "cr"})
 	commander.Connect()
+	defer commander.Close()
 	<-commander.Ready()
 	commander.SetClock(tester)
 	tester.chat("*IDN?", "IZNAKURNOZH", func() (string, error) {
-		return commander.Query("*IDN?", 0)
+		return commander.Query(context.Background(), "*IDN?", nil, PriorityBackground)
 	})
 }
 
-func TestFixedSizeResponse(t *testing.T) {
+// flushingFramer reads fixed size frames
+// and requests a line ending to be sent after them
+type flushingFramer struct {
+	FixedSizeFramer
+}
+
+func (f *flushingFramer) FlushSequence() []byte {
+	return []byte("\r\n")
+}
+
+func TestFlushingFramer(t *testing.T) {
 	tester := newCmdTester(t, samplePort)
 	commander := NewCommander(tester.connect, &PortSettings{Port: samplePort})
 	commander.Connect()
+	defer commander.Close()
 	<-commander.Ready()
 	commander.SetClock(tester)
 
 	ch := make(chan string)
 	for i := 0; i < 3; i++ {
 		go func() {
-			if r, err := commander.Query("FOOBAR", 8); err != nil {
+			if r, err := commander.Query(context.Background(), "FOOBAR", &flushingFramer{FixedSizeFramer{Size: 8}}, PriorityBackground); err != nil {
 				log.Panicf("failed to invoke command: %v", err)
 			} else {
 				ch <- r
@@ -401,9 +780,164 @@ func TestFixedSizeResponse(t *testing.T) {
 	}
 }
 
+func commanderQueueLength(dc *DeviceCommander) int {
+	dc.Lock()
+	defer dc.Unlock()
+	if s, ok := dc.state.(*commanderStateBusy); ok {
+		return len(s.queue)
+	}
+	return 0
+}
+
+func TestCommandPriority(t *testing.T) {
+	tester := newCmdTester(t, samplePort)
+	commander := NewCommander(tester.connect, &PortSettings{Port: samplePort})
+	commander.Connect()
+	defer commander.Close()
+	<-commander.Ready()
+	commander.SetClock(tester)
+
+	var wg sync.WaitGroup
+	query := func(cmd, expectedResponse string, priority CommandPriority) {
+		wg.Add(1)
+		n := commanderQueueLength(commander)
+		go func() {
+			defer wg.Done()
+			switch r, err := commander.Query(context.Background(), cmd, nil, priority); {
+			case err != nil:
+				t.Errorf("%q failed: %v", cmd, err)
+			case r != expectedResponse:
+				t.Errorf("bad response for %q: %q instead of %q", cmd, r, expectedResponse)
+			}
+		}()
+		testutils.WaitFor(t, func() bool {
+			return commanderQueueLength(commander) == n+1
+		})
+	}
+	query("MEAS:VOLT?", "12.0", PriorityBackground)
+	tester.expectCommand("MEAS:VOLT?")
+	query("CURR?", "3.5", PriorityBackground)
+	query("MODE?", "1", PriorityBackground)
+	query("CURR 3.4; *OPC?", "1", PriorityInteractive)
+	query("OUTP 0; *OPC?", "1", PriorityInteractive)
+	tester.writeResponse("12.0")
+
+	// the set commands overtake pending polls
+	tester.simpleChat("CURR 3.4; *OPC?", "1")
+	tester.simpleChat("OUTP 0; *OPC?", "1")
+	tester.simpleChat("CURR?", "3.5")
+	tester.simpleChat("MODE?", "1")
+	wg.Wait()
+}
+
+func TestCancelQuery(t *testing.T) {
+	tester := newCmdTester(t, samplePort)
+	commander := NewCommander(tester.connect, &PortSettings{Port: samplePort})
+	commander.Connect()
+	defer commander.Close()
+	<-commander.Ready()
+	commander.SetClock(tester)
+
+	errCh := make(chan error)
+	query := func(ctx context.Context, cmd string) {
+		go func() {
+			_, err := commander.Query(ctx, cmd, nil, PriorityBackground)
+			errCh <- err
+		}()
+	}
+	verifyCancelled := func() {
+		select {
+		case err := <-errCh:
+			if err != context.Canceled {
+				t.Errorf("unexpected error value: %#v (expected context.Canceled)", err)
+			}
+		case <-time.After(30 * time.Second):
+			t.Fatalf("timed out waiting for the query to be cancelled")
+		}
+	}
+
+	// cancel a command that's not started yet
+	ch := make(chan string)
+	go func() {
+		r, err := commander.Query(context.Background(), "CURR?", nil, PriorityBackground)
+		if err != nil {
+			t.Errorf("CURR? failed: %v", err)
+		}
+		ch <- r
+	}()
+	tester.expectCommand("CURR?")
+	ctx, cancel := context.WithCancel(context.Background())
+	query(ctx, "MODE?")
+	testutils.WaitFor(t, func() bool {
+		return commanderQueueLength(commander) == 2
+	})
+	cancel()
+	verifyCancelled()
+	if n := commanderQueueLength(commander); n != 1 {
+		t.Errorf("bad queue length after cancelling the command: %d", n)
+	}
+	tester.respondToCommand("3.5", ch)
+
+	// cancel a command that's being executed
+	ctx, cancel = context.WithCancel(context.Background())
+	query(ctx, "MEAS:VOLT?")
+	tester.expectCommand("MEAS:VOLT?")
+	cancel()
+	verifyCancelled()
+
+	// make sure the commander still works
+	tester.chat("CURR?", "3.4", func() (string, error) {
+		return commander.Query(context.Background(), "CURR?", nil, PriorityBackground)
+	})
+}
+
 type queueItem struct {
-	query, resp       string
-	fixedResponseSize int
+	query, resp string
+	framer      Framer
+}
+
+func TestCloseWhileCommandFinishes(t *testing.T) {
+	tester := newCmdTester(t, samplePort)
+	commander := NewCommander(tester.connect, &PortSettings{Port: samplePort})
+	commander.Connect()
+	<-commander.Ready()
+	commander.SetClock(tester)
+
+	respCh := make(chan string)
+	go func() {
+		resp, err := commander.Query(context.Background(), "*IDN?", nil, PriorityBackground)
+		if err != nil {
+			t.Errorf("Query(): %v", err)
+		}
+		respCh <- resp
+	}()
+	tester.expectCommand("*IDN?")
+	// make the command finish while the disconnect is in progress
+	commander.Lock()
+	tester.writeResponse("IZNAKURNOZH")
+	if resp := <-respCh; resp != "IZNAKURNOZH" {
+		t.Errorf("bad response %q", resp)
+	}
+	doneCh := make(chan struct{})
+	go func() {
+		commander.enterState(commander.state.Disconnect(commander))
+		close(doneCh)
+	}()
+	select {
+	case <-doneCh:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("disconnect deadlocked")
+	}
+	commander.Unlock()
+
+	// the late CommandFinished call must not
+	// affect the state after disconnecting
+	commander.Close()
+	commander.Lock()
+	defer commander.Unlock()
+	if _, ok := commander.state.(*commanderStateOffline); !ok {
+		t.Errorf("bad state after Close(): %T", commander.state)
+	}
 }
 
 type fakeCommander struct {
@@ -430,7 +964,10 @@ func (c *fakeCommander) Ready() <-chan struct{} {
 	return c.readyCh
 }
 
-func (c *fakeCommander) Query(query string, fixedResponseSize int) (string, error) {
+func (c *fakeCommander) Query(ctx context.Context, query string, framer Framer, priority CommandPriority) (string, error) {
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
 	if !c.connected {
 		err := errors.New("fakeCommander: not connected")
 		c.t.Error(err)
@@ -448,14 +985,28 @@ func (c *fakeCommander) Query(query string, fixedResponseSize int) (string, erro
 		c.t.Error(err)
 		return "", err
 	}
-	if item.fixedResponseSize != fixedResponseSize {
-		err := fmt.Errorf("fakeCommander: bad fixedResponseSize: %d instead of %d", fixedResponseSize, item.fixedResponseSize)
+	if !reflect.DeepEqual(item.framer, framer) {
+		err := fmt.Errorf("fakeCommander: bad framer: %#v instead of %#v", framer, item.framer)
 		c.t.Error(err)
 		return "", err
 	}
 	return item.resp, nil
 }
 
+func (c *fakeCommander) Exchange(ctx context.Context, request []byte, framer Framer, priority CommandPriority) ([]byte, error) {
+	err := errors.New("fakeCommander: binary frames aren't supported")
+	c.t.Error(err)
+	return nil, err
+}
+
+func (c *fakeCommander) SafeState(ctx context.Context) error {
+	return nil
+}
+
+func (c *fakeCommander) Diagnostics() CommanderDiagnostics {
+	return CommanderDiagnostics{Connected: c.connected}
+}
+
 func (c *fakeCommander) Close() {
 	c.connected = false
 }
@@ -464,7 +1015,7 @@ func (c *fakeCommander) enqueue(items ...interface{}) {
 	for i := 0; i < len(items); {
 		qi := queueItem{}
 		var ok bool
-		qi.fixedResponseSize, ok = items[i].(int)
+		qi.framer, ok = items[i].(Framer)
 		if ok {
 			i++
 		}
@@ -480,10 +1031,6 @@ func (c *fakeCommander) enqueue(items ...interface{}) {
 			c.t.Fatalf("response must be a string but got %#v", items[i+1])
 		}
 
-		if qi.fixedResponseSize != 0 && len(qi.resp) != qi.fixedResponseSize {
-			c.t.Fatalf("fixedResponseSize %d doesn't match the length of the response (%d): %q", qi.fixedResponseSize, len(qi.resp), qi.resp)
-		}
-
 		i += 2
 		c.queue = append(c.queue, qi)
 	}
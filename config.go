@@ -4,7 +4,9 @@ import (
 	"errors"
 	"fmt"
 	"reflect"
+	"sort"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/go-yaml/yaml"
@@ -22,7 +24,22 @@ type ControlConfig struct {
 	Units    string
 	Type     string
 	Writable bool
-	Enum     map[int]string
+	// Enum maps the device values to the names that are
+	// displayed for the control. The keys may be either
+	// numbers or strings such as 'CV' or 'CC'
+	Enum map[string]string
+	// Min and Max limit the values that can be set. The writes
+	// of the values outside the range fail rather than being
+	// clamped. They're published as meta/min and meta/max
+	Min *float64
+	Max *float64
+	// Precision specifies the number of decimal places
+	// to be displayed for the value
+	Precision *int
+	// Order specifies the position of the control among
+	// the controls of the device. Zero means the default
+	// order, i.e. the one assigned by wbgo
+	Order int
 }
 
 type ParameterSpec interface {
@@ -42,25 +59,394 @@ type ParameterSpec interface {
 	// Validate checks if ParameterSpec is valid and returns an
 	// error if it isn't
 	Validate() error
+	// Polling returns the poll settings of the parameter
+	Polling() *PollSettings
+}
+
+// ChannelParameterSpec is implemented by the parameter specs
+// that can be instantiated for each channel of multi-channel
+// devices
+type ChannelParameterSpec interface {
+	ParameterSpec
+	// ForChannels returns the list of parameter specs for the
+	// channels. selectCommand is the channel selection command
+	// with '{ch}' placeholder, or an empty string. If the
+	// parameter isn't per-channel, the list contains just
+	// the parameter itself
+	ForChannels(channels []int, selectCommand string) ([]ParameterSpec, error)
+}
+
+const (
+	channelPlaceholder = "{ch}"
+	addressPlaceholder = "{addr}"
+)
+
+// channelTemplate replaces the channel placeholder in the string
+func channelTemplate(s string, channel int) string {
+	return strings.Replace(s, channelPlaceholder, strconv.Itoa(channel), -1)
+}
+
+// ForChannel returns a copy of the control for the channel.
+// The channel number is appended to the name and the title
+func (c *ControlConfig) ForChannel(channel int) *ControlConfig {
+	r := *c
+	r.Name = fmt.Sprintf("%s_%d", c.Name, channel)
+	if c.Title != "" {
+		r.Title = fmt.Sprintf("%s %d", c.Title, channel)
+	}
+	return &r
+}
+
+// PollSettings specifies how the parameter is polled
+type PollSettings struct {
+	// PollInterval specifies the minimum interval between
+	// the polls of the parameter. Zero means polling
+	// the parameter on each poll cycle
+	PollInterval time.Duration
+	// Priority specifies the polling priority of the
+	// parameter. Parameters with higher priority are polled
+	// first during the poll cycle
+	Priority int
+	// ReadOnce specifies that the parameter should only be
+	// read once after the device is identified
+	ReadOnce bool
+}
+
+func (s *PollSettings) Polling() *PollSettings {
+	return s
+}
+
+func (s *PollSettings) Validate() error {
+	switch {
+	case s.PollInterval < 0:
+		return fmt.Errorf("bad poll interval %v", s.PollInterval)
+	case s.ReadOnce && s.PollInterval != 0:
+		return errors.New("can't specify poll interval for read-once parameter")
+	}
+	return nil
+}
+
+const (
+	defaultIdentifyAttempts = 10
+	defaultBaudRate         = 9600
+	defaultDataBits         = 8
+	defaultParity           = "N"
+	defaultStopBits         = 1
+)
+
+// LineSettings specifies serial line parameters of the port.
+// Zero values mean the defaults (9600 8N1)
+type LineSettings struct {
+	BaudRate int
+	DataBits int
+	// Parity can be 'N' (none), 'E' (even) or 'O' (odd)
+	Parity        string
+	StopBits      int
+	ReadTimeoutMs int
+}
+
+// Normalize returns a copy of the line settings with
+// default values filled in
+func (s LineSettings) Normalize() LineSettings {
+	if s.BaudRate == 0 {
+		s.BaudRate = defaultBaudRate
+	}
+	if s.DataBits == 0 {
+		s.DataBits = defaultDataBits
+	}
+	if s.Parity == "" {
+		s.Parity = defaultParity
+	}
+	if s.StopBits == 0 {
+		s.StopBits = defaultStopBits
+	}
+	if s.ReadTimeoutMs == 0 {
+		s.ReadTimeoutMs = int(serialTimeout / time.Millisecond)
+	}
+	return s
+}
+
+func (s LineSettings) ReadTimeout() time.Duration {
+	return time.Duration(s.Normalize().ReadTimeoutMs) * time.Millisecond
+}
+
+func (s LineSettings) Validate() error {
+	switch {
+	case s.BaudRate < 0:
+		return fmt.Errorf("bad baud rate %d", s.BaudRate)
+	case s.DataBits != 0 && (s.DataBits < 5 || s.DataBits > 8):
+		return fmt.Errorf("bad data bits %d (must be 5, 6, 7 or 8)", s.DataBits)
+	case s.Parity != "" && s.Parity != "N" && s.Parity != "E" && s.Parity != "O":
+		return fmt.Errorf("bad parity %q (must be N, E or O)", s.Parity)
+	case s.StopBits != 0 && s.StopBits != 1 && s.StopBits != 2:
+		return fmt.Errorf("bad stop bits %d (must be 1 or 2)", s.StopBits)
+	case s.ReadTimeoutMs < 0:
+		return fmt.Errorf("bad read timeout %d", s.ReadTimeoutMs)
+	}
+	return nil
+}
+
+// TimingSettings specifies timeouts and retry counts used
+// when talking to the device. Zero values mean the defaults
+type TimingSettings struct {
+	// CommandTimeoutMs specifies how long to wait for the
+	// device response
+	CommandTimeoutMs int
+	// ReconnectDelayMs specifies the delay before the first
+	// reconnection attempt. The delay is doubled after each
+	// failed attempt up to MaxReconnectDelayMs
+	ReconnectDelayMs    int
+	MaxReconnectDelayMs int
+	// ReconnectJitterPercent specifies random variation of
+	// the reconnection delay so that the ports sharing the same
+	// gateway don't reconnect in lockstep. Zero means no jitter
+	ReconnectJitterPercent int
+	// DrainTimeoutMs specifies how long to wait for any stray
+	// incoming data before sending a command
+	DrainTimeoutMs int
+	// TcpTimeoutMs specifies the connection timeout for TCP ports
+	TcpTimeoutMs int
+	// IdentifyAttempts specifies the number of attempts to
+	// identify the device
+	IdentifyAttempts int
+}
+
+// Normalize returns a copy of the timing settings with
+// default values filled in
+func (s TimingSettings) Normalize() TimingSettings {
+	if s.CommandTimeoutMs == 0 {
+		s.CommandTimeoutMs = int(commanderTimeout / time.Millisecond)
+	}
+	if s.ReconnectDelayMs == 0 {
+		s.ReconnectDelayMs = int(reconnectDelay / time.Millisecond)
+	}
+	if s.MaxReconnectDelayMs == 0 {
+		s.MaxReconnectDelayMs = int(maxReconnectDelay / time.Millisecond)
+	}
+	if s.DrainTimeoutMs == 0 {
+		s.DrainTimeoutMs = int(drainTimeout / time.Millisecond)
+	}
+	if s.TcpTimeoutMs == 0 {
+		s.TcpTimeoutMs = int(tcpTimeout / time.Millisecond)
+	}
+	if s.IdentifyAttempts == 0 {
+		s.IdentifyAttempts = defaultIdentifyAttempts
+	}
+	return s
+}
+
+func (s TimingSettings) CommandTimeout() time.Duration {
+	return time.Duration(s.Normalize().CommandTimeoutMs) * time.Millisecond
+}
+
+func (s TimingSettings) ReconnectDelay() time.Duration {
+	return time.Duration(s.Normalize().ReconnectDelayMs) * time.Millisecond
+}
+
+func (s TimingSettings) MaxReconnectDelay() time.Duration {
+	return time.Duration(s.Normalize().MaxReconnectDelayMs) * time.Millisecond
+}
+
+// ReconnectBackoff returns the delay before the reconnection attempt
+// number attempt (starting from 0). random must be a number in
+// [0, 1) range that's used to apply the jitter
+func (s TimingSettings) ReconnectBackoff(attempt int, random float64) time.Duration {
+	d, max := s.ReconnectDelay(), s.MaxReconnectDelay()
+	for i := 0; i < attempt && d < max; i++ {
+		d *= 2
+	}
+	if d > max {
+		d = max
+	}
+	if s.ReconnectJitterPercent > 0 {
+		d += time.Duration(float64(d) * float64(s.ReconnectJitterPercent) / 100 * (2*random - 1))
+	}
+	return d
+}
+
+func (s TimingSettings) DrainTimeout() time.Duration {
+	return time.Duration(s.Normalize().DrainTimeoutMs) * time.Millisecond
+}
+
+func (s TimingSettings) TcpTimeout() time.Duration {
+	return time.Duration(s.Normalize().TcpTimeoutMs) * time.Millisecond
+}
+
+func (s TimingSettings) NumIdentifyAttempts() int {
+	return s.Normalize().IdentifyAttempts
+}
+
+func (s TimingSettings) Validate() error {
+	switch {
+	case s.CommandTimeoutMs < 0:
+		return fmt.Errorf("bad command timeout %d", s.CommandTimeoutMs)
+	case s.ReconnectDelayMs < 0:
+		return fmt.Errorf("bad reconnect delay %d", s.ReconnectDelayMs)
+	case s.MaxReconnectDelayMs < 0:
+		return fmt.Errorf("bad max reconnect delay %d", s.MaxReconnectDelayMs)
+	case s.ReconnectDelayMs > 0 && s.MaxReconnectDelayMs > 0 && s.ReconnectDelayMs > s.MaxReconnectDelayMs:
+		return fmt.Errorf("reconnect delay %d is greater than max reconnect delay %d", s.ReconnectDelayMs, s.MaxReconnectDelayMs)
+	case s.ReconnectJitterPercent < 0 || s.ReconnectJitterPercent > 100:
+		return fmt.Errorf("bad reconnect jitter %d%% (must be between 0 and 100)", s.ReconnectJitterPercent)
+	case s.DrainTimeoutMs < 0:
+		return fmt.Errorf("bad drain timeout %d", s.DrainTimeoutMs)
+	case s.TcpTimeoutMs < 0:
+		return fmt.Errorf("bad tcp timeout %d", s.TcpTimeoutMs)
+	case s.IdentifyAttempts < 0:
+		return fmt.Errorf("bad number of identify attempts %d", s.IdentifyAttempts)
+	}
+	return nil
+}
+
+// PortDefaults specifies driver-wide defaults for the port settings
+type PortDefaults struct {
+	LineSettings   `yaml:",inline"`
+	TimingSettings `yaml:",inline"`
+}
+
+// fillDefaults replaces zero fields of the struct pointed
+// to by dest with corresponding fields of defaults, which
+// must be a struct of the same type
+func fillDefaults(dest, defaults interface{}) {
+	d := reflect.ValueOf(dest).Elem()
+	v := reflect.ValueOf(defaults)
+	for i := 0; i < d.NumField(); i++ {
+		f := d.Field(i)
+		if reflect.DeepEqual(f.Interface(), reflect.Zero(f.Type()).Interface()) {
+			f.Set(v.Field(i))
+		}
+	}
 }
 
 type PortSettings struct {
 	Name  string
 	Title string
-	Port  string
+	// Port is either a serial port device such as /dev/ttyS0,
+	// host:port (optionally prefixed with tcp://) for raw TCP
+	// connections, or rfc2217://host:port for the terminal
+	// servers that support RFC 2217. In the latter case, the
+	// line settings are applied to the terminal server port.
+	// LAN instruments can be accessed using
+	// vxi11://host[:port][/device] (device defaults to inst0,
+	// the port is looked up using the portmapper if it's not
+	// specified) or hislip://host[:port][/device] (the port
+	// defaults to 4880 and the device to hislip0).
+	// The devices sharing a port must have the same line,
+	// timing, setup and safe state settings, line ending
+	// and command delay
+	Port string
 	// LineEnding can be 'crlf' (default) or 'lf', or empty meaning the default
 	// TODO: the default should be taken from the protocol
 	LineEnding  string
 	IdSubstring string
 	Protocol    string
-	Prefix      string // FIXME: use protocol-specific address spec
+	// Prefix is prepended to each command of SCPI devices.
+	// It can't be used together with Setup because setup
+	// commands aren't addressed.
+	// Deprecated: use AddressFormat instead
+	Prefix string
 	// Resync specifies that identification procedure should
-	// be invoked on each poll cycle. This helps with SCPI
-	// devices that go out of sync
+	// be invoked on each poll cycle that has parameters due.
+	// This helps with SCPI devices that go out of sync
 	Resync         bool
 	CommandDelayMs int
 	Setup          []*SetupItem
-	Address        int // TODO: use this instead of prefix
+	// SafeState specifies the commands that put the device
+	// into a safe state, e.g. turn off the output of a power
+	// supply. They're sent on graceful shutdown and, if
+	// SafeStateOnReconnect is set, after reconnecting
+	// following an unexpected disconnect. The failure to enter
+	// the safe state after reconnecting is reported as
+	// meta/error of 'online' control. The devices sharing
+	// a port must have the same safe state settings
+	SafeState            []*SetupItem
+	SafeStateOnReconnect bool
+	// CheckErrors specifies that the device errors should be
+	// checked after setting the values and on each poll cycle
+	// that reads any parameters. The last error is published
+	// as a device control
+	CheckErrors bool
+	// Address is the address of the device on the bus
+	Address int
+	// AddressFormat specifies how the commands are addressed
+	// to the SCPI devices that share the bus. '{addr}' in it
+	// is replaced with Address, and the result is prepended
+	// to each command line, e.g. 'ADDR {addr};'. Setup and
+	// safe state commands belong to the port rather than to
+	// the device, so they're sent as is
+	AddressFormat string
+	// Framing specifies the framing used by Modbus devices,
+	// 'rtu' (default) or 'tcp'
+	Framing string
+	// Checksum enables the checksums for the Edwards devices
+	Checksum bool
+	// Diagnostics specifies that diagnostic controls such as
+	// the number of reconnection attempts should be published
+	// for the device
+	Diagnostics bool
+	// Channels lists the channel numbers of multi-channel
+	// devices. Per-channel parameters are instantiated
+	// for each of the channels
+	Channels []int
+	// ChannelSelect is the command that selects the channel
+	// for per-channel parameters, e.g. 'INST:NSEL {ch}'.
+	// It's sent together with each per-channel command
+	ChannelSelect  string
+	LineSettings   `yaml:",inline"`
+	TimingSettings `yaml:",inline"`
+}
+
+func (s *PortSettings) applyDefaults(defaults *PortDefaults) {
+	fillDefaults(&s.LineSettings, defaults.LineSettings)
+	fillDefaults(&s.TimingSettings, defaults.TimingSettings)
+}
+
+func (s *PortSettings) validateChannels() error {
+	seen := make(map[int]bool)
+	for _, ch := range s.Channels {
+		switch {
+		case ch < 0:
+			return fmt.Errorf("bad channel %d", ch)
+		case seen[ch]:
+			return fmt.Errorf("duplicate channel %d", ch)
+		}
+		seen[ch] = true
+	}
+	switch {
+	case s.ChannelSelect == "":
+		return nil
+	case len(s.Channels) == 0:
+		return errors.New("channel select command specified without channels")
+	case !strings.Contains(s.ChannelSelect, channelPlaceholder):
+		return fmt.Errorf("channel select command %q doesn't contain %s", s.ChannelSelect, channelPlaceholder)
+	}
+	return nil
+}
+
+// AddressPrefix returns the prefix that's prepended to the
+// commands to address them to the device
+func (s *PortSettings) AddressPrefix() string {
+	if s.AddressFormat == "" {
+		return s.Prefix
+	}
+	return strings.Replace(s.AddressFormat, addressPlaceholder, strconv.Itoa(s.Address), -1)
+}
+
+// LineTerminator returns the characters that correspond
+// to LineEnding
+func (s *PortSettings) LineTerminator() string {
+	switch s.LineEnding {
+	case "cr":
+		return "\r"
+	case "lf":
+		return "\n"
+	case "":
+		fallthrough
+	case "crlf":
+		return "\r\n"
+	default:
+		panic("bad line ending spec: " + s.LineEnding)
+	}
 }
 
 func (s *PortSettings) CommandDelay() time.Duration {
@@ -73,7 +459,8 @@ type PortConfig struct {
 }
 
 type DriverConfig struct {
-	Ports []*PortConfig
+	Defaults *PortDefaults
+	Ports    []*PortConfig
 }
 
 type ParameterUnmarshaler func(unmarshal func(interface{}) error) ([]ParameterSpec, error)
@@ -87,20 +474,86 @@ func (c *ControlConfig) TransformDeviceValue(v interface{}) string {
 	if c.Enum == nil {
 		return s
 	}
-	n, err := strconv.Atoi(s)
+	if name, found := c.Enum[s]; found {
+		return name
+	}
+	// handle numeric values such as '+1' or '01'
+	n, err := strconv.Atoi(strings.TrimSpace(s))
 	if err != nil {
 		return s
 	}
-	if name, found := c.Enum[n]; found {
+	if name, found := c.Enum[strconv.Itoa(n)]; found {
 		return name
 	}
 	return s
 }
 
+// TransformControlValue converts the value of the control to the
+// device value. For enum controls, the value may be either the
+// name or the device value. If several device values have the
+// same name, the lowest one is used
+func (c *ControlConfig) TransformControlValue(value string) (string, error) {
+	if c.Enum == nil {
+		return value, nil
+	}
+	if _, found := c.Enum[value]; found {
+		return value, nil
+	}
+	var keys []string
+	for k, name := range c.Enum {
+		if name == value {
+			keys = append(keys, k)
+		}
+	}
+	if len(keys) == 0 {
+		if n, err := strconv.Atoi(value); err == nil {
+			if _, found := c.Enum[strconv.Itoa(n)]; found {
+				return strconv.Itoa(n), nil
+			}
+		}
+		return "", fmt.Errorf("unknown enum value %q", value)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		a, errA := strconv.Atoi(keys[i])
+		b, errB := strconv.Atoi(keys[j])
+		if errA == nil && errB == nil {
+			return a < b
+		}
+		return keys[i] < keys[j]
+	})
+	return keys[0], nil
+}
+
+// CheckRange returns an error if the value is out of the
+// range that's specified by Min and Max
+func (c *ControlConfig) CheckRange(value string) error {
+	if c.Min == nil && c.Max == nil {
+		return nil
+	}
+	v, err := strconv.ParseFloat(value, 64)
+	switch {
+	case err != nil:
+		return fmt.Errorf("bad numeric value %q", value)
+	case c.Min != nil && v < *c.Min:
+		return fmt.Errorf("value %s is less than min %v", value, *c.Min)
+	case c.Max != nil && v > *c.Max:
+		return fmt.Errorf("value %s is greater than max %v", value, *c.Max)
+	}
+	return nil
+}
+
 func (c *ControlConfig) Validate() error {
 	if c.Name == "" {
 		return errors.New("got control without name")
 	}
+	switch {
+	case c.Min != nil && c.Max != nil && *c.Min > *c.Max:
+		return fmt.Errorf("min is greater than max for control %q", c.Name)
+	case c.Precision != nil && *c.Precision < 0:
+		return fmt.Errorf("bad precision %d for control %q", *c.Precision, c.Name)
+	case c.Order < 0:
+		return fmt.Errorf("bad order %d for control %q", c.Order, c.Name)
+	}
 	// FIXME: should do this validation on merged controls
 	// if c.Type == "" {
 	// 	return fmt.Errorf("no type specified for control %q", c.Name)
@@ -138,6 +591,28 @@ func mergeControls(a, b *ControlConfig) (*ControlConfig, error) {
 	} else if b.Enum != nil {
 		return nil, fmt.Errorf("enum conflict for %q", a.Name)
 	}
+	switch {
+	case a.Min != nil && b.Min != nil && *a.Min != *b.Min:
+		return nil, fmt.Errorf("merge: min conflict for %q", a.Name)
+	case a.Max != nil && b.Max != nil && *a.Max != *b.Max:
+		return nil, fmt.Errorf("merge: max conflict for %q", a.Name)
+	case a.Precision != nil && b.Precision != nil && *a.Precision != *b.Precision:
+		return nil, fmt.Errorf("merge: precision conflict for %q", a.Name)
+	case a.Order != 0 && b.Order != 0 && a.Order != b.Order:
+		return nil, fmt.Errorf("merge: order conflict for %q", a.Name)
+	}
+	if a.Min == nil {
+		r.Min = b.Min
+	}
+	if a.Max == nil {
+		r.Max = b.Max
+	}
+	if a.Precision == nil {
+		r.Precision = b.Precision
+	}
+	if a.Order == 0 {
+		r.Order = b.Order
+	}
 	return &r, nil
 }
 
@@ -197,6 +672,27 @@ func (config *PortConfig) UnmarshalYAML(unmarshal func(interface{}) error) error
 		return errors.New("must specify the protocol")
 	}
 
+	if err := settings.LineSettings.Validate(); err != nil {
+		return fmt.Errorf("port %q: %v", settings.Name, err)
+	}
+
+	if err := settings.TimingSettings.Validate(); err != nil {
+		return fmt.Errorf("port %q: %v", settings.Name, err)
+	}
+
+	if err := settings.validateChannels(); err != nil {
+		return fmt.Errorf("port %q: %v", settings.Name, err)
+	}
+
+	if settings.Prefix != "" && settings.AddressFormat != "" {
+		return fmt.Errorf("port %q: can't specify both prefix and address format", settings.Name)
+	}
+
+	if settings.Prefix != "" && len(settings.Setup) > 0 {
+		// the setup commands used to be prefixed, too
+		return fmt.Errorf("port %q: setup commands aren't prefixed, use address format and include the address in the setup commands", settings.Name)
+	}
+
 	makeParamList, found := paramFactories[settings.Protocol]
 	if !found {
 		return fmt.Errorf("unknown protocol %q", settings.Protocol)
@@ -209,13 +705,34 @@ func (config *PortConfig) UnmarshalYAML(unmarshal func(interface{}) error) error
 
 	config.PortSettings = &settings
 	params := reflect.ValueOf(paramList).Elem().FieldByName("Parameters")
-	config.Parameters = make([]ParameterSpec, params.Len())
+	config.Parameters = make([]ParameterSpec, 0, params.Len())
 	for i := 0; i < params.Len(); i++ {
 		spec := params.Index(i).Interface().(ParameterSpec)
 		if err := spec.Validate(); err != nil {
 			return err
 		}
-		config.Parameters[i] = spec
+		channelSpec, ok := spec.(ChannelParameterSpec)
+		if !ok {
+			config.Parameters = append(config.Parameters, spec)
+			continue
+		}
+		specs, err := channelSpec.ForChannels(settings.Channels, settings.ChannelSelect)
+		if err != nil {
+			return fmt.Errorf("port %q: %v", settings.Name, err)
+		}
+		config.Parameters = append(config.Parameters, specs...)
+	}
+
+	if settings.AddressPrefix() != "" {
+		// the prefix would be silently ignored by the protocols
+		// that don't address the commands themselves
+		protocol, err := CreateProtocol(config)
+		if err != nil {
+			return fmt.Errorf("port %q: %v", settings.Name, err)
+		}
+		if _, ok := protocol.(Addresser); !ok {
+			return fmt.Errorf("port %q: protocol %q doesn't support prefix and address format", settings.Name, settings.Protocol)
+		}
 	}
 
 	return nil
@@ -228,6 +745,23 @@ func ParseDriverConfig(in []byte) (*DriverConfig, error) {
 	if err != nil {
 		return nil, err
 	}
+	if cfg.Defaults != nil {
+		if err := cfg.Defaults.LineSettings.Validate(); err != nil {
+			return nil, fmt.Errorf("defaults: %v", err)
+		}
+		if err := cfg.Defaults.TimingSettings.Validate(); err != nil {
+			return nil, fmt.Errorf("defaults: %v", err)
+		}
+		for _, port := range cfg.Ports {
+			port.applyDefaults(cfg.Defaults)
+		}
+	}
+	for _, port := range cfg.Ports {
+		// the reconnect delays may come from the defaults
+		if err := port.TimingSettings.Normalize().Validate(); err != nil {
+			return nil, fmt.Errorf("port %q: %v", port.Name, err)
+		}
+	}
 	return &cfg, nil
 }
 
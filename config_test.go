@@ -5,13 +5,15 @@ import (
 	"reflect"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/davecgh/go-spew/spew"
 )
 
 type sampleParameterSpec struct {
-	Controls   []*ControlConfig
-	SampleName string
+	Controls     []*ControlConfig
+	SampleName   string
+	PollSettings `yaml:",inline"`
 }
 
 var _ ParameterSpec = &sampleParameterSpec{}
@@ -44,6 +46,9 @@ func (spec *sampleParameterSpec) Validate() error {
 			return err
 		}
 	}
+	if err := spec.PollSettings.Validate(); err != nil {
+		return err
+	}
 	if spec.SampleName == "" {
 		return errors.New("SampleName not specified")
 	}
@@ -54,6 +59,10 @@ func (spec *sampleParameterSpec) Validate() error {
 }
 
 var sampleConfigStr = `
+defaults:
+  draintimeoutms: 100
+  reconnectdelayms: 1000
+  commandtimeoutms: 10000
 ports:
 - name: somedev
   title: Some Device
@@ -61,10 +70,19 @@ ports:
   protocol: sample
   idsubstring: some_dev_id
   commanddelayms: 42
+  baudrate: 19200
+  databits: 7
+  parity: E
+  readtimeoutms: 1000
+  commandtimeoutms: 3000
+  identifyattempts: 3
   setup:
   - command: :SYST:REM
   - command: WHATEVER
     response: ORLY
+  safestate:
+  - command: OUTP 0
+  safestateonreconnect: true
   parameters:
   - samplename: CURRVOLT
     controls:
@@ -85,12 +103,15 @@ ports:
       type: voltage
       writable: true
   - samplename: MEAS:CURR
+    pollinterval: 5s
+    priority: 1
     controls:
     - name: mcurrent1
       title: Measured Current 1
       units: A
       type: current
   - samplename: MODE
+    readonce: true
     controls:
     - name: mode
       title: Mode
@@ -104,6 +125,13 @@ enums:
 `
 
 var sampleParsedConfig = &DriverConfig{
+	Defaults: &PortDefaults{
+		TimingSettings: TimingSettings{
+			CommandTimeoutMs: 10000,
+			ReconnectDelayMs: 1000,
+			DrainTimeoutMs:   100,
+		},
+	},
 	Ports: []*PortConfig{
 		{
 			PortSettings: &PortSettings{
@@ -113,6 +141,19 @@ var sampleParsedConfig = &DriverConfig{
 				IdSubstring:    "some_dev_id",
 				CommandDelayMs: 42,
 				Protocol:       "sample",
+				LineSettings: LineSettings{
+					BaudRate:      19200,
+					DataBits:      7,
+					Parity:        "E",
+					ReadTimeoutMs: 1000,
+				},
+				TimingSettings: TimingSettings{
+					// port-specific value overrides the default
+					CommandTimeoutMs: 3000,
+					ReconnectDelayMs: 1000,
+					DrainTimeoutMs:   100,
+					IdentifyAttempts: 3,
+				},
 				Setup: []*SetupItem{
 					{
 						Command: ":SYST:REM",
@@ -122,6 +163,12 @@ var sampleParsedConfig = &DriverConfig{
 						Response: "ORLY",
 					},
 				},
+				SafeState: []*SetupItem{
+					{
+						Command: "OUTP 0",
+					},
+				},
+				SafeStateOnReconnect: true,
 			},
 			Parameters: []ParameterSpec{
 				&sampleParameterSpec{
@@ -169,6 +216,10 @@ var sampleParsedConfig = &DriverConfig{
 						},
 					},
 					SampleName: "MEAS:CURR",
+					PollSettings: PollSettings{
+						PollInterval: 5 * time.Second,
+						Priority:     1,
+					},
 				},
 				&sampleParameterSpec{
 					Controls: []*ControlConfig{
@@ -176,14 +227,17 @@ var sampleParsedConfig = &DriverConfig{
 							Name:  "mode",
 							Title: "Mode",
 							Type:  "text",
-							Enum: map[int]string{
-								0: "x",
-								1: "y",
-								2: "z",
+							Enum: map[string]string{
+								"0": "x",
+								"1": "y",
+								"2": "z",
 							},
 						},
 					},
 					SampleName: "MODE",
+					PollSettings: PollSettings{
+						ReadOnce: true,
+					},
 				},
 			},
 		},
@@ -228,10 +282,10 @@ func TestGetControls(t *testing.T) {
 			Name:  "mode",
 			Title: "Mode",
 			Type:  "text",
-			Enum: map[int]string{
-				0: "x",
-				1: "y",
-				2: "z",
+			Enum: map[string]string{
+				"0": "x",
+				"1": "y",
+				"2": "z",
 			},
 		},
 	}
@@ -254,14 +308,94 @@ func TestGetControls(t *testing.T) {
 	}
 }
 
+func TestEnumValues(t *testing.T) {
+	config := &ControlConfig{
+		Name: "mode",
+		Enum: map[string]string{
+			"0":  "Off",
+			"1":  "Fault",
+			"2":  "Fault",
+			"CV": "Constant voltage",
+		},
+	}
+	for _, tc := range []struct{ deviceValue, name string }{
+		{"0", "Off"},
+		{"+1", "Fault"},
+		{"CV", "Constant voltage"},
+		{"CC", "CC"},
+	} {
+		if name := config.TransformDeviceValue(tc.deviceValue); name != tc.name {
+			t.Errorf("TransformDeviceValue(%q): got %q instead of %q", tc.deviceValue, name, tc.name)
+		}
+	}
+	for _, tc := range []struct{ value, deviceValue string }{
+		{"Off", "0"},
+		{"0", "0"},
+		{"01", "1"},
+		{"Fault", "1"},
+		{"Constant voltage", "CV"},
+		{"CV", "CV"},
+	} {
+		switch deviceValue, err := config.TransformControlValue(tc.value); {
+		case err != nil:
+			t.Errorf("TransformControlValue(%q): %v", tc.value, err)
+		case deviceValue != tc.deviceValue:
+			t.Errorf("TransformControlValue(%q): got %q instead of %q", tc.value, deviceValue, tc.deviceValue)
+		}
+	}
+	if _, err := config.TransformControlValue("Constant current"); err == nil {
+		t.Errorf("TransformControlValue() didn't fail for unknown name")
+	}
+}
+
+func TestReconnectBackoffDelays(t *testing.T) {
+	settings := TimingSettings{
+		ReconnectDelayMs:       1000,
+		MaxReconnectDelayMs:    5000,
+		ReconnectJitterPercent: 20,
+	}
+	for _, testCase := range []struct {
+		attempt  int
+		random   float64
+		expected time.Duration
+	}{
+		{0, 0.5, 1000 * time.Millisecond},
+		{1, 0.5, 2000 * time.Millisecond},
+		{2, 0.5, 4000 * time.Millisecond},
+		{3, 0.5, 5000 * time.Millisecond},
+		{100, 0.5, 5000 * time.Millisecond},
+		{0, 0, 800 * time.Millisecond},
+		{1, 0.75, 2200 * time.Millisecond},
+		{3, 0, 4000 * time.Millisecond},
+	} {
+		if d := settings.ReconnectBackoff(testCase.attempt, testCase.random); d != testCase.expected {
+			t.Errorf("bad backoff for attempt %d, random %v: %v instead of %v", testCase.attempt, testCase.random, d, testCase.expected)
+		}
+	}
+}
+
 func TestValidationFailures(t *testing.T) {
 	RegisterProtocolConfig("sample", &sampleParameterSpec{})
 	for _, testCase := range []struct{ old, new, errStr string }{
 		{"samplename: CURRVOLT", "#", "SampleName not specified"},
 		{"samplename: CURRVOLT", "samplename: XXX", "SampleName XXX is prohibited"},
 		{"name: mcurrent1", "#", "got control without name"},
+		{"baudrate: 19200", "baudrate: -1", `port "somedev": bad baud rate -1`},
+		{"databits: 7", "databits: 9", `port "somedev": bad data bits 9 (must be 5, 6, 7 or 8)`},
+		{"parity: E", "parity: X", `port "somedev": bad parity "X" (must be N, E or O)`},
+		{"parity: E", "stopbits: 3", `port "somedev": bad stop bits 3 (must be 1 or 2)`},
+		{"readtimeoutms: 1000", "readtimeoutms: -1", `port "somedev": bad read timeout -1`},
+		{"commandtimeoutms: 3000", "commandtimeoutms: -1", `port "somedev": bad command timeout -1`},
+		{"identifyattempts: 3", "identifyattempts: -1", `port "somedev": bad number of identify attempts -1`},
+		{"identifyattempts: 3", "reconnectjitterpercent: 101", `port "somedev": bad reconnect jitter 101% (must be between 0 and 100)`},
+		{"draintimeoutms: 100", "draintimeoutms: -1", `defaults: bad drain timeout -1`},
+		{"identifyattempts: 3", "reconnectdelayms: 5000\n  maxreconnectdelayms: 2000", `port "somedev": reconnect delay 5000 is greater than max reconnect delay 2000`},
+		{"reconnectdelayms: 1000", "reconnectdelayms: 90000", `port "somedev": reconnect delay 90000 is greater than max reconnect delay 60000`},
 		// TODO: should validate merged controls
 		// {"type: voltage", "#", `no type specified for control "voltage1"`},
+		{"pollinterval: 5s", "pollinterval: -5s", "bad poll interval -5s"},
+		{"readonce: true", "readonce: true\n    pollinterval: 1s", "can't specify poll interval for read-once parameter"},
+		{"type: voltage", "type: voltage\n      min: 10\n      max: 5", `min is greater than max for control "voltage1"`},
 	} {
 		_, err := ParseDriverConfig([]byte(strings.Replace(sampleConfigStr, testCase.old, testCase.new, -1)))
 		switch {
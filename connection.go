@@ -4,11 +4,13 @@ import (
 	"github.com/goburrow/serial"
 	"io"
 	"net"
+	"strconv"
 	"strings"
 	"time"
 )
 
 const (
+	// the defaults for the corresponding port settings
 	serialTimeout = 500 * time.Millisecond
 	tcpTimeout    = 500 * time.Millisecond
 )
@@ -31,25 +33,119 @@ func (w *serialWrapper) Write(b []byte) (n int, err error) {
 	return
 }
 
-// func (w *netWrapper) Read(p []byte) ()
-func connect(serialAddress string) (io.ReadWriteCloser, error) {
+func serialConfig(settings *PortSettings) *serial.Config {
+	lineSettings := settings.LineSettings.Normalize()
+	return &serial.Config{
+		Address:  settings.Port,
+		BaudRate: lineSettings.BaudRate,
+		DataBits: lineSettings.DataBits,
+		StopBits: lineSettings.StopBits,
+		Parity:   lineSettings.Parity,
+		Timeout:  lineSettings.ReadTimeout(),
+	}
+}
+
+type netWrapper struct {
+	net.Conn
+}
+
+func isNetTimeout(err error) bool {
+	netErr, ok := err.(net.Error)
+	return ok && netErr.Timeout()
+}
+
+func (w *netWrapper) Read(b []byte) (n int, err error) {
+	if n, err = w.Conn.Read(b); isNetTimeout(err) {
+		err = ErrTimeout
+	}
+	return
+}
+
+func (w *netWrapper) Write(b []byte) (n int, err error) {
+	if n, err = w.Conn.Write(b); isNetTimeout(err) {
+		err = ErrTimeout
+	}
+	return
+}
+
+// messageReader reads the messages from the connection. The data
+// that's received is kept between the reads, so a read that times
+// out in the middle of a message can be resumed later
+type messageReader struct {
+	conn net.Conn
+	buf  []byte
+	tmp  []byte
+	// parse returns the size of the first message in the
+	// buffer, or zero if the message is incomplete
+	parse func(buf []byte) (int, error)
+}
+
+func newMessageReader(conn net.Conn, parse func(buf []byte) (int, error)) *messageReader {
+	return &messageReader{conn: conn, tmp: make([]byte, 4096), parse: parse}
+}
+
+func (r *messageReader) read() ([]byte, error) {
+	for {
+		n, err := r.parse(r.buf)
+		switch {
+		case err != nil:
+			return nil, err
+		case n > 0:
+			msg := append([]byte{}, r.buf[:n]...)
+			r.buf = r.buf[n:]
+			return msg, nil
+		}
+		n, err = r.conn.Read(r.tmp)
+		r.buf = append(r.buf, r.tmp[:n]...)
+		switch {
+		case isNetTimeout(err):
+			return nil, ErrTimeout
+		case err != nil:
+			return nil, err
+		}
+	}
+}
+
+// splitAddress splits the address such as host:port/name
+// into the host:port part, using the default port if
+// it's not specified, and the name
+func splitAddress(address string, defaultPort int, defaultName string) (string, string) {
+	name := defaultName
+	if i := strings.Index(address, "/"); i >= 0 {
+		address, name = address[:i], address[i+1:]
+	}
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		address = net.JoinHostPort(address, strconv.Itoa(defaultPort))
+	}
+	return address, name
+}
+
+func dialTcp(address string, timeout time.Duration) (io.ReadWriteCloser, error) {
+	conn, err := net.DialTimeout("tcp", address, timeout)
+	if err != nil {
+		return nil, err
+	}
+	return &netWrapper{conn}, nil
+}
+
+func connect(settings *PortSettings) (io.ReadWriteCloser, error) {
+	serialAddress := settings.Port
 	switch {
 	case strings.HasPrefix(serialAddress, "/"):
-		if port, err := serial.Open(&serial.Config{
-			Address:  serialAddress,
-			BaudRate: 9600,
-			DataBits: 8,
-			StopBits: 1,
-			Parity:   "N",
-			Timeout:  serialTimeout,
-		}); err != nil {
+		if port, err := serial.Open(serialConfig(settings)); err != nil {
 			return nil, err
 		} else {
 			return &serialWrapper{port}, nil
 		}
 	case strings.HasPrefix(serialAddress, "tcp://"):
-		return net.Dial("tcp", serialAddress[6:])
+		return dialTcp(serialAddress[6:], settings.TcpTimeout())
+	case strings.HasPrefix(serialAddress, "rfc2217://"):
+		return dialRfc2217(serialAddress[10:], settings)
+	case strings.HasPrefix(serialAddress, "vxi11://"):
+		return dialVxi11(serialAddress[8:], settings)
+	case strings.HasPrefix(serialAddress, "hislip://"):
+		return dialHislip(serialAddress[9:], settings)
 	}
 
-	return net.Dial("tcp", serialAddress)
+	return dialTcp(serialAddress, settings.TcpTimeout())
 }
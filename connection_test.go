@@ -0,0 +1,53 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/goburrow/serial"
+)
+
+func TestSerialConfig(t *testing.T) {
+	for _, testCase := range []struct {
+		settings *PortSettings
+		config   *serial.Config
+	}{
+		{
+			&PortSettings{Port: "/dev/ttyS0"},
+			&serial.Config{
+				Address:  "/dev/ttyS0",
+				BaudRate: 9600,
+				DataBits: 8,
+				StopBits: 1,
+				Parity:   "N",
+				Timeout:  500 * time.Millisecond,
+			},
+		},
+		{
+			&PortSettings{
+				Port: "/dev/ttyUSB0",
+				LineSettings: LineSettings{
+					BaudRate:      19200,
+					DataBits:      7,
+					Parity:        "E",
+					StopBits:      2,
+					ReadTimeoutMs: 1000,
+				},
+			},
+			&serial.Config{
+				Address:  "/dev/ttyUSB0",
+				BaudRate: 19200,
+				DataBits: 7,
+				StopBits: 2,
+				Parity:   "E",
+				Timeout:  1000 * time.Millisecond,
+			},
+		},
+	} {
+		config := serialConfig(testCase.settings)
+		if !reflect.DeepEqual(config, testCase.config) {
+			t.Errorf("bad serial config for %#v: %#v (expected %#v)", testCase.settings, config, testCase.config)
+		}
+	}
+}
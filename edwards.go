@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"strconv"
@@ -16,10 +17,11 @@ const (
 	edwardsSetupCommand      = "!S"
 	edwardsQuerySetupCommand = "?S"
 	edwardsQueryValueCommand = "?V"
-	// FIXME: don't hardcode the following values directly, use config
-	edwardsIdentifyNumAttempts = 10
 )
 
+// edwardsErrorCodes contains the error messages for the error
+// codes. The TIC and nEXT manuals only define the codes 0-9, the
+// other codes are reported as device errors with the raw code
 var edwardsErrorCodes = []string{
 	"no error",                         // 0
 	"Invalid command for object ID",    // 1
@@ -33,6 +35,104 @@ var edwardsErrorCodes = []string{
 	"Invalid config ID",                // 9
 }
 
+// edwardsAlertIds contains the alert IDs (TIC manual, 1.7.3)
+var edwardsAlertIds = map[string]string{
+	"0":  "No Alert",
+	"1":  "ADC Fault",
+	"2":  "ADC Not Ready",
+	"3":  "Over Range",
+	"4":  "Under Range",
+	"5":  "ADC Invalid",
+	"6":  "No Gauge",
+	"7":  "Unknown",
+	"8":  "Not Supported",
+	"9":  "New ID",
+	"10": "Over Range",
+	"11": "Under Range",
+	"12": "Over Range",
+	"13": "Ion Em Timeout",
+	"14": "Not Struck",
+	"15": "Filament Fail",
+	"16": "Mag Fail",
+	"17": "Striker Fail",
+	"18": "Not Struck",
+	"19": "Filament Fail",
+	"20": "Cal Error",
+	"21": "Initialising",
+	"22": "Emission Error",
+	"23": "Over Pressure",
+	"24": "ASG Cant Zero",
+	"25": "RampUp Timeout",
+	"26": "Droop Timeout",
+	"27": "Run Hours High",
+	"28": "SC Interlock",
+	"29": "ID Volts Error",
+	"30": "Serial ID Fail",
+	"31": "Upload Active",
+	"32": "DX Fault",
+	"33": "Temp Alert",
+	"34": "SYSI Inhibit",
+	"35": "Ext Inhibit",
+	"36": "Temp Inhibit",
+	"37": "No Reading",
+	"38": "No Message",
+	"39": "NOV Failure",
+	"40": "Upload Timeout",
+	"41": "Download Failed",
+	"42": "No Tube",
+	"43": "Use Gauges 4-6",
+	"44": "Degas Inhibited",
+	"45": "IGC Inhibited",
+	"46": "Brownout/Short",
+	"47": "Service due",
+}
+
+// edwardsPriorities contains the alert priorities (TIC manual, 1.7.2)
+var edwardsPriorities = map[string]string{
+	"0": "OK",
+	"1": "warning",
+	"2": "alarm 1",
+	"3": "alarm 2",
+}
+
+// edwardsChecksum returns the checksum of the message, which is
+// the modulo-256 sum of its bytes formatted as two hex digits
+func edwardsChecksum(msg string) string {
+	var sum byte
+	for i := 0; i < len(msg); i++ {
+		sum += msg[i]
+	}
+	return fmt.Sprintf("%02X", sum)
+}
+
+// edwardsQuery sends the command to the device. If checksum is
+// true, the checksum is appended to the command, and the checksum
+// of the response is verified and removed
+func edwardsQuery(ctx context.Context, c Commander, cmd string, checksum bool, priority CommandPriority) (string, error) {
+	if !checksum {
+		return c.Query(ctx, cmd, nil, priority)
+	}
+	resp, err := c.Query(ctx, cmd+edwardsChecksum(cmd), nil, priority)
+	if err != nil {
+		return "", err
+	}
+	n := len(resp) - 2
+	if n < 0 || !strings.EqualFold(resp[n:], edwardsChecksum(resp[:n])) {
+		return "", fmt.Errorf("bad response checksum: %q", resp)
+	}
+	return resp[:n], nil
+}
+
+// edwardsAlertSpec specifies the controls for the alert ID
+// and priority which are the last values of many responses
+type edwardsAlertSpec struct {
+	// Name is the prefix of the control names. The controls
+	// are named <name>AlertId, <name>Priority and <name>Alarm
+	Name string
+	// Title is the prefix of the control titles
+	Title string
+}
+
 // TODO: param spec should contain a list of controls --
 // there should be semicolon-separated value list in the response
 // matching the number of controls
@@ -45,16 +145,47 @@ type edwardsParameterSpec struct {
 	Controls []*ControlConfig
 	Read     string
 	Write    string
+	// Alert specifies that the response ends with the alert
+	// ID and the priority, which are published as human-readable
+	// text controls, together with an alarm control that's set
+	// if the priority is not OK
+	Alert        *edwardsAlertSpec
+	PollSettings `yaml:",inline"`
 }
 
 var _ ParameterSpec = &edwardsParameterSpec{}
 
 func (spec *edwardsParameterSpec) ListControls() []*ControlConfig {
-	return spec.Controls
+	if spec.Alert == nil {
+		return spec.Controls
+	}
+	return append(append([]*ControlConfig{}, spec.Controls...), spec.alertControls()...)
+}
+
+func (spec *edwardsParameterSpec) alertControl(suffix, titleSuffix, controlType string, enum map[string]string) *ControlConfig {
+	control := &ControlConfig{
+		Name: spec.Alert.Name + suffix,
+		Type: controlType,
+		Enum: enum,
+	}
+	if spec.Alert.Title != "" {
+		control.Title = spec.Alert.Title + " " + titleSuffix
+	}
+	return control
+}
+
+// alertControls returns the controls for the alert ID, the
+// priority and the alarm, in this order
+func (spec *edwardsParameterSpec) alertControls() []*ControlConfig {
+	return []*ControlConfig{
+		spec.alertControl("AlertId", "alert", "text", edwardsAlertIds),
+		spec.alertControl("Priority", "priority", "text", edwardsPriorities),
+		spec.alertControl("Alarm", "alarm", "alarm", nil),
+	}
 }
 
 func (spec *edwardsParameterSpec) ShouldPoll() bool {
-	for _, control := range spec.Controls {
+	for _, control := range spec.ListControls() {
 		if control.ShouldPoll() {
 			return true
 		}
@@ -72,6 +203,9 @@ func (spec *edwardsParameterSpec) Validate() error {
 			return err
 		}
 	}
+	if err := spec.PollSettings.Validate(); err != nil {
+		return err
+	}
 	if spec.Oid <= 0 {
 		return fmt.Errorf("Invalid OID %d", spec.Oid)
 	}
@@ -79,6 +213,10 @@ func (spec *edwardsParameterSpec) Validate() error {
 		return fmt.Errorf("Negative sub %d, OID=%d", *spec.Sub, spec.Oid)
 	}
 	switch {
+	case spec.Alert != nil && spec.Alert.Name == "":
+		return fmt.Errorf("OID %d: alert name not specified", spec.Oid)
+	case spec.Alert != nil && (spec.Read == "" || spec.Write != ""):
+		return fmt.Errorf("OID %d: alert can only be specified for read-only parameters", spec.Oid)
 	case spec.Read == "" && spec.Write == "":
 		return fmt.Errorf("OID %d: must specify read and/or write command", spec.Oid)
 	case spec.Read != "" && spec.Read != edwardsQuerySetupCommand && spec.Read != edwardsQueryValueCommand:
@@ -91,6 +229,7 @@ func (spec *edwardsParameterSpec) Validate() error {
 
 type edwardsParameter struct {
 	*edwardsParameterSpec
+	checksum bool
 }
 
 var _ Parameter = &edwardsParameter{}
@@ -109,6 +248,10 @@ func (p *edwardsParameter) parseResponse(resp, cmdPrefix string) ([]string, erro
 	// req:  ?S904 3
 	// resp: '=S904 3;0'
 	// error response looks like '*Cnnn 1'
+	// The object id must match the one in the command exactly.
+	// This is the only way to detect the responses that belong
+	// to the other commands, e.g. the late response to the
+	// command that has timed out
 	if len(resp) <= len(cmdPrefix)+1 || resp[1:len(cmdPrefix)+1] != cmdPrefix[1:]+" " {
 		return nil, errors.New("invalid device response")
 	}
@@ -121,10 +264,10 @@ func (p *edwardsParameter) parseResponse(resp, cmdPrefix string) ([]string, erro
 		if errCode == 0 {
 			return nil, nil
 		}
-		if errCode >= len(edwardsErrorCodes) {
-			return nil, fmt.Errorf("invalid error code %d", errCode)
+		if errCode < 0 || errCode >= len(edwardsErrorCodes) {
+			return nil, &DeviceError{[]string{fmt.Sprintf("unknown error code %d", errCode)}}
 		}
-		return nil, fmt.Errorf("device error: %s", edwardsErrorCodes[errCode])
+		return nil, &DeviceError{[]string{edwardsErrorCodes[errCode]}}
 	}
 	if resp[0] != '=' {
 		return nil, errors.New("invalid device response")
@@ -139,7 +282,7 @@ func (p *edwardsParameter) parseResponse(resp, cmdPrefix string) ([]string, erro
 	return values, nil
 }
 
-func (p *edwardsParameter) command(c Commander, cmdType, data string) ([]string, error) {
+func (p *edwardsParameter) command(ctx context.Context, c Commander, cmdType, data string, priority CommandPriority) ([]string, error) {
 	cmdPrefix := fmt.Sprintf("%s%d", cmdType, p.Oid)
 	cmd := cmdPrefix
 	if p.Sub != nil {
@@ -150,32 +293,47 @@ func (p *edwardsParameter) command(c Commander, cmdType, data string) ([]string,
 	} else if data != "" {
 		cmd += " " + data
 	}
-	resp, err := c.Query(cmd, 0)
+	resp, err := edwardsQuery(ctx, c, cmd, p.checksum, priority)
 	if err != nil {
 		return nil, err
 	}
 	return p.parseResponse(resp, cmdPrefix)
 }
 
-func (p *edwardsParameter) Query(c Commander, handler QueryHandler) error {
+func (p *edwardsParameter) Query(ctx context.Context, c Commander, handler QueryHandler) error {
 	if p.Read == "" {
 		return fmt.Errorf("no read command for %q", p.Name())
 	}
-	values, err := p.command(c, p.Read, "")
+	values, err := p.command(ctx, c, p.Read, "", PriorityBackground)
 	if err != nil {
 		return err
 	}
-	if len(values) != len(p.Controls) {
+	numValues := len(p.Controls)
+	if p.Alert != nil {
+		numValues += 2
+	}
+	if len(values) != numValues {
 		return errors.New("mismatched number of params in response")
 	}
 	for n, control := range p.Controls {
 		// TODO: perhaps convert values to numbers here
 		handler(control.Name, values[n])
 	}
+	if p.Alert != nil {
+		alertControls := p.alertControls()
+		alertId, priority := values[len(p.Controls)], values[len(p.Controls)+1]
+		handler(alertControls[0].Name, alertId)
+		handler(alertControls[1].Name, priority)
+		alarm := "0"
+		if priority != "0" {
+			alarm = "1"
+		}
+		handler(alertControls[2].Name, alarm)
+	}
 	return nil
 }
 
-func (p *edwardsParameter) Set(c Commander, name string, value interface{}) error {
+func (p *edwardsParameter) Set(ctx context.Context, c Commander, name string, value interface{}) error {
 	controlIndex := -1
 	for n, control := range p.Controls {
 		if control.Name == name {
@@ -198,7 +356,7 @@ func (p *edwardsParameter) Set(c Commander, name string, value interface{}) erro
 		if p.Read == "" {
 			return fmt.Errorf("trying to write multi-valued param %q without read command", p.Name())
 		}
-		values, err := p.command(c, p.Read, "")
+		values, err := p.command(ctx, c, p.Read, "", PriorityInteractive)
 		if err != nil {
 			return err
 		}
@@ -209,7 +367,7 @@ func (p *edwardsParameter) Set(c Commander, name string, value interface{}) erro
 		data = strings.Join(values, ";")
 	}
 
-	values, err := p.command(c, p.Write, data)
+	values, err := p.command(ctx, c, p.Write, data, PriorityInteractive)
 	if err != nil {
 		return err
 	}
@@ -220,20 +378,25 @@ func (p *edwardsParameter) Set(c Commander, name string, value interface{}) erro
 }
 
 type edwardsProtocol struct {
-	idSubstring string
+	idSubstring      string
+	identifyAttempts int
+	checksum         bool
 }
 
 func newEdwardsProtocol(config *PortConfig) (Protocol, error) {
-	return &edwardsProtocol{config.IdSubstring}, nil
+	return &edwardsProtocol{config.IdSubstring, config.NumIdentifyAttempts(), config.Checksum}, nil
 }
 
-func (p *edwardsProtocol) Identify(c Commander) (r string, err error) {
-	for i := 0; i < edwardsIdentifyNumAttempts; i++ {
-		r, err = c.Query(edwardsIdCommand, 0)
+func (p *edwardsProtocol) Identify(ctx context.Context, c Commander) (r string, err error) {
+	for i := 0; i < p.identifyAttempts; i++ {
+		r, err = edwardsQuery(ctx, c, edwardsIdCommand, p.checksum, PriorityBackground)
 		switch {
 		case err == ErrTimeout:
 			wbgo.Error.Print("Identify() timeout")
 			continue
+		case ctx.Err() != nil:
+			// cancelled
+			return "", err
 		case err != nil:
 			wbgo.Error.Printf("Identify() error: %v", err)
 			return "", err
@@ -252,7 +415,7 @@ func (p *edwardsProtocol) Parameter(spec ParameterSpec) (Parameter, error) {
 	if !ok {
 		return nil, errors.New("EDWARDS parameter spec expected")
 	}
-	return &edwardsParameter{edwardsSpec}, nil
+	return &edwardsParameter{edwardsSpec, p.checksum}, nil
 }
 
 func init() {
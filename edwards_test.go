@@ -1,6 +1,10 @@
 package main
 
-import "testing"
+import (
+	"context"
+	"reflect"
+	"testing"
+)
 
 var edwardsConfig = `
 ports:
@@ -89,7 +93,7 @@ func TestEdwardsIdentify(t *testing.T) {
 	pt := newProtocolTester(t, edwardsConfig)
 	// don't know what zero byte is exactly doing there
 	pt.commander.enqueue("?S902", "=S902 TIC200;D39700640S;150326362\x00;5.0")
-	id, err := pt.protocol.Identify(pt.commander)
+	id, err := pt.protocol.Identify(context.Background(), pt.commander)
 	if err != nil {
 		t.Fatalf("Identify(): %v", err)
 	}
@@ -147,4 +151,81 @@ func TestErrorResponses(t *testing.T) {
 	pt.verifyQueryError(0, "device error: Operation took too long")
 	pt.commander.enqueue("!C916 0", "*C916 7")
 	pt.verifySetError(2, "relay1Off", 1, "device error: EEPROM read or write error")
+	pt.commander.enqueue("?V902", "*V902 12")
+	pt.verifyQueryError(0, "device error: unknown error code 12")
+	// responses for other objects are rejected
+	pt.commander.enqueue("?V902", "=V903 0;1;0;0;1;0;0;1;0;0")
+	pt.verifyQueryError(0, "invalid device response")
+}
+
+var edwardsAlertConfig = `
+ports:
+- name: edwards
+  title: Edwards
+  port: someport
+  protocol: edwards
+  checksum: true
+  parameters:
+  - oid: 913
+    read: "?V"
+    controls:
+    - name: gauge1Value
+      title: Gauge 1 value
+      type: value
+    alert:
+      name: gauge1
+      title: Gauge 1
+`
+
+func TestEdwardsChecksum(t *testing.T) {
+	if cs := edwardsChecksum("?V913"); cs != "32" {
+		t.Errorf("bad checksum %q", cs)
+	}
+	pt := newProtocolTester(t, edwardsAlertConfig)
+	pt.commander.enqueue("?S902"+edwardsChecksum("?S902"), "=S902 TIC200;5.0"+edwardsChecksum("=S902 TIC200;5.0"))
+	id, err := pt.protocol.Identify(context.Background(), pt.commander)
+	if err != nil {
+		t.Fatalf("Identify(): %v", err)
+	}
+	if id != "TIC200/5.0" {
+		t.Errorf("Bad id %q", id)
+	}
+	pt.commander.enqueue("?V91332", "=V913 1.2e-3;59;11;0;000")
+	pt.verifyQueryError(0, `bad response checksum: "=V913 1.2e-3;59;11;0;000"`)
+	pt.commander.verifyAndFlush()
+}
+
+func TestEdwardsAlert(t *testing.T) {
+	pt := newProtocolTester(t, edwardsAlertConfig)
+	var controls []ControlConfig
+	for _, control := range pt.portConfig.Parameters[0].ListControls() {
+		controls = append(controls, *control)
+	}
+	expectedControls := []ControlConfig{
+		{Name: "gauge1Value", Title: "Gauge 1 value", Type: "value"},
+		{Name: "gauge1AlertId", Title: "Gauge 1 alert", Type: "text", Enum: edwardsAlertIds},
+		{Name: "gauge1Priority", Title: "Gauge 1 priority", Type: "text", Enum: edwardsPriorities},
+		{Name: "gauge1Alarm", Title: "Gauge 1 alarm", Type: "alarm"},
+	}
+	if !reflect.DeepEqual(controls, expectedControls) {
+		t.Errorf("bad controls %#v (expected %#v)", controls, expectedControls)
+	}
+
+	resp := "=V913 1.2e-3;3;2"
+	pt.commander.enqueue("?V91332", resp+edwardsChecksum(resp))
+	pt.verifyQuery(0, map[string]interface{}{
+		"gauge1Value":    "1.2e-3",
+		"gauge1AlertId":  "3",
+		"gauge1Priority": "2",
+		"gauge1Alarm":    "1",
+	})
+	resp = "=V913 1.2e-3;0;0"
+	pt.commander.enqueue("?V91332", resp+edwardsChecksum(resp))
+	pt.verifyQuery(0, map[string]interface{}{
+		"gauge1Value":    "1.2e-3",
+		"gauge1AlertId":  "0",
+		"gauge1Priority": "0",
+		"gauge1Alarm":    "0",
+	})
+	pt.commander.verifyAndFlush()
 }
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"strconv"
@@ -40,11 +41,39 @@ func parseErnResponse(resp, commandStr string, expectDataItems int) ([]string, e
 	return []string{data}, nil
 }
 
+// formatErnValue formats the number using decimal comma,
+// padding it with zeros to the specified width
+func formatErnValue(v float64, width, decimals int) (string, error) {
+	s := strings.Replace(strconv.FormatFloat(v, 'f', decimals, 64), ".", ",", -1)
+	switch {
+	case width == 0:
+		return s, nil
+	case len(s) > width:
+		return "", fmt.Errorf("value %v doesn't fit in %d characters", v, width)
+	case v < 0:
+		return "-" + strings.Repeat("0", width-len(s)) + s[1:], nil
+	default:
+		return strings.Repeat("0", width-len(s)) + s, nil
+	}
+}
+
 type ernParameterSpec struct {
 	Command  string
 	RespLen  int
 	RespSkip int
 	Controls []*ControlConfig
+	// Write is the command code for setting the value of the
+	// writable numeric control, e.g. voltage setpoint. The
+	// value is sent after '>'. If the device echoes the value
+	// in the response, the echoed value must match it
+	Write string
+	// WriteWidth is the width of the value being written,
+	// e.g. 5 for '07000'. Zero means no padding
+	WriteWidth int
+	// WriteDecimals is the number of digits after the
+	// decimal comma in the value being written
+	WriteDecimals int
+	PollSettings  `yaml:",inline"`
 }
 
 var _ ParameterSpec = &ernParameterSpec{}
@@ -54,6 +83,10 @@ func (spec *ernParameterSpec) ListControls() []*ControlConfig {
 }
 
 func (spec *ernParameterSpec) ShouldPoll() bool {
+	if spec.Command == "" {
+		// write-only parameter
+		return false
+	}
 	for _, control := range spec.Controls {
 		if control.ShouldPoll() {
 			return true
@@ -77,20 +110,53 @@ func (spec *ernParameterSpec) Validate() error {
 			return err
 		}
 	}
-	if spec.Command == "" {
+	if err := spec.PollSettings.Validate(); err != nil {
+		return err
+	}
+	if spec.Command == "" && spec.Write == "" {
 		return fmt.Errorf("ern: no command specified")
 	}
+	if spec.Write == "" {
+		return nil
+	}
+	switch {
+	case len(spec.Controls) != 1:
+		return fmt.Errorf("ern: write command %q must have exactly one control", spec.Write)
+	case spec.Controls[0].Type == "text" || spec.Controls[0].Type == "pushbutton":
+		return fmt.Errorf("ern: write command %q requires a numeric control", spec.Write)
+	case spec.WriteWidth < 0:
+		return fmt.Errorf("ern: bad write width %d", spec.WriteWidth)
+	case spec.WriteDecimals < 0:
+		return fmt.Errorf("ern: bad write decimals %d", spec.WriteDecimals)
+	}
 	return nil
 }
 
+// ernFramer reads the fixed size responses. The devices expect
+// the line ending to be sent after such responses
+type ernFramer struct {
+	FixedSizeFramer
+	lineEnding string
+}
+
+var _ Flusher = &ernFramer{}
+
+func (f *ernFramer) FlushSequence() []byte {
+	return []byte(f.lineEnding)
+}
+
 type ernParameter struct {
 	*ernParameterSpec
-	address int
+	address    int
+	lineEnding string
 }
 
 var _ Parameter = &ernParameter{}
 
 func (p *ernParameter) Name() string {
+	if p.Command == "" {
+		return p.writeCommandStr()
+	}
 	return p.commandStr()
 }
 
@@ -98,6 +164,10 @@ func (p *ernParameter) commandStr() string {
 	return fmt.Sprintf("%02d%s", p.address, p.Command)
 }
 
+func (p *ernParameter) writeCommandStr() string {
+	return fmt.Sprintf("%02d%s", p.address, p.Write)
+}
+
 func (p *ernParameter) parseResponse(resp string, expectData bool) ([]string, error) {
 	expectDataItems := 0
 	if expectData {
@@ -110,8 +180,12 @@ func (p *ernParameter) parseResponse(resp string, expectData bool) ([]string, er
 	return parts[p.RespSkip:], nil
 }
 
-func (p *ernParameter) Query(c Commander, handler QueryHandler) error {
-	resp, err := c.Query("Z"+p.commandStr(), p.RespLen)
+func (p *ernParameter) Query(ctx context.Context, c Commander, handler QueryHandler) error {
+	var framer Framer
+	if p.RespLen > 0 {
+		framer = &ernFramer{FixedSizeFramer{Size: p.RespLen}, p.lineEnding}
+	}
+	resp, err := c.Query(ctx, "Z"+p.commandStr(), framer, PriorityBackground)
 	if err != nil {
 		return err
 	}
@@ -135,19 +209,57 @@ func (p *ernParameter) Query(c Commander, handler QueryHandler) error {
 	return nil
 }
 
-func (p *ernParameter) Set(c Commander, name string, value interface{}) error {
-	// this only works for pushbuttons as of now
-	// TODO: need to support setting voltage/current
-	resp, err := c.Query("Z"+p.commandStr(), 0)
+func (p *ernParameter) Set(ctx context.Context, c Commander, name string, value interface{}) error {
+	if p.Write != "" {
+		return p.setValue(ctx, c, name, value)
+	}
+	// pushbutton
+	resp, err := c.Query(ctx, "Z"+p.commandStr(), nil, PriorityInteractive)
 	if err == nil {
 		_, err = p.parseResponse(resp, false)
 	}
 	return err
 }
 
+// setValue sets the value of the numeric control using
+// the write command
+func (p *ernParameter) setValue(ctx context.Context, c Commander, name string, value interface{}) error {
+	if name != p.Controls[0].Name {
+		return fmt.Errorf("unknown control name %q", name)
+	}
+	s := strings.Replace(fmt.Sprintf("%v", value), ",", ".", -1)
+	v, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return fmt.Errorf("can't parse number %q: %v", s, err)
+	}
+	data, err := formatErnValue(v, p.WriteWidth, p.WriteDecimals)
+	if err != nil {
+		return fmt.Errorf("parameter %s: %v", p.Name(), err)
+	}
+	encoder := charmap.Windows1251.NewEncoder()
+	encoded, err := encoder.String(data)
+	if err != nil {
+		return fmt.Errorf("parameter %s: error encoding value %q", p.Name(), data)
+	}
+	commandStr := p.writeCommandStr()
+	resp, err := c.Query(ctx, "Z"+commandStr+">"+encoded, nil, PriorityInteractive)
+	if err != nil {
+		return err
+	}
+	parts, err := parseErnResponse(resp, commandStr, 1)
+	switch {
+	case err != nil:
+		return fmt.Errorf("parameter %s: %v", p.Name(), err)
+	case parts != nil && strings.Replace(parts[0], ".", ",", -1) != data:
+		return fmt.Errorf("parameter %s: value mismatch: %q instead of %q", p.Name(), parts[0], data)
+	}
+	return nil
+}
+
 type ernProtocol struct {
 	idSubstring string
 	address     int
+	lineEnding  string
 }
 
 func newErnProtocol(config *PortConfig) (Protocol, error) {
@@ -157,12 +269,13 @@ func newErnProtocol(config *PortConfig) (Protocol, error) {
 	return &ernProtocol{
 		idSubstring: config.IdSubstring,
 		address:     config.Address,
+		lineEnding:  config.LineTerminator(),
 	}, nil
 }
 
-func (p *ernProtocol) Identify(c Commander) (r string, err error) {
+func (p *ernProtocol) Identify(ctx context.Context, c Commander) (r string, err error) {
 	commandStr := fmt.Sprintf("%02dNN", p.address)
-	resp, err := c.Query("Z"+commandStr, 0)
+	resp, err := c.Query(ctx, "Z"+commandStr, nil, PriorityBackground)
 	if err != nil {
 		return "", err
 	}
@@ -178,7 +291,7 @@ func (p *ernProtocol) Parameter(spec ParameterSpec) (Parameter, error) {
 	if !ok {
 		return nil, errors.New("ERN parameter spec expected")
 	}
-	return &ernParameter{ernSpec, p.address}, nil
+	return &ernParameter{ernSpec, p.address, p.lineEnding}, nil
 }
 
 func init() {
@@ -1,12 +1,16 @@
 package main
 
-import "testing"
+import (
+	"context"
+	"testing"
+)
 
 // id:      'Z44NN\r' --> '!44N>\xc8\xcf\xd1-1200-220\xc2/7\xea\xc2-1\xc0'
 // (converted to UTF-8: !44N>ИПС-1200-220В/7кВ-1А)
 // measure: 'Z4441\r' --> '!444>1+07018+000,012'
 // disable: 'Z441D\r' --> '!441'
 // enable:  'Z441E\r' --> '!441'
+// set U:   'Z442U>07000\r' --> '!442'
 var ernConfig = `
 ports:
 - name: ern
@@ -37,12 +41,27 @@ ports:
     - name: Off
       type: pushbutton
       writable: true
+  - write: "2U"
+    writewidth: 5
+    controls:
+    - name: USet
+      units: V
+      type: value
+      writable: true
+  - write: "2I"
+    writewidth: 7
+    writedecimals: 3
+    controls:
+    - name: ISet
+      units: A
+      type: value
+      writable: true
 `
 
 func TestErnIdentify(t *testing.T) {
 	pt := newProtocolTester(t, ernConfig)
 	pt.commander.enqueue("Z44NN", "!44N>\xc8\xcf\xd1-1200-220\xc2/7\xea\xc2-1\xc0")
-	id, err := pt.protocol.Identify(pt.commander)
+	id, err := pt.protocol.Identify(context.Background(), pt.commander)
 	if err != nil {
 		t.Fatalf("Identify(): %v", err)
 	}
@@ -53,7 +72,7 @@ func TestErnIdentify(t *testing.T) {
 
 func TestErnQuery(t *testing.T) {
 	pt := newProtocolTester(t, ernConfig)
-	pt.commander.enqueue(20, "Z4441", "!444>1+07018+000,012")
+	pt.commander.enqueue(&ernFramer{FixedSizeFramer{Size: 20}, "\r"}, "Z4441", "!444>1+07018+000,012")
 	pt.verifyQuery(0, map[string]interface{}{
 		"U": float64(7018),
 		"I": float64(0.012),
@@ -67,3 +86,18 @@ func TestErnSet(t *testing.T) {
 	pt.commander.enqueue("Z441D", "!441")
 	pt.verifySet(2, "Off", 1)
 }
+
+func TestErnSetValue(t *testing.T) {
+	pt := newProtocolTester(t, ernConfig)
+	pt.commander.enqueue("Z442U>07000", "!442")
+	pt.verifySet(3, "USet", 7000)
+	// the value echoed by the device is verified
+	pt.commander.enqueue("Z442I>000,012", "!442>000,012")
+	pt.verifySet(4, "ISet", "0,012")
+	pt.commander.enqueue("Z442I>000,500", "!442>000,400")
+	pt.verifySetError(4, "ISet", 0.5, `parameter 442I: value mismatch: "000,400" instead of "000,500"`)
+	pt.commander.enqueue("Z442U>00100", "!44X")
+	pt.verifySetError(3, "USet", 100, `parameter 442U: bad ern response "!44X"`)
+	pt.verifySetError(3, "USet", 123456, "parameter 442U: value 123456 doesn't fit in 5 characters")
+	pt.commander.verifyAndFlush()
+}
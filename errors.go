@@ -1,9 +1,22 @@
 package main
 
-import "errors"
+import (
+	"errors"
+	"strings"
+)
 
 var (
 	errNoPortsDefined = errors.New("no ports defined")
 	errNoPortsOpen    = errors.New("couldn't open any ports")
 	ErrTimeout        = errors.New("serial timeout")
 )
+
+// DeviceError contains the errors reported by the device
+// itself, e.g. the entries of SCPI error queue
+type DeviceError struct {
+	Errors []string
+}
+
+func (e *DeviceError) Error() string {
+	return "device error: " + strings.Join(e.Errors, "; ")
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+)
+
+// Framer reads the response frames sent by the device. Protocols
+// pass framers to the commander, so the commander doesn't need to
+// know how the responses are delimited
+type Framer interface {
+	// ReadFrame reads a single response frame
+	ReadFrame(r *bufio.Reader) ([]byte, error)
+}
+
+// Flusher is implemented by the framers of the devices that
+// expect a flush sequence to be sent after the response frame
+// is received. The commander sends the sequence after the
+// command delay
+type Flusher interface {
+	// FlushSequence returns the data to be sent to the device
+	FlushSequence() []byte
+}
+
+// FramerFunc makes it possible to use an ordinary
+// function as a Framer
+type FramerFunc func(r *bufio.Reader) ([]byte, error)
+
+var _ Framer = FramerFunc(nil)
+
+func (f FramerFunc) ReadFrame(r *bufio.Reader) ([]byte, error) {
+	return f(r)
+}
+
+// LineFramer reads the frames that are terminated by the line
+// ending. The line ending isn't included in the frame
+type LineFramer struct {
+	LineEnding string
+}
+
+var _ Framer = &LineFramer{}
+
+func (f *LineFramer) ReadFrame(r *bufio.Reader) ([]byte, error) {
+	delim := f.LineEnding[len(f.LineEnding)-1]
+	resp, err := r.ReadBytes(delim)
+	if err != nil {
+		return nil, err
+	}
+	return f.trim(resp), nil
+}
+
+// trim removes the line ending from the end of the response
+func (f *LineFramer) trim(resp []byte) []byte {
+	delim := f.LineEnding[len(f.LineEnding)-1]
+	switch {
+	case len(resp) >= len(f.LineEnding) && string(resp[len(resp)-len(f.LineEnding):]) == f.LineEnding:
+		return resp[:len(resp)-len(f.LineEnding)]
+	case len(resp) > 0 && resp[len(resp)-1] == delim:
+		// allow responses to cmd + "\r\n" to end with just "\n"
+		return resp[:len(resp)-1]
+	default:
+		return resp
+	}
+}
+
+// FixedSizeFramer reads the frames of the specified size
+type FixedSizeFramer struct {
+	Size int
+}
+
+var _ Framer = &FixedSizeFramer{}
+
+func (f *FixedSizeFramer) ReadFrame(r *bufio.Reader) ([]byte, error) {
+	frame := make([]byte, f.Size)
+	if _, err := io.ReadFull(r, frame); err != nil {
+		return nil, err
+	}
+	return frame, nil
+}
+
+// LengthPrefixedFramer reads the frames which contain the number
+// of the remaining bytes in the header
+type LengthPrefixedFramer struct {
+	// LengthOffset is the offset of the length field
+	LengthOffset int
+	// LengthSize is the size of the length field, 1 or 2 bytes.
+	// 2-byte lengths are big endian
+	LengthSize int
+	// Adjustment is added to the length to get the number of
+	// bytes following the length field, e.g. for the checksum
+	// that's not counted in the length
+	Adjustment int
+	// MaxLength is the maximum number of bytes following the
+	// length field. Zero means no limit
+	MaxLength int
+}
+
+var _ Framer = &LengthPrefixedFramer{}
+
+func (f *LengthPrefixedFramer) ReadFrame(r *bufio.Reader) ([]byte, error) {
+	frame := make([]byte, f.LengthOffset+f.LengthSize)
+	if _, err := io.ReadFull(r, frame); err != nil {
+		return nil, err
+	}
+	length := 0
+	for _, b := range frame[f.LengthOffset:] {
+		length = length<<8 | int(b)
+	}
+	length += f.Adjustment
+	if length < 0 || (f.MaxLength > 0 && length > f.MaxLength) {
+		return nil, fmt.Errorf("bad frame length %d", length)
+	}
+	headerSize := len(frame)
+	frame = append(frame, make([]byte, length)...)
+	if _, err := io.ReadFull(r, frame[headerSize:]); err != nil {
+		return nil, err
+	}
+	return frame, nil
+}
+
+// EscapedTerminatorFramer reads the frames that are terminated
+// by the terminator byte. The terminator and escape bytes that
+// are part of the frame data are preceded by the escape byte.
+// The frames are returned unescaped and without the terminator
+type EscapedTerminatorFramer struct {
+	Terminator byte
+	Escape     byte
+	// MaxLength is the maximum length of the unescaped
+	// frame. Zero means no limit
+	MaxLength int
+}
+
+var _ Framer = &EscapedTerminatorFramer{}
+
+func (f *EscapedTerminatorFramer) ReadFrame(r *bufio.Reader) ([]byte, error) {
+	var frame []byte
+	for {
+		b, err := r.ReadByte()
+		switch {
+		case err == io.EOF && len(frame) > 0:
+			return nil, io.ErrUnexpectedEOF
+		case err != nil:
+			return nil, err
+		case b == f.Terminator:
+			return frame, nil
+		case b == f.Escape:
+			if b, err = r.ReadByte(); err == io.EOF {
+				return nil, io.ErrUnexpectedEOF
+			} else if err != nil {
+				return nil, err
+			}
+		}
+		if f.MaxLength > 0 && len(frame) == f.MaxLength {
+			return nil, fmt.Errorf("frame is longer than %d bytes", f.MaxLength)
+		}
+		frame = append(frame, b)
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestFramers(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		framer Framer
+		input  string
+		frames []string
+		errStr string
+	}{
+		{
+			name:   "crlf",
+			framer: &LineFramer{LineEnding: "\r\n"},
+			input:  "abc\r\ndef\nghi\r\n",
+			frames: []string{"abc", "def", "ghi"},
+		},
+		{
+			name:   "cr",
+			framer: &LineFramer{LineEnding: "\r"},
+			input:  "abc\rdef\r",
+			frames: []string{"abc", "def"},
+		},
+		{
+			name:   "fixed size",
+			framer: &FixedSizeFramer{Size: 3},
+			input:  "abcdef",
+			frames: []string{"abc", "def"},
+		},
+		{
+			name:   "length prefixed",
+			framer: &LengthPrefixedFramer{LengthOffset: 1, LengthSize: 1},
+			input:  "\x01\x02ab\x02\x00\x03\x04\x00",
+			frames: []string{"\x01\x02ab", "\x02\x00"},
+			errStr: "unexpected EOF",
+		},
+		{
+			name:   "length prefixed with 2-byte length and trailer",
+			framer: &LengthPrefixedFramer{LengthSize: 2, Adjustment: 1},
+			input:  "\x00\x02abc\x00\x00x",
+			frames: []string{"\x00\x02abc", "\x00\x00x"},
+		},
+		{
+			name:   "length prefixed with max length",
+			framer: &LengthPrefixedFramer{LengthSize: 1, MaxLength: 2},
+			input:  "\x02ab\x03abc",
+			frames: []string{"\x02ab"},
+			errStr: "bad frame length 3",
+		},
+		{
+			name:   "escaped terminator",
+			framer: &EscapedTerminatorFramer{Terminator: 0x7e, Escape: 0x7d},
+			input:  "ab\x7e\x7d\x7ec\x7d\x7d\x7e\x7edef",
+			frames: []string{"ab", "\x7ec\x7d", ""},
+			errStr: "unexpected EOF",
+		},
+		{
+			name:   "escaped terminator with max length",
+			framer: &EscapedTerminatorFramer{Terminator: '\n', Escape: '\\', MaxLength: 3},
+			input:  "a\\\nb\nabcd\n",
+			frames: []string{"a\nb"},
+			errStr: "frame is longer than 3 bytes",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r := bufio.NewReader(strings.NewReader(tc.input))
+			for _, expectedFrame := range tc.frames {
+				frame, err := tc.framer.ReadFrame(r)
+				switch {
+				case err != nil:
+					t.Fatalf("ReadFrame(): %v", err)
+				case !bytes.Equal(frame, []byte(expectedFrame)):
+					t.Errorf("bad frame %q (expected %q)", frame, expectedFrame)
+				}
+			}
+			if tc.errStr == "" {
+				return
+			}
+			switch _, err := tc.framer.ReadFrame(r); {
+			case err == nil:
+				t.Errorf("no error received")
+			case err.Error() != tc.errStr:
+				t.Errorf("unexpected error string %q (expected %q)", err, tc.errStr)
+			}
+		})
+	}
+}
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+)
+
+// HiSLIP message types (IVI-6.1)
+const (
+	hislipInitialize                  = 0
+	hislipInitializeResponse          = 1
+	hislipFatalError                  = 2
+	hislipError                       = 3
+	hislipData                        = 6
+	hislipDataEnd                     = 7
+	hislipDeviceClearComplete         = 8
+	hislipDeviceClearAcknowledge      = 9
+	hislipInterrupted                 = 13
+	hislipAsyncInitialize             = 17
+	hislipAsyncInitializeResponse     = 18
+	hislipAsyncDeviceClear            = 19
+	hislipAsyncDeviceClearAcknowledge = 23
+)
+
+const (
+	hislipDefaultPort       = 4880
+	hislipDefaultSubAddress = "hislip0"
+	hislipHeaderSize        = 16
+	hislipProtocolVersion   = 0x0100
+	hislipVendorId          = 'W'<<8 | 'B'
+	hislipMaxPayloadSize    = 16 * 1024 * 1024
+	// hislipInitialMessageId is the message id of the first
+	// message after initialization and device clear
+	hislipInitialMessageId = 0xffffff00
+)
+
+type hislipMessage struct {
+	msgType   byte
+	control   byte
+	parameter uint32
+	payload   []byte
+}
+
+func (m *hislipMessage) encode() []byte {
+	r := make([]byte, hislipHeaderSize, hislipHeaderSize+len(m.payload))
+	r[0], r[1], r[2], r[3] = 'H', 'S', m.msgType, m.control
+	binary.BigEndian.PutUint32(r[4:], m.parameter)
+	binary.BigEndian.PutUint64(r[8:], uint64(len(m.payload)))
+	return append(r, m.payload...)
+}
+
+func parseHislipMessage(buf []byte) (int, error) {
+	if len(buf) < hislipHeaderSize {
+		return 0, nil
+	}
+	if buf[0] != 'H' || buf[1] != 'S' {
+		return 0, errors.New("hislip: bad message prologue")
+	}
+	payloadSize := binary.BigEndian.Uint64(buf[8:])
+	if payloadSize > hislipMaxPayloadSize {
+		return 0, fmt.Errorf("hislip: payload too large: %d", payloadSize)
+	}
+	size := hislipHeaderSize + int(payloadSize)
+	if len(buf) < size {
+		return 0, nil
+	}
+	return size, nil
+}
+
+func decodeHislipMessage(data []byte) *hislipMessage {
+	return &hislipMessage{
+		msgType:   data[2],
+		control:   data[3],
+		parameter: binary.BigEndian.Uint32(data[4:]),
+		payload:   data[hislipHeaderSize:],
+	}
+}
+
+// hislipChannel is the synchronous or the asynchronous
+// connection of HiSLIP session
+type hislipChannel struct {
+	conn   net.Conn
+	reader *messageReader
+}
+
+func dialHislipChannel(address string, timeout time.Duration) (*hislipChannel, error) {
+	conn, err := net.DialTimeout("tcp", address, timeout)
+	if err != nil {
+		return nil, err
+	}
+	return &hislipChannel{conn, newMessageReader(conn, parseHislipMessage)}, nil
+}
+
+func (ch *hislipChannel) send(msg *hislipMessage) error {
+	_, err := ch.conn.Write(msg.encode())
+	if isNetTimeout(err) {
+		return ErrTimeout
+	}
+	return err
+}
+
+// receive reads the next message, handling the error messages
+func (ch *hislipChannel) receive() (*hislipMessage, error) {
+	data, err := ch.reader.read()
+	if err != nil {
+		return nil, err
+	}
+	msg := decodeHislipMessage(data)
+	switch msg.msgType {
+	case hislipFatalError:
+		return nil, fmt.Errorf("hislip: fatal error %d: %s", msg.control, msg.payload)
+	case hislipError:
+		return nil, fmt.Errorf("hislip: error %d: %s", msg.control, msg.payload)
+	}
+	return msg, nil
+}
+
+// expect reads the messages until the one of the
+// specified type is received, skipping the other ones
+func (ch *hislipChannel) expect(msgType byte) (*hislipMessage, error) {
+	for {
+		msg, err := ch.receive()
+		if err != nil || msg.msgType == msgType {
+			return msg, err
+		}
+	}
+}
+
+// hislipConn is a HiSLIP connection to an instrument
+type hislipConn struct {
+	sync, async *hislipChannel
+	// messageId is the id of the next message to be sent
+	// and lastMessageId is the id of the last message sent
+	messageId     uint32
+	lastMessageId uint32
+	// stale is set if a read timed out, so the
+	// response may still be pending
+	stale   bool
+	pending []byte
+}
+
+var _ MessageConnection = &hislipConn{}
+
+func dialHislip(address string, settings *PortSettings) (*hislipConn, error) {
+	address, subAddress := splitAddress(address, hislipDefaultPort, hislipDefaultSubAddress)
+	c := &hislipConn{messageId: hislipInitialMessageId}
+	var err error
+	if c.sync, err = dialHislipChannel(address, settings.TcpTimeout()); err != nil {
+		return nil, err
+	}
+	if err = c.initialize(address, subAddress, settings); err != nil {
+		c.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *hislipConn) initialize(address, subAddress string, settings *PortSettings) error {
+	c.sync.conn.SetDeadline(time.Now().Add(settings.CommandTimeout()))
+	err := c.sync.send(&hislipMessage{
+		msgType:   hislipInitialize,
+		parameter: hislipProtocolVersion<<16 | hislipVendorId,
+		payload:   []byte(subAddress),
+	})
+	if err != nil {
+		return err
+	}
+	resp, err := c.sync.expect(hislipInitializeResponse)
+	if err != nil {
+		return err
+	}
+	sessionId := resp.parameter & 0xffff
+
+	if c.async, err = dialHislipChannel(address, settings.TcpTimeout()); err != nil {
+		return err
+	}
+	c.async.conn.SetDeadline(time.Now().Add(settings.CommandTimeout()))
+	if err := c.async.send(&hislipMessage{msgType: hislipAsyncInitialize, parameter: sessionId}); err != nil {
+		return err
+	}
+	if _, err := c.async.expect(hislipAsyncInitializeResponse); err != nil {
+		return err
+	}
+	return c.SetDeadline(time.Time{})
+}
+
+func (c *hislipConn) SetDeadline(t time.Time) error {
+	if err := c.sync.conn.SetDeadline(t); err != nil {
+		return err
+	}
+	return c.async.conn.SetDeadline(t)
+}
+
+// Write sends the data as a single message with END indicator
+func (c *hislipConn) Write(b []byte) (int, error) {
+	err := c.sync.send(&hislipMessage{
+		msgType:   hislipDataEnd,
+		parameter: c.messageId,
+		payload:   b,
+	})
+	if err != nil {
+		return 0, err
+	}
+	c.lastMessageId = c.messageId
+	c.messageId += 2
+	return len(b), nil
+}
+
+// ReadMessage reads the response to the last message that was
+// sent. The responses to the earlier messages are skipped
+func (c *hislipConn) ReadMessage() ([]byte, error) {
+	var data []byte
+	for {
+		msg, err := c.sync.receive()
+		if err != nil {
+			c.stale = true
+			return nil, err
+		}
+		switch {
+		case msg.msgType == hislipInterrupted:
+			data = nil
+		case msg.msgType != hislipData && msg.msgType != hislipDataEnd:
+			// ignore other messages
+		case msg.parameter != c.lastMessageId:
+			// stale response
+		case msg.msgType == hislipData:
+			data = append(data, msg.payload...)
+		default:
+			return append(data, msg.payload...), nil
+		}
+	}
+}
+
+func (c *hislipConn) Read(b []byte) (int, error) {
+	if len(c.pending) == 0 {
+		msg, err := c.ReadMessage()
+		if err != nil {
+			return 0, err
+		}
+		c.pending = msg
+	}
+	n := copy(b, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+// DeviceClear clears the input and output buffers of the device
+func (c *hislipConn) DeviceClear() error {
+	if err := c.async.send(&hislipMessage{msgType: hislipAsyncDeviceClear}); err != nil {
+		return err
+	}
+	ack, err := c.async.expect(hislipAsyncDeviceClearAcknowledge)
+	if err != nil {
+		return err
+	}
+	// the client must agree with the server's
+	// feature preferences
+	if err := c.sync.send(&hislipMessage{msgType: hislipDeviceClearComplete, control: ack.control}); err != nil {
+		return err
+	}
+	if _, err := c.sync.expect(hislipDeviceClearAcknowledge); err != nil {
+		return err
+	}
+	c.messageId = hislipInitialMessageId
+	c.pending = nil
+	c.stale = false
+	return nil
+}
+
+func (c *hislipConn) Drain() error {
+	c.pending = nil
+	if !c.stale {
+		return nil
+	}
+	return c.DeviceClear()
+}
+
+func (c *hislipConn) Close() error {
+	if c.async != nil {
+		c.async.conn.Close()
+	}
+	return c.sync.conn.Close()
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// fakeHislipServer is a minimal HiSLIP server that responds to
+// '*IDN?' and doesn't respond to 'HANG?'. The responses are
+// sent in small Data messages followed by DataEnd
+type fakeHislipServer struct {
+	listener net.Listener
+	eventCh  chan string
+}
+
+func newFakeHislipServer(t *testing.T) *fakeHislipServer {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen(): %v", err)
+	}
+	s := &fakeHislipServer{
+		listener: listener,
+		eventCh:  make(chan string, 100),
+	}
+	go s.serve()
+	return s
+}
+
+func (s *fakeHislipServer) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		go s.handle(conn)
+	}
+}
+
+func (s *fakeHislipServer) handle(conn net.Conn) {
+	defer conn.Close()
+	ch := &hislipChannel{conn, newMessageReader(conn, parseHislipMessage)}
+	for {
+		msg, err := ch.receive()
+		if err != nil {
+			return
+		}
+		switch msg.msgType {
+		case hislipInitialize:
+			s.eventCh <- fmt.Sprintf("initialize %04x %s", msg.parameter&0xffff, msg.payload)
+			// protocol version, session id
+			ch.send(&hislipMessage{msgType: hislipInitializeResponse, parameter: hislipProtocolVersion<<16 | 7})
+		case hislipAsyncInitialize:
+			s.eventCh <- fmt.Sprintf("async initialize %d", msg.parameter)
+			ch.send(&hislipMessage{msgType: hislipAsyncInitializeResponse})
+		case hislipDataEnd:
+			cmd := strings.TrimSpace(string(msg.payload))
+			s.eventCh <- fmt.Sprintf("write %s %08x", cmd, msg.parameter)
+			if cmd != "*IDN?" {
+				break
+			}
+			resp := "FAKE,HISLIP,0,1.0\n"
+			for ; len(resp) > 5; resp = resp[5:] {
+				ch.send(&hislipMessage{msgType: hislipData, parameter: msg.parameter, payload: []byte(resp[:5])})
+			}
+			ch.send(&hislipMessage{msgType: hislipDataEnd, parameter: msg.parameter, payload: []byte(resp)})
+		case hislipAsyncDeviceClear:
+			s.eventCh <- "clear"
+			ch.send(&hislipMessage{msgType: hislipAsyncDeviceClearAcknowledge, control: 1})
+		case hislipDeviceClearComplete:
+			s.eventCh <- fmt.Sprintf("clear complete %d", msg.control)
+			ch.send(&hislipMessage{msgType: hislipDeviceClearAcknowledge, control: msg.control})
+		default:
+			return
+		}
+	}
+}
+
+func (s *fakeHislipServer) verifyEvents(t *testing.T, expectedEvents ...string) {
+	var events []string
+	for range expectedEvents {
+		events = append(events, <-s.eventCh)
+	}
+	if !reflect.DeepEqual(events, expectedEvents) {
+		t.Errorf("bad server events %q (expected %q)", events, expectedEvents)
+	}
+}
+
+func (s *fakeHislipServer) close() {
+	s.listener.Close()
+}
+
+func TestHislip(t *testing.T) {
+	s := newFakeHislipServer(t)
+	defer s.close()
+
+	commander := NewCommander(connect, &PortSettings{
+		Port:           "hislip://" + s.listener.Addr().String(),
+		TimingSettings: TimingSettings{CommandTimeoutMs: 300},
+	})
+	commander.Connect()
+	defer commander.Close()
+	<-commander.Ready()
+	s.verifyEvents(t, "initialize 5742 hislip0", "async initialize 7")
+
+	query := func(cmd string) (string, error) {
+		return commander.Query(context.Background(), cmd, nil, PriorityBackground)
+	}
+	if resp, err := query("*IDN?"); err != nil {
+		t.Errorf("Query(): %v", err)
+	} else if resp != "FAKE,HISLIP,0,1.0" {
+		t.Errorf("bad response %q", resp)
+	}
+	s.verifyEvents(t, "write *IDN? ffffff00")
+
+	if _, err := query("HANG?"); err != ErrTimeout {
+		t.Errorf("unexpected error value: %#v (expected ErrTimeout)", err)
+	}
+	s.verifyEvents(t, "write HANG? ffffff02")
+
+	// the device must be cleared after the timeout,
+	// resetting the message ids
+	if resp, err := query("*IDN?"); err != nil {
+		t.Errorf("Query(): %v", err)
+	} else if resp != "FAKE,HISLIP,0,1.0" {
+		t.Errorf("bad response %q", resp)
+	}
+	s.verifyEvents(t, "clear", "clear complete 1", "write *IDN? ffffff00")
+}
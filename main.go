@@ -2,37 +2,115 @@ package main
 
 import (
 	"flag"
+	"fmt"
 	"io/ioutil"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
 	"time"
 
 	"github.com/contactless/wbgo"
+	"gopkg.in/fsnotify.v1"
 )
 
 const (
 	DRIVER_CLIENT_ID = "wb-mqtt-scpi"
+	// configReloadDelay is used to avoid reloading the config
+	// multiple times when the file is being written
+	configReloadDelay = 500 * time.Millisecond
 )
 
+func loadConfig(configPath string) (*DriverConfig, error) {
+	confBytes, err := ioutil.ReadFile(configPath)
+	if err != nil {
+		return nil, fmt.Errorf("can't load config: %v", err)
+	}
+	config, err := ParseDriverConfig(confBytes)
+	if err != nil {
+		return nil, fmt.Errorf("can't parse config: %v", err)
+	}
+	return config, nil
+}
+
+func reloadConfig(driver *wbgo.Driver, model *Model, configPath string) {
+	config, err := loadConfig(configPath)
+	if err != nil {
+		wbgo.Error.Printf("config reload failed: %v", err)
+		return
+	}
+	driver.CallSync(func() {
+		if err := model.Reload(config); err != nil {
+			wbgo.Error.Printf("config reload failed: %v", err)
+		} else {
+			wbgo.Info.Printf("config reloaded")
+		}
+	})
+}
+
+// watchConfig returns a channel that receives a value
+// each time the config file is changed
+func watchConfig(configPath string) (<-chan struct{}, error) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	// watch the directory because editors often
+	// replace the file instead of writing to it
+	if err := watcher.Add(filepath.Dir(configPath)); err != nil {
+		watcher.Close()
+		return nil, err
+	}
+	configPath = filepath.Clean(configPath)
+	ch := make(chan struct{}, 1)
+	go func() {
+		var timer *time.Timer
+		var timerCh <-chan time.Time
+		for {
+			select {
+			case ev := <-watcher.Events:
+				if filepath.Clean(ev.Name) != configPath || ev.Op&(fsnotify.Write|fsnotify.Create|fsnotify.Rename) == 0 {
+					continue
+				}
+				if timer != nil {
+					timer.Stop()
+				}
+				timer = time.NewTimer(configReloadDelay)
+				timerCh = timer.C
+			case <-timerCh:
+				timerCh = nil
+				select {
+				case ch <- struct{}{}:
+				default:
+				}
+			case err := <-watcher.Errors:
+				wbgo.Error.Printf("config watcher error: %v", err)
+			}
+		}
+	}()
+	return ch, nil
+}
+
 func main() {
 	configPath := flag.String("config", "/etc/wb-mqtt-scpi.conf", "config path")
 	broker := flag.String("broker", "tcp://localhost:1883", "MQTT broker url")
 	debug := flag.Bool("debug", false, "Enable debugging")
+	watch := flag.Bool("watch", false, "Reload the config when the config file changes")
+	shutdownTimeout := flag.Duration("shutdown-timeout", 5*time.Second, "How long to wait for pending commands to finish on shutdown")
 	flag.Parse()
 
 	if *debug {
 		wbgo.SetDebuggingEnabled(true)
 	}
 
-	confBytes, err := ioutil.ReadFile(*configPath)
+	config, err := loadConfig(*configPath)
 	if err != nil {
-		wbgo.Error.Fatalf("can't load config: %v", err)
-	}
-	config, err := ParseDriverConfig(confBytes)
-	if err != nil {
-		wbgo.Error.Fatalf("can't parse config: %v", err)
+		wbgo.Error.Fatal(err)
 	}
 
 	model := NewModel(DefaultCommanderFactory(connect), config)
 	mqttClient := wbgo.NewPahoMQTTClient(*broker, DRIVER_CLIENT_ID, false)
+	model.SetMQTTClient(mqttClient)
 	driver := wbgo.NewDriver(model, mqttClient)
 	// NOTE: this is not 'real' poll interval
 	// The model polls the device continuously
@@ -40,8 +118,37 @@ func main() {
 	if err := driver.Start(); err != nil {
 		wbgo.Error.Fatalf("failed to start the driver: %v", err)
 	}
+
+	// the config is reloaded on SIGHUP and, if enabled,
+	// when the config file changes
+	hupCh := make(chan os.Signal, 1)
+	signal.Notify(hupCh, syscall.SIGHUP)
+	var watchCh <-chan struct{}
+	if *watch {
+		if watchCh, err = watchConfig(*configPath); err != nil {
+			wbgo.Error.Fatalf("can't watch the config file: %v", err)
+		}
+	}
+	termCh := make(chan os.Signal, 1)
+	signal.Notify(termCh, syscall.SIGTERM, syscall.SIGINT)
 	for {
-		time.Sleep(1 * time.Second)
+		select {
+		case <-hupCh:
+		case <-watchCh:
+		case sig := <-termCh:
+			wbgo.Info.Printf("received %v, shutting down", sig)
+			// CallSync only queues the thunk, so wait for
+			// it to complete before stopping the driver
+			done := make(chan struct{})
+			driver.CallSync(func() {
+				model.Shutdown(*shutdownTimeout)
+				close(done)
+			})
+			<-done
+			driver.Stop()
+			return
+		}
+		reloadConfig(driver, model, *configPath)
 	}
 
 	// conn, err := connect("192.168.255.209:10010")
@@ -0,0 +1,511 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"sync"
+)
+
+const (
+	modbusReadCoils              = 0x01
+	modbusReadDiscreteInputs     = 0x02
+	modbusReadHoldingRegisters   = 0x03
+	modbusReadInputRegisters     = 0x04
+	modbusWriteSingleCoil        = 0x05
+	modbusWriteSingleRegister    = 0x06
+	modbusWriteMultipleRegisters = 0x10
+	modbusExceptionFlag          = 0x80
+
+	modbusFramingRtu = "rtu"
+	modbusFramingTcp = "tcp"
+
+	modbusMbapHeaderSize = 7
+	// the max PDU size plus the unit id
+	modbusMaxMbapLength = 254
+)
+
+var modbusExceptionCodes = map[byte]string{
+	0x01: "illegal function",
+	0x02: "illegal data address",
+	0x03: "illegal data value",
+	0x04: "slave device failure",
+	0x05: "acknowledge",
+	0x06: "slave device busy",
+	0x08: "memory parity error",
+	0x0a: "gateway path unavailable",
+	0x0b: "gateway target device failed to respond",
+}
+
+// modbusFunctions maps the function names used in the
+// parameter specs to the corresponding read function codes
+var modbusFunctions = map[string]byte{
+	"coil":     modbusReadCoils,
+	"discrete": modbusReadDiscreteInputs,
+	"holding":  modbusReadHoldingRegisters,
+	"input":    modbusReadInputRegisters,
+}
+
+// modbusFormatSizes maps the data formats to the
+// corresponding numbers of registers
+var modbusFormatSizes = map[string]int{
+	"u16":     1,
+	"s16":     1,
+	"u32":     2,
+	"s32":     2,
+	"float32": 2,
+}
+
+// modbusCRC calculates Modbus RTU CRC16 of the data
+func modbusCRC(data []byte) uint16 {
+	crc := uint16(0xffff)
+	for _, b := range data {
+		crc ^= uint16(b)
+		for i := 0; i < 8; i++ {
+			if crc&1 != 0 {
+				crc = crc>>1 ^ 0xa001
+			} else {
+				crc >>= 1
+			}
+		}
+	}
+	return crc
+}
+
+// appendModbusCRC appends the CRC to the RTU frame. Unlike the
+// rest of the frame, the CRC is sent low byte first
+func appendModbusCRC(frame []byte) []byte {
+	crc := modbusCRC(frame)
+	return append(frame, byte(crc), byte(crc>>8))
+}
+
+// readModbusRtuFrame reads RTU response frame. The size of the
+// frame is determined by its function code
+func readModbusRtuFrame(r *bufio.Reader) ([]byte, error) {
+	frame := make([]byte, 3)
+	if _, err := io.ReadFull(r, frame); err != nil {
+		return nil, err
+	}
+	var n int
+	switch fn := frame[1]; {
+	case fn&modbusExceptionFlag != 0:
+		// the exception code is already read
+		n = 0
+	case fn >= modbusReadCoils && fn <= modbusReadInputRegisters:
+		// the byte count is already read
+		n = int(frame[2])
+	case fn == modbusWriteSingleCoil || fn == modbusWriteSingleRegister || fn == modbusWriteMultipleRegisters:
+		// address + value or address + quantity
+		n = 3
+	default:
+		return nil, fmt.Errorf("unexpected modbus function code 0x%02x in the response", fn)
+	}
+	frame = append(frame, make([]byte, n+2)...)
+	if _, err := io.ReadFull(r, frame[3:]); err != nil {
+		return nil, err
+	}
+	return frame, nil
+}
+
+// modbusTcpFramer reads Modbus TCP response frames
+// using the length from their MBAP headers
+var modbusTcpFramer = &LengthPrefixedFramer{
+	LengthOffset: 4,
+	LengthSize:   2,
+	MaxLength:    modbusMaxMbapLength,
+}
+
+type modbusParameterSpec struct {
+	Control      ControlConfig `yaml:",inline"`
+	PollSettings `yaml:",inline"`
+	// Slave is the slave id (unit id for Modbus TCP).
+	// Zero means using the address of the port
+	Slave int
+	// Function can be 'coil', 'discrete', 'holding' or 'input'
+	Function string
+	Register int
+	// Format can be 'u16' (default), 's16', 'u32', 's32' or
+	// 'float32'. It's ignored for coils and discrete inputs
+	Format string
+	// WordOrder specifies the order of registers of 32-bit
+	// values, 'big' (default, high word first) or 'little'
+	WordOrder string
+	// Scale and Offset are applied to the register values
+	// as value*scale + offset. Zero scale means 1
+	Scale  float64
+	Offset float64
+}
+
+var _ ParameterSpec = &modbusParameterSpec{}
+
+func (spec *modbusParameterSpec) ListControls() []*ControlConfig {
+	return []*ControlConfig{&spec.Control}
+}
+
+func (spec *modbusParameterSpec) ShouldPoll() bool {
+	return spec.Control.ShouldPoll()
+}
+
+func (spec *modbusParameterSpec) Settable() bool {
+	return spec.Control.Writable
+}
+
+func (spec *modbusParameterSpec) isBit() bool {
+	return spec.Function == "coil" || spec.Function == "discrete"
+}
+
+func (spec *modbusParameterSpec) format() string {
+	if spec.Format == "" {
+		return "u16"
+	}
+	return spec.Format
+}
+
+func (spec *modbusParameterSpec) scale() float64 {
+	if spec.Scale == 0 {
+		return 1
+	}
+	return spec.Scale
+}
+
+func (spec *modbusParameterSpec) Validate() error {
+	if err := spec.Control.Validate(); err != nil {
+		return err
+	}
+	if err := spec.PollSettings.Validate(); err != nil {
+		return err
+	}
+	name := spec.Control.Name
+	switch {
+	case spec.Slave < 0 || spec.Slave > 255:
+		return fmt.Errorf("%s: bad slave id %d", name, spec.Slave)
+	case modbusFunctions[spec.Function] == 0:
+		return fmt.Errorf("%s: bad function %q (must be coil, discrete, holding or input)", name, spec.Function)
+	case spec.Register < 0 || spec.Register > 0xffff:
+		return fmt.Errorf("%s: bad register address %d", name, spec.Register)
+	case modbusFormatSizes[spec.format()] == 0:
+		return fmt.Errorf("%s: bad format %q", name, spec.Format)
+	case spec.WordOrder != "" && spec.WordOrder != "big" && spec.WordOrder != "little":
+		return fmt.Errorf("%s: bad word order %q (must be big or little)", name, spec.WordOrder)
+	case spec.Register+modbusFormatSizes[spec.format()] > 0x10000:
+		return fmt.Errorf("%s: register address %d is out of range", name, spec.Register)
+	case spec.Control.Writable && spec.Function != "coil" && spec.Function != "holding":
+		return fmt.Errorf("%s: only coils and holding registers are writable", name)
+	}
+	return nil
+}
+
+type modbusParameter struct {
+	*modbusParameterSpec
+	protocol *modbusProtocol
+	slave    byte
+}
+
+var _ Parameter = &modbusParameter{}
+
+func (p *modbusParameter) Name() string {
+	return fmt.Sprintf("%d:%s:%d", p.slave, p.Function, p.Register)
+}
+
+func (p *modbusParameter) numRegisters() int {
+	if p.isBit() {
+		return 1
+	}
+	return modbusFormatSizes[p.format()]
+}
+
+// decode converts the register values to the control value
+func (p *modbusParameter) decode(regs []uint16) string {
+	if p.isBit() {
+		return strconv.Itoa(int(regs[0]))
+	}
+	var raw uint32
+	if len(regs) == 1 {
+		raw = uint32(regs[0])
+	} else if p.WordOrder == "little" {
+		raw = uint32(regs[1])<<16 | uint32(regs[0])
+	} else {
+		raw = uint32(regs[0])<<16 | uint32(regs[1])
+	}
+	var v float64
+	switch p.format() {
+	case "u16", "u32":
+		v = float64(raw)
+	case "s16":
+		v = float64(int16(raw))
+	case "s32":
+		v = float64(int32(raw))
+	case "float32":
+		v = float64(math.Float32frombits(raw))
+	}
+	if p.Scale == 0 && p.Offset == 0 {
+		if p.format() == "float32" {
+			return strconv.FormatFloat(v, 'f', -1, 32)
+		}
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	}
+	// limit the precision to avoid rounding artifacts
+	// like 23.400000000000002
+	return strconv.FormatFloat(v*p.scale()+p.Offset, 'g', 12, 64)
+}
+
+// encode converts the control value to the register values
+func (p *modbusParameter) encode(value interface{}) ([]uint16, error) {
+	s := fmt.Sprintf("%v", value)
+	v, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return nil, fmt.Errorf("bad value %q for %q", s, p.Name())
+	}
+	if p.isBit() {
+		if v != 0 {
+			return []uint16{1}, nil
+		}
+		return []uint16{0}, nil
+	}
+	v = (v - p.Offset) / p.scale()
+	var raw uint32
+	switch f := p.format(); f {
+	case "float32":
+		raw = math.Float32bits(float32(v))
+	default:
+		v = math.Round(v)
+		var min, max float64
+		switch f {
+		case "u16":
+			min, max = 0, math.MaxUint16
+		case "s16":
+			min, max = math.MinInt16, math.MaxInt16
+		case "u32":
+			min, max = 0, math.MaxUint32
+		case "s32":
+			min, max = math.MinInt32, math.MaxInt32
+		}
+		if v < min || v > max {
+			return nil, fmt.Errorf("value %s is out of range for %q", s, p.Name())
+		}
+		if v < 0 {
+			raw = uint32(int32(v))
+		} else {
+			raw = uint32(v)
+		}
+	}
+	switch {
+	case p.numRegisters() == 1:
+		return []uint16{uint16(raw)}, nil
+	case p.WordOrder == "little":
+		return []uint16{uint16(raw), uint16(raw >> 16)}, nil
+	default:
+		return []uint16{uint16(raw >> 16), uint16(raw)}, nil
+	}
+}
+
+func (p *modbusParameter) Query(ctx context.Context, c Commander, handler QueryHandler) error {
+	regs, err := p.read(ctx, c, PriorityBackground)
+	if err != nil {
+		return err
+	}
+	handler(p.Control.Name, p.decode(regs))
+	return nil
+}
+
+func (p *modbusParameter) read(ctx context.Context, c Commander, priority CommandPriority) ([]uint16, error) {
+	fn := modbusFunctions[p.Function]
+	count := p.numRegisters()
+	pdu := []byte{fn, 0, 0, 0, 0}
+	binary.BigEndian.PutUint16(pdu[1:], uint16(p.Register))
+	binary.BigEndian.PutUint16(pdu[3:], uint16(count))
+	resp, err := p.protocol.exchange(ctx, c, p.slave, pdu, priority)
+	if err != nil {
+		return nil, err
+	}
+	if p.isBit() {
+		if len(resp) != 3 || resp[1] != 1 {
+			return nil, fmt.Errorf("%s: malformed response", p.Name())
+		}
+		return []uint16{uint16(resp[2] & 1)}, nil
+	}
+	if len(resp) != 2+count*2 || int(resp[1]) != count*2 {
+		return nil, fmt.Errorf("%s: malformed response", p.Name())
+	}
+	regs := make([]uint16, count)
+	for i := range regs {
+		regs[i] = binary.BigEndian.Uint16(resp[2+i*2:])
+	}
+	return regs, nil
+}
+
+func (p *modbusParameter) Set(ctx context.Context, c Commander, name string, value interface{}) error {
+	if name != p.Control.Name {
+		return fmt.Errorf("unknown control name %q", name)
+	}
+	regs, err := p.encode(value)
+	if err != nil {
+		return err
+	}
+	var pdu []byte
+	switch {
+	case p.Function == "coil":
+		pdu = []byte{modbusWriteSingleCoil, 0, 0, 0, 0}
+		if regs[0] != 0 {
+			pdu[3] = 0xff
+		}
+	case len(regs) == 1:
+		pdu = []byte{modbusWriteSingleRegister, 0, 0, 0, 0}
+		binary.BigEndian.PutUint16(pdu[3:], regs[0])
+	default:
+		pdu = []byte{modbusWriteMultipleRegisters, 0, 0, 0, 0, byte(len(regs) * 2)}
+		binary.BigEndian.PutUint16(pdu[3:], uint16(len(regs)))
+		for _, reg := range regs {
+			pdu = append(pdu, byte(reg>>8), byte(reg))
+		}
+	}
+	binary.BigEndian.PutUint16(pdu[1:], uint16(p.Register))
+	resp, err := p.protocol.exchange(ctx, c, p.slave, pdu, PriorityInteractive)
+	if err != nil {
+		return err
+	}
+	// the response echoes the address and the value
+	// (or the quantity of registers written)
+	if len(resp) != 5 || string(resp) != string(pdu[:5]) {
+		return fmt.Errorf("%s: unexpected response to the write request", p.Name())
+	}
+	return nil
+}
+
+type modbusProtocol struct {
+	framing       string
+	address       int
+	mutex         sync.Mutex
+	transactionId uint16
+	// probe is the parameter that's read to make
+	// sure the device responds
+	probe *modbusParameter
+}
+
+var _ Protocol = &modbusProtocol{}
+
+func newModbusProtocol(config *PortConfig) (Protocol, error) {
+	framing := config.Framing
+	switch framing {
+	case "":
+		framing = modbusFramingRtu
+	case modbusFramingRtu, modbusFramingTcp:
+	default:
+		return nil, fmt.Errorf("bad modbus framing %q (must be rtu or tcp)", config.Framing)
+	}
+	if config.Address < 0 || config.Address > 255 {
+		return nil, fmt.Errorf("bad modbus address %d", config.Address)
+	}
+	return &modbusProtocol{framing: framing, address: config.Address}, nil
+}
+
+// Identify reads the first parameter of the device to make sure
+// it responds, as there's no universally supported identification
+// request in Modbus
+func (p *modbusProtocol) Identify(ctx context.Context, c Commander) (string, error) {
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+	p.mutex.Lock()
+	probe := p.probe
+	p.mutex.Unlock()
+	if probe != nil {
+		if _, err := probe.read(ctx, c, PriorityBackground); err != nil {
+			return "", err
+		}
+	}
+	return fmt.Sprintf("Modbus %s", p.framing), nil
+}
+
+func (p *modbusProtocol) Parameter(spec ParameterSpec) (Parameter, error) {
+	modbusSpec, ok := spec.(*modbusParameterSpec)
+	if !ok {
+		return nil, errors.New("Modbus parameter spec expected")
+	}
+	slave := modbusSpec.Slave
+	if slave == 0 {
+		slave = p.address
+	}
+	if slave == 0 && p.framing == modbusFramingRtu {
+		return nil, fmt.Errorf("%s: slave id not specified", modbusSpec.Control.Name)
+	}
+	param := &modbusParameter{modbusSpec, p, byte(slave)}
+	p.mutex.Lock()
+	if p.probe == nil {
+		p.probe = param
+	}
+	p.mutex.Unlock()
+	return param, nil
+}
+
+func (p *modbusProtocol) nextTransactionId() uint16 {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.transactionId++
+	return p.transactionId
+}
+
+// exchange sends the request PDU to the slave and returns the
+// response PDU. Modbus exceptions are returned as errors
+func (p *modbusProtocol) exchange(ctx context.Context, c Commander, slave byte, pdu []byte, priority CommandPriority) ([]byte, error) {
+	var resp []byte
+	if p.framing == modbusFramingTcp {
+		transactionId := p.nextTransactionId()
+		req := make([]byte, modbusMbapHeaderSize, modbusMbapHeaderSize+len(pdu))
+		binary.BigEndian.PutUint16(req, transactionId)
+		binary.BigEndian.PutUint16(req[4:], uint16(len(pdu)+1))
+		req[6] = slave
+		frame, err := c.Exchange(ctx, append(req, pdu...), modbusTcpFramer, priority)
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case len(frame) < modbusMbapHeaderSize+2:
+			return nil, errors.New("malformed modbus tcp frame")
+		case binary.BigEndian.Uint16(frame) != transactionId:
+			return nil, fmt.Errorf("modbus transaction id mismatch: %d instead of %d", binary.BigEndian.Uint16(frame), transactionId)
+		case binary.BigEndian.Uint16(frame[2:]) != 0:
+			return nil, errors.New("bad modbus protocol id")
+		case frame[6] != slave:
+			return nil, fmt.Errorf("modbus unit id mismatch: %d instead of %d", frame[6], slave)
+		}
+		resp = frame[modbusMbapHeaderSize:]
+	} else {
+		req := appendModbusCRC(append([]byte{slave}, pdu...))
+		frame, err := c.Exchange(ctx, req, FramerFunc(readModbusRtuFrame), priority)
+		if err != nil {
+			return nil, err
+		}
+		n := len(frame) - 2
+		if crc := modbusCRC(frame[:n]); byte(crc) != frame[n] || byte(crc>>8) != frame[n+1] {
+			return nil, errors.New("modbus CRC error")
+		}
+		if frame[0] != slave {
+			return nil, fmt.Errorf("modbus slave id mismatch: %d instead of %d", frame[0], slave)
+		}
+		resp = frame[1:n]
+	}
+
+	switch {
+	case resp[0] == pdu[0]|modbusExceptionFlag:
+		if len(resp) < 2 {
+			return nil, errors.New("malformed modbus exception response")
+		}
+		if msg, found := modbusExceptionCodes[resp[1]]; found {
+			return nil, fmt.Errorf("modbus exception: %s", msg)
+		}
+		return nil, fmt.Errorf("modbus exception: unknown exception code %d", resp[1])
+	case resp[0] != pdu[0]:
+		return nil, fmt.Errorf("modbus function code mismatch: 0x%02x instead of 0x%02x", resp[0], pdu[0])
+	}
+	return resp, nil
+}
+
+func init() {
+	RegisterProtocol("modbus", newModbusProtocol, &modbusParameterSpec{})
+}
@@ -0,0 +1,308 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"reflect"
+	"testing"
+	"time"
+)
+
+var modbusConfig = `
+ports:
+- name: modbus
+  title: Modbus
+  port: someport
+  protocol: modbus
+  address: 1
+  parameters:
+  # parameter 0
+  - name: voltage
+    title: Voltage
+    type: voltage
+    function: input
+    register: 0x10
+    scale: 0.1
+  # parameter 1
+  - name: temperature
+    title: Temperature
+    type: temperature
+    function: holding
+    register: 0x20
+    format: s16
+    writable: true
+  # parameter 2
+  - name: power
+    title: Power
+    type: power
+    function: input
+    register: 0x30
+    format: float32
+  # parameter 3
+  - name: counter
+    title: Counter
+    type: value
+    function: holding
+    register: 0x40
+    format: u32
+    wordorder: little
+    writable: true
+  # parameter 4
+  - name: output
+    title: Output
+    type: switch
+    slave: 2
+    function: coil
+    register: 5
+    writable: true
+  # parameter 5
+  - name: alarm
+    title: Alarm
+    type: switch
+    function: discrete
+    register: 7
+`
+
+var modbusTcpConfig = `
+ports:
+- name: modbus
+  title: Modbus
+  port: someport
+  protocol: modbus
+  framing: tcp
+  parameters:
+  - name: current
+    title: Current
+    type: current
+    slave: 3
+    function: holding
+    register: 0x100
+    scale: 0.01
+    offset: -1
+    writable: true
+`
+
+type modbusTester struct {
+	*cmdTester
+	commander  *DeviceCommander
+	protocol   Protocol
+	portConfig *PortConfig
+}
+
+func newModbusTester(t *testing.T, configText string) *modbusTester {
+	config, err := ParseDriverConfig([]byte(configText))
+	if err != nil {
+		t.Fatalf("Failed to parse config: %v", err)
+	}
+	protocol, err := CreateProtocol(config.Ports[0])
+	if err != nil {
+		t.Fatalf("CreateProtocol(): %v", err)
+	}
+	tester := newCmdTester(t, samplePort)
+	commander := NewCommander(tester.connect, config.Ports[0].PortSettings)
+	commander.Connect()
+	<-commander.Ready()
+	commander.SetClock(tester)
+	return &modbusTester{tester, commander, protocol, config.Ports[0]}
+}
+
+func (mt *modbusTester) param(paramIndex int) Parameter {
+	param, err := mt.protocol.Parameter(mt.portConfig.Parameters[paramIndex])
+	if err != nil {
+		mt.t.Fatalf("Parameter(): %v", err)
+	}
+	return param
+}
+
+// exchange verifies the request frame and sends the response frame
+// while thunk is being executed
+func (mt *modbusTester) exchange(request, response []byte, thunk func() error) error {
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- thunk()
+	}()
+	buf := make([]byte, len(request))
+	readCh := make(chan error, 1)
+	go func() {
+		_, err := io.ReadFull(mt.ourReader, buf)
+		readCh <- err
+	}()
+	select {
+	case <-time.After(30 * time.Second):
+		mt.t.Fatalf("timed out waiting for the request % x", request)
+	case err := <-readCh:
+		if err != nil {
+			mt.t.Fatalf("failed to read the request: %v", err)
+		}
+	}
+	if !bytes.Equal(buf, request) {
+		mt.t.Fatalf("bad request: % x (expected % x)", buf, request)
+	}
+	if _, err := mt.ourWriter.Write(response); err != nil {
+		mt.t.Fatalf("Write failed: %v", err)
+	}
+	return <-errCh
+}
+
+func (mt *modbusTester) verifyQuery(paramIndex int, request, response []byte, expectedValue string) {
+	param := mt.param(paramIndex)
+	r := make(map[string]interface{})
+	if err := mt.exchange(request, response, func() error {
+		return param.Query(context.Background(), mt.commander, func(name string, value interface{}) {
+			r[name] = value
+		})
+	}); err != nil {
+		mt.t.Fatalf("Query(): %v", err)
+	}
+	expectedResult := map[string]interface{}{
+		mt.portConfig.Parameters[paramIndex].ListControls()[0].Name: expectedValue,
+	}
+	if !reflect.DeepEqual(r, expectedResult) {
+		mt.t.Errorf("bad query result: %#v (expected: %#v)", r, expectedResult)
+	}
+}
+
+func (mt *modbusTester) verifySet(paramIndex int, value interface{}, request, response []byte) {
+	param := mt.param(paramIndex)
+	name := mt.portConfig.Parameters[paramIndex].ListControls()[0].Name
+	if err := mt.exchange(request, response, func() error {
+		return param.Set(context.Background(), mt.commander, name, value)
+	}); err != nil {
+		mt.t.Fatalf("Set(): %v", err)
+	}
+}
+
+func (mt *modbusTester) verifyQueryError(paramIndex int, request, response []byte, errStr string) {
+	param := mt.param(paramIndex)
+	err := mt.exchange(request, response, func() error {
+		return param.Query(context.Background(), mt.commander, func(string, interface{}) {
+			mt.t.Errorf("unexpected query handler call")
+		})
+	})
+	if err == nil {
+		mt.t.Fatalf("no error received for param %d", paramIndex)
+	}
+	if err.Error() != errStr {
+		mt.t.Errorf("unexpected error string %q (expected %q)", err, errStr)
+	}
+}
+
+func rtu(data ...byte) []byte {
+	return appendModbusCRC(data)
+}
+
+func TestModbusCRC(t *testing.T) {
+	frame := rtu(0x01, 0x03, 0x00, 0x00, 0x00, 0x01)
+	if expected := []byte{0x01, 0x03, 0x00, 0x00, 0x00, 0x01, 0x84, 0x0a}; !bytes.Equal(frame, expected) {
+		t.Errorf("bad frame % x (expected % x)", frame, expected)
+	}
+}
+
+func TestModbusQuery(t *testing.T) {
+	mt := newModbusTester(t, modbusConfig)
+	defer mt.commander.Close()
+	mt.verifyQuery(0,
+		rtu(0x01, 0x04, 0x00, 0x10, 0x00, 0x01),
+		rtu(0x01, 0x04, 0x02, 0x00, 0xea),
+		"23.4")
+	mt.verifyQuery(1,
+		rtu(0x01, 0x03, 0x00, 0x20, 0x00, 0x01),
+		rtu(0x01, 0x03, 0x02, 0xff, 0xf6),
+		"-10")
+	mt.verifyQuery(2,
+		rtu(0x01, 0x04, 0x00, 0x30, 0x00, 0x02),
+		rtu(0x01, 0x04, 0x04, 0x41, 0x46, 0x00, 0x00),
+		"12.375")
+	mt.verifyQuery(3,
+		rtu(0x01, 0x03, 0x00, 0x40, 0x00, 0x02),
+		rtu(0x01, 0x03, 0x04, 0x00, 0x01, 0x00, 0x02),
+		"131073")
+	mt.verifyQuery(4,
+		rtu(0x02, 0x01, 0x00, 0x05, 0x00, 0x01),
+		rtu(0x02, 0x01, 0x01, 0x01),
+		"1")
+	mt.verifyQuery(5,
+		rtu(0x01, 0x02, 0x00, 0x07, 0x00, 0x01),
+		rtu(0x01, 0x02, 0x01, 0x00),
+		"0")
+}
+
+func TestModbusSet(t *testing.T) {
+	mt := newModbusTester(t, modbusConfig)
+	defer mt.commander.Close()
+	mt.verifySet(1, "-10",
+		rtu(0x01, 0x06, 0x00, 0x20, 0xff, 0xf6),
+		rtu(0x01, 0x06, 0x00, 0x20, 0xff, 0xf6))
+	mt.verifySet(3, "131073",
+		rtu(0x01, 0x10, 0x00, 0x40, 0x00, 0x02, 0x04, 0x00, 0x01, 0x00, 0x02),
+		rtu(0x01, 0x10, 0x00, 0x40, 0x00, 0x02))
+	mt.verifySet(4, "1",
+		rtu(0x02, 0x05, 0x00, 0x05, 0xff, 0x00),
+		rtu(0x02, 0x05, 0x00, 0x05, 0xff, 0x00))
+	mt.verifySet(4, "0",
+		rtu(0x02, 0x05, 0x00, 0x05, 0x00, 0x00),
+		rtu(0x02, 0x05, 0x00, 0x05, 0x00, 0x00))
+}
+
+func TestModbusErrors(t *testing.T) {
+	mt := newModbusTester(t, modbusConfig)
+	defer mt.commander.Close()
+	mt.verifyQueryError(0,
+		rtu(0x01, 0x04, 0x00, 0x10, 0x00, 0x01),
+		rtu(0x01, 0x84, 0x02),
+		"modbus exception: illegal data address")
+	badCRC := rtu(0x01, 0x04, 0x02, 0x00, 0xea)
+	badCRC[len(badCRC)-1] ^= 0xff
+	mt.verifyQueryError(0,
+		rtu(0x01, 0x04, 0x00, 0x10, 0x00, 0x01),
+		badCRC,
+		"modbus CRC error")
+	// make sure the commander still works
+	mt.verifyQuery(0,
+		rtu(0x01, 0x04, 0x00, 0x10, 0x00, 0x01),
+		rtu(0x01, 0x04, 0x02, 0x00, 0x0a),
+		"1")
+}
+
+func TestModbusIdentify(t *testing.T) {
+	mt := newModbusTester(t, modbusConfig)
+	defer mt.commander.Close()
+	mt.param(0)
+	identify := func() error {
+		id, err := mt.protocol.Identify(context.Background(), mt.commander)
+		if err == nil && id != "Modbus rtu" {
+			t.Errorf("bad id %q", id)
+		}
+		return err
+	}
+	if err := mt.exchange(
+		rtu(0x01, 0x04, 0x00, 0x10, 0x00, 0x01),
+		rtu(0x01, 0x04, 0x02, 0x00, 0xea),
+		identify); err != nil {
+		t.Errorf("Identify(): %v", err)
+	}
+	err := mt.exchange(
+		rtu(0x01, 0x04, 0x00, 0x10, 0x00, 0x01),
+		rtu(0x01, 0x84, 0x04),
+		identify)
+	if expectedErr := "modbus exception: slave device failure"; err == nil || err.Error() != expectedErr {
+		t.Errorf("unexpected Identify() error %v (expected %q)", err, expectedErr)
+	}
+}
+
+func TestModbusTcp(t *testing.T) {
+	mt := newModbusTester(t, modbusTcpConfig)
+	defer mt.commander.Close()
+	mt.verifyQuery(0,
+		[]byte{0x00, 0x01, 0x00, 0x00, 0x00, 0x06, 0x03, 0x03, 0x01, 0x00, 0x00, 0x01},
+		[]byte{0x00, 0x01, 0x00, 0x00, 0x00, 0x05, 0x03, 0x03, 0x02, 0x01, 0xf4},
+		"4")
+	mt.verifySet(0, "2.5",
+		[]byte{0x00, 0x02, 0x00, 0x00, 0x00, 0x06, 0x03, 0x06, 0x01, 0x00, 0x01, 0x5e},
+		[]byte{0x00, 0x02, 0x00, 0x00, 0x00, 0x06, 0x03, 0x06, 0x01, 0x00, 0x01, 0x5e})
+	mt.verifyQueryError(0,
+		[]byte{0x00, 0x03, 0x00, 0x00, 0x00, 0x06, 0x03, 0x03, 0x01, 0x00, 0x00, 0x01},
+		[]byte{0x00, 0x03, 0x00, 0x00, 0x00, 0x03, 0x03, 0x83, 0x0b},
+		"modbus exception: gateway target device failed to respond")
+}
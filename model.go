@@ -1,8 +1,12 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"log"
+	"reflect"
+	"sort"
+	"strconv"
 	"sync"
 	"time"
 
@@ -11,6 +15,25 @@ import (
 
 const (
 	minPollInterval = 50 * time.Millisecond
+	// maxPollDelay limits the time between the poll loop
+	// wakeups so the device status is kept up to date
+	// even if no parameters are due
+	maxPollDelay = time.Second
+)
+
+var (
+	// controlMetaNames lists the control metadata
+	// that may be published for the controls
+	controlMetaNames = []string{"type", "name", "units", "readonly", "order", "min", "max", "precision", "error"}
+)
+
+const (
+	// readErrorMeta and writeErrorMeta are the values of
+	// meta/error topic for the controls that couldn't be read
+	// from or written to the device, respectively. If both
+	// errors are present, they're combined, e.g. "rw"
+	readErrorMeta  = "r"
+	writeErrorMeta = "w"
 )
 
 type deviceControl struct {
@@ -20,7 +43,14 @@ type deviceControl struct {
 	dirty         bool
 	sent          bool
 	writing       bool
+	writeQueued   bool
+	queuedValue   string
 	value         string
+	deviceValue   string
+	readError     bool
+	writeError    bool
+	errorDirty    bool
+	metaSent      bool
 }
 
 func (dc *deviceControl) writability() wbgo.Writability {
@@ -43,7 +73,7 @@ func (dc *deviceControl) title() string {
 }
 
 func (dc *deviceControl) toWbgoControl() wbgo.Control {
-	return wbgo.Control{
+	control := wbgo.Control{
 		Name:        dc.config.Name,
 		Title:       dc.title(),
 		Type:        dc.config.Type,
@@ -51,6 +81,11 @@ func (dc *deviceControl) toWbgoControl() wbgo.Control {
 		Value:       dc.value,
 		Writability: dc.writability(),
 	}
+	if dc.config.Max != nil {
+		control.HasMax = true
+		control.Max = *dc.config.Max
+	}
+	return control
 }
 
 func (dc *deviceControl) wasPolled() bool {
@@ -66,22 +101,125 @@ func (dc *deviceControl) setValueFromDevice(v interface{}) {
 		return
 	}
 	dc.value = dc.config.TransformDeviceValue(v)
+	dc.deviceValue = dc.value
 	// should only send id value once
 	dc.dirty = !dc.sent || (dc.config.Name != idControlName && dc.config.ShouldPoll())
+	dc.setReadErrorUnlocked(false)
 }
 
-func (dc *deviceControl) startWrite(value string) {
+// setValueIfChanged is like setValueFromDevice but only marks
+// the control as dirty if its value has changed
+func (dc *deviceControl) setValueIfChanged(v interface{}) {
+	dc.Lock()
+	defer dc.Unlock()
+	value := dc.config.TransformDeviceValue(v)
+	if dc.sent && value == dc.value {
+		return
+	}
+	dc.value = value
+	dc.deviceValue = value
+	dc.dirty = true
+}
+
+func (dc *deviceControl) setReadErrorUnlocked(readError bool) {
+	if dc.readError != readError {
+		dc.readError = readError
+		dc.errorDirty = true
+	}
+}
+
+// setReadError marks the control as failed to be read from the device
+func (dc *deviceControl) setReadError() {
+	dc.Lock()
+	defer dc.Unlock()
+	dc.setReadErrorUnlocked(true)
+}
+
+// clearReadError clears the read error of the control
+func (dc *deviceControl) clearReadError() {
+	dc.Lock()
+	defer dc.Unlock()
+	dc.setReadErrorUnlocked(false)
+}
+
+func (dc *deviceControl) setWriteErrorUnlocked(writeError bool) {
+	if dc.writeError != writeError {
+		dc.writeError = writeError
+		dc.errorDirty = true
+	}
+}
+
+// setWriteError marks the control as failed to be written to
+// the device or clears the write error
+func (dc *deviceControl) setWriteError(writeError bool) {
+	dc.Lock()
+	defer dc.Unlock()
+	dc.setWriteErrorUnlocked(writeError)
+}
+
+func (dc *deviceControl) errorMeta() string {
+	v := ""
+	if dc.readError {
+		v += readErrorMeta
+	}
+	if dc.writeError {
+		v += writeErrorMeta
+	}
+	return v
+}
+
+// queueWrite sets the value of the control and stores it to be
+// written to the device. It returns false if there's already a
+// queued write for this control, in which case the queued value
+// is replaced
+func (dc *deviceControl) queueWrite(value string) bool {
 	dc.Lock()
 	defer dc.Unlock()
 	dc.value = value
 	dc.dirty = false
 	dc.writing = true
+	dc.queuedValue = value
+	if dc.writeQueued {
+		return false
+	}
+	dc.writeQueued = true
+	return true
+}
+
+// takeWrite returns the queued value to be written to the device
+func (dc *deviceControl) takeWrite() string {
+	dc.Lock()
+	defer dc.Unlock()
+	dc.writeQueued = false
+	return dc.queuedValue
 }
 
-func (dc *deviceControl) endWrite() {
+// endWrite finishes the write. It returns false if another
+// write was queued for the control in the meantime
+func (dc *deviceControl) endWrite() bool {
 	dc.Lock()
 	defer dc.Unlock()
+	dc.setWriteErrorUnlocked(false)
+	if dc.writeQueued {
+		return false
+	}
 	dc.writing = false
+	return true
+}
+
+// failWrite marks the control as failed to be written and, unless
+// another write is queued, reverts it to the last value that was
+// read from the device
+func (dc *deviceControl) failWrite() {
+	dc.Lock()
+	defer dc.Unlock()
+	dc.setWriteErrorUnlocked(true)
+	if dc.writeQueued {
+		return
+	}
+	dc.writing = false
+	dc.value = dc.deviceValue
+	dc.dirty = true
 }
 
 func (dc *deviceControl) send(dev wbgo.LocalDeviceModel, observer wbgo.DeviceObserver) {
@@ -103,14 +241,142 @@ func (dc *deviceControl) send(dev wbgo.LocalDeviceModel, observer wbgo.DeviceObs
 	}
 }
 
+// sendError publishes the error state of the control if it has
+// changed. The error is only published after the control itself
+// is published
+func (dc *deviceControl) sendError(publishMeta func(controlName, metaName, value string)) {
+	dc.Lock()
+	if !dc.errorDirty || !dc.sent {
+		dc.Unlock()
+		return
+	}
+	dc.errorDirty = false
+	v := dc.errorMeta()
+	dc.Unlock()
+	publishMeta(dc.config.Name, "error", v)
+}
+
+// sendMeta publishes the control metadata that's not supported
+// by wbgo. It's only published once after the control itself
+// is published
+func (dc *deviceControl) sendMeta(publishMeta func(controlName, metaName, value string)) {
+	dc.Lock()
+	if dc.metaSent || !dc.sent {
+		dc.Unlock()
+		return
+	}
+	dc.metaSent = true
+	dc.Unlock()
+	if dc.config.Min != nil {
+		publishMeta(dc.config.Name, "min", fmt.Sprintf("%v", *dc.config.Min))
+	}
+	if dc.config.Precision != nil {
+		publishMeta(dc.config.Name, "precision", strconv.Itoa(*dc.config.Precision))
+	}
+	// wbgo publishes meta/order for every control, so it's
+	// only republished for the controls with explicit order
+	if dc.config.Order != 0 {
+		publishMeta(dc.config.Name, "order", strconv.Itoa(dc.config.Order))
+	}
+}
+
+// pollItem tracks the polling schedule of a parameter
+type pollItem struct {
+	spec     ParameterSpec
+	param    Parameter
+	nextPoll time.Time
+	done     bool
+}
+
+// pollScheduler decides which parameters of the device
+// should be queried during the poll cycle
+type pollScheduler struct {
+	items []*pollItem
+}
+
+func newPollScheduler(specs []ParameterSpec, params map[ParameterSpec]Parameter) *pollScheduler {
+	s := &pollScheduler{}
+	for _, spec := range specs {
+		if spec.ShouldPoll() {
+			s.items = append(s.items, &pollItem{spec: spec, param: params[spec]})
+		}
+	}
+	// keep config order for the parameters with the same priority
+	sort.SliceStable(s.items, func(i, j int) bool {
+		return s.items[i].spec.Polling().Priority > s.items[j].spec.Polling().Priority
+	})
+	return s
+}
+
+// due returns the items that should be polled at the specified
+// time, ordered by their priority
+func (s *pollScheduler) due(now time.Time) []*pollItem {
+	var r []*pollItem
+	for _, item := range s.items {
+		switch {
+		case item.spec.Polling().ReadOnce && item.done:
+		case item.nextPoll.After(now):
+		default:
+			r = append(r, item)
+		}
+	}
+	return r
+}
+
+// next returns the time when the next item becomes due.
+// It returns false if there are no more items to poll
+func (s *pollScheduler) next() (time.Time, bool) {
+	var r time.Time
+	found := false
+	for _, item := range s.items {
+		if item.spec.Polling().ReadOnce && item.done {
+			continue
+		}
+		if !found || item.nextPoll.Before(r) {
+			r = item.nextPoll
+			found = true
+		}
+	}
+	return r, found
+}
+
+// polled updates the schedule after the item is polled at the
+// specified time
+func (s *pollScheduler) polled(item *pollItem, now time.Time, ok bool) {
+	if ok {
+		item.done = true
+	}
+	item.nextPoll = now.Add(item.spec.Polling().PollInterval)
+}
+
+// reset makes the scheduler re-read read-once parameters,
+// e.g. after the device identification failure
+func (s *pollScheduler) reset() {
+	for _, item := range s.items {
+		item.done = false
+	}
+}
+
 type device struct {
 	wbgo.DeviceBase
-	commander  Commander
-	protocol   Protocol
-	portConfig *PortConfig
-	stopCh     chan struct{}
-	controls   map[string]*deviceControl
-	parameters []Parameter
+	commander    Commander
+	protocol     Protocol
+	portConfig   *PortConfig
+	ctx          context.Context
+	cancel       context.CancelFunc
+	loopCtx      context.Context // cancelled to stop the poll and write loops
+	stopLoops    context.CancelFunc
+	wg           sync.WaitGroup
+	controls     map[string]*deviceControl
+	diagControls []*deviceControl
+	errorChecker ErrorChecker
+	scheduler    *pollScheduler
+	clock        Clock
+	client       wbgo.MQTTClient
+	identified   bool
+	writeMtx     sync.Mutex // protects 'writeQueue'
+	writeQueue   []*deviceControl
+	writeCh      chan struct{}
 }
 
 var (
@@ -120,9 +386,38 @@ var (
 		Title: "id",
 		Type:  "text",
 	}
+	onlineControlName = "online"
+	onlineControl     = &ControlConfig{
+		Name:  onlineControlName,
+		Title: "Online",
+		Type:  "switch",
+	}
+	lastErrorControlName = "lastError"
+	lastErrorControl     = &ControlConfig{
+		Name:  lastErrorControlName,
+		Title: "Last error",
+		Type:  "text",
+	}
+	reconnectAttemptsControlName = "reconnectAttempts"
+	reconnectBackoffControlName  = "reconnectBackoff"
+	diagControlConfigs           = []*ControlConfig{
+		{
+			Name:  reconnectAttemptsControlName,
+			Title: "Reconnect attempts",
+			Type:  "value",
+		},
+		{
+			Name:  reconnectBackoffControlName,
+			Title: "Reconnect backoff",
+			Type:  "value",
+			Units: "s",
+		},
+	}
 )
 
-func newDevice(commander Commander, portConfig *PortConfig, stopCh chan struct{}) (*device, error) {
+// newDevice creates a new device. The device is not polled till
+// start() is called
+func newDevice(portConfig *PortConfig, clock Clock, client wbgo.MQTTClient) (*device, error) {
 	protocol, err := CreateProtocol(portConfig)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create protocol: %v", err)
@@ -138,14 +433,12 @@ func newDevice(commander Commander, portConfig *PortConfig, stopCh chan struct{}
 		title = portConfig.Name
 	}
 
-	var params []Parameter
 	paramMap := make(map[ParameterSpec]Parameter)
 	for _, paramSpec := range portConfig.Parameters {
 		param, err := protocol.Parameter(paramSpec)
 		if err != nil {
 			return nil, fmt.Errorf("failed to resolve parameter: %v", err)
 		}
-		params = append(params, param)
 		paramMap[paramSpec] = param
 	}
 
@@ -154,12 +447,13 @@ func newDevice(commander Commander, portConfig *PortConfig, stopCh chan struct{}
 			DevName:  portConfig.Name,
 			DevTitle: title,
 		},
-		commander:  commander,
 		protocol:   protocol,
 		portConfig: portConfig,
-		stopCh:     stopCh,
 		controls:   make(map[string]*deviceControl),
-		parameters: params,
+		scheduler:  newPollScheduler(portConfig.Parameters, paramMap),
+		clock:      clock,
+		client:     client,
+		writeCh:    make(chan struct{}, 1),
 	}
 
 	d.controls[idControlName] = &deviceControl{config: idControl}
@@ -168,6 +462,31 @@ func newDevice(commander Commander, portConfig *PortConfig, stopCh chan struct{}
 			config: controlConfig,
 		}
 	}
+	if _, found := d.controls[onlineControlName]; found {
+		return nil, fmt.Errorf("control name %q is reserved", onlineControlName)
+	}
+	d.controls[onlineControlName] = &deviceControl{config: onlineControl}
+	if portConfig.CheckErrors {
+		errorChecker, ok := protocol.(ErrorChecker)
+		if !ok {
+			return nil, fmt.Errorf("protocol %q doesn't support error checking", portConfig.Protocol)
+		}
+		if _, found := d.controls[lastErrorControlName]; found {
+			return nil, fmt.Errorf("control name %q is reserved", lastErrorControlName)
+		}
+		d.controls[lastErrorControlName] = &deviceControl{config: lastErrorControl}
+		d.errorChecker = errorChecker
+	}
+	if portConfig.Diagnostics {
+		for _, controlConfig := range diagControlConfigs {
+			if _, found := d.controls[controlConfig.Name]; found {
+				return nil, fmt.Errorf("control name %q is reserved for diagnostics", controlConfig.Name)
+			}
+			control := &deviceControl{config: controlConfig}
+			d.controls[controlConfig.Name] = control
+			d.diagControls = append(d.diagControls, control)
+		}
+	}
 
 	for name, paramSpec := range paramSpecSetMap {
 		if paramMap[paramSpec] == nil {
@@ -191,47 +510,107 @@ func (d *device) idControl() *deviceControl {
 	return d.control(idControlName)
 }
 
+// publishControlMeta publishes control metadata that's not handled by
+// wbgo.Driver
+func (d *device) publishControlMeta(controlName, metaName, value string) {
+	if d.client == nil {
+		return
+	}
+	d.client.Publish(wbgo.MQTTMessage{
+		Topic:    fmt.Sprintf("/devices/%s/controls/%s/meta/%s", d.DevName, controlName, metaName),
+		Payload:  value,
+		QoS:      1,
+		Retained: true,
+	})
+}
+
 func (d *device) identify() bool {
-	r, err := d.protocol.Identify(d.commander)
+	r, err := d.protocol.Identify(d.ctx, d.commander)
 	if err != nil {
 		select {
-		case <-d.stopCh:
+		case <-d.ctx.Done():
 			return false
 			// ignore errors if stopping
 		default:
 			wbgo.Error.Printf("Identify() failed for device %s: %v", d.portConfig.Name, err)
 		}
+		// re-read read-once parameters after the device
+		// is identified again
+		d.scheduler.reset()
+		d.identified = false
+		d.idControl().setReadError()
 		return false
 	}
 	d.idControl().setValueFromDevice(r)
+	d.identified = true
 	return true
 }
 
+// updateStatus updates the values of 'online' control and
+// diagnostic controls, if any. The failure to put the device
+// into the safe state after reconnecting is reported as
+// the write error of 'online' control
+func (d *device) updateStatus() {
+	diag := d.commander.Diagnostics()
+	online := "0"
+	if diag.Connected && d.identified {
+		online = "1"
+	}
+	d.control(onlineControlName).setValueIfChanged(online)
+	if diag.Connected {
+		// clear the error set while waiting for the port
+		d.control(onlineControlName).clearReadError()
+	}
+	d.control(onlineControlName).setWriteError(diag.SafeStateFailed)
+	if len(d.diagControls) == 0 {
+		return
+	}
+	d.control(reconnectAttemptsControlName).setValueIfChanged(diag.ReconnectAttempts)
+	d.control(reconnectBackoffControlName).setValueIfChanged(diag.ReconnectBackoff.Seconds())
+}
+
 // poll polls the underlying device and marks any updated control as dirty
 func (d *device) poll() {
+	defer d.updateStatus()
+
 	// only poll 'id' once unless Resync is enabled, in which
-	// case read id on each poll loop
-	if (d.portConfig.Resync || !d.idControl().wasPolled()) && !d.identify() {
+	// case read id each time some parameters are due
+	now := d.clock.Now()
+	due := d.scheduler.due(now)
+	resync := d.portConfig.Resync && len(due) > 0
+	if (resync || !d.idControl().wasPolled()) && !d.identify() {
 		return
 	}
 
-	for n, param := range d.parameters {
-		// FIXME: don't assume same indices to these arrays!
-		paramSpec := d.portConfig.Parameters[n]
-		if !paramSpec.ShouldPoll() {
-			for _, controlConfig := range paramSpec.ListControls() {
-				if !controlConfig.ShouldPoll() {
-					d.control(controlConfig.Name).setValueFromDevice("")
-				}
-			}
+	for _, paramSpec := range d.portConfig.Parameters {
+		if paramSpec.ShouldPoll() {
 			continue
 		}
-		err := param.Query(d.commander, func(name string, v interface{}) {
+		for _, controlConfig := range paramSpec.ListControls() {
+			if !controlConfig.ShouldPoll() {
+				d.control(controlConfig.Name).setValueFromDevice("")
+			}
+		}
+	}
+
+	for _, item := range due {
+		if d.loopCtx.Err() != nil {
+			// shutting down
+			return
+		}
+		param := item.param
+		err := param.Query(d.ctx, d.commander, func(name string, v interface{}) {
 			d.control(name).setValueFromDevice(v)
 		})
+		d.scheduler.polled(item, now, err == nil)
 		if err != nil {
+			for _, controlConfig := range item.spec.ListControls() {
+				if controlConfig.ShouldPoll() {
+					d.control(controlConfig.Name).setReadError()
+				}
+			}
 			select {
-			case <-d.stopCh:
+			case <-d.ctx.Done():
 				// ignore errors if stopping
 			default:
 				wbgo.Error.Printf("failed to read %s from %q: %v", param.Name(), d.portConfig.Name, err)
@@ -239,6 +618,40 @@ func (d *device) poll() {
 
 		}
 	}
+
+	// only check errors if the device was actually
+	// polled so the bus isn't flooded with error queries
+	if len(due) > 0 && d.errorChecker != nil && d.loopCtx.Err() == nil {
+		d.checkErrors()
+	}
+}
+
+// checkErrors checks the device for errors, publishing the last
+// error reported by the device as the value of 'lastError' control
+func (d *device) checkErrors() {
+	lastError := d.control(lastErrorControlName)
+	switch err := d.errorChecker.CheckErrors(d.ctx, d.commander).(type) {
+	case nil:
+		// the last error is kept, but the control
+		// must be published after the first check
+		if !lastError.wasPolled() {
+			lastError.setValueIfChanged("")
+		}
+	case *DeviceError:
+		wbgo.Error.Printf("device %q reported errors: %v", d.portConfig.Name, err)
+		d.setLastError(err)
+	default:
+		select {
+		case <-d.ctx.Done():
+			// ignore errors if stopping
+		default:
+			wbgo.Error.Printf("failed to check errors for %q: %v", d.portConfig.Name, err)
+		}
+	}
+}
+
+func (d *device) setLastError(err *DeviceError) {
+	d.control(lastErrorControlName).setValueIfChanged(err.Errors[len(err.Errors)-1])
 }
 
 // send sends any dirty controls, or values for dirty controls for which metadata
@@ -246,14 +659,25 @@ func (d *device) poll() {
 // called safely from another goroutine while poll() is still running
 func (d *device) send() {
 	// TODO: keep an ordered list of controls
-	d.idControl().send(d, d.Observer)
-	for n, _ := range d.parameters {
-		// FIXME: don't assume same indices to these arrays!
-		paramSpec := d.portConfig.Parameters[n]
+	d.sendControl(d.idControl())
+	for _, paramSpec := range d.portConfig.Parameters {
 		for _, controlConfig := range paramSpec.ListControls() {
-			d.control(controlConfig.Name).send(d, d.Observer)
+			d.sendControl(d.control(controlConfig.Name))
 		}
 	}
+	d.sendControl(d.control(onlineControlName))
+	if d.errorChecker != nil {
+		d.sendControl(d.control(lastErrorControlName))
+	}
+	for _, control := range d.diagControls {
+		d.sendControl(control)
+	}
+}
+
+func (d *device) sendControl(control *deviceControl) {
+	control.send(d, d.Observer)
+	control.sendMeta(d.publishControlMeta)
+	control.sendError(d.publishControlMeta)
 }
 
 func (d *device) AcceptValue(string, string) {
@@ -274,45 +698,439 @@ func (d *device) AcceptOnValue(name, value string) bool {
 		wbgo.Error.Printf("no settable parameter for control %q in device %q", name, d.portConfig.Name)
 		return false
 	}
-	dc.startWrite(value)
-	dc.settableParam.Set(d.commander, dc.config.Name, value)
-	dc.endWrite()
+	deviceValue, err := dc.config.TransformControlValue(value)
+	if err != nil {
+		wbgo.Error.Printf("can't set %s/%s: %v", d.portConfig.Name, name, err)
+		return false
+	}
+	if err := dc.config.CheckRange(deviceValue); err != nil {
+		// out of range values are treated as failed writes,
+		// so the control reverts to the device value
+		wbgo.Error.Printf("can't set %s/%s: %v", d.portConfig.Name, name, err)
+		dc.failWrite()
+		return false
+	}
+	// enum values may be set using either names or device
+	// values, but the control always holds the name
+	if dc.queueWrite(dc.config.TransformDeviceValue(deviceValue)) {
+		d.writeMtx.Lock()
+		d.writeQueue = append(d.writeQueue, dc)
+		d.writeMtx.Unlock()
+		select {
+		case d.writeCh <- struct{}{}:
+		default:
+		}
+	}
 	return true
 }
 
+// nextWrite removes the first control from the write queue
+// and returns it, or returns nil if the queue is empty
+func (d *device) nextWrite() *deviceControl {
+	d.writeMtx.Lock()
+	defer d.writeMtx.Unlock()
+	if len(d.writeQueue) == 0 {
+		return nil
+	}
+	dc := d.writeQueue[0]
+	d.writeQueue = d.writeQueue[1:]
+	return dc
+}
+
+// writeLoop performs the queued writes until the device is stopped.
+// Rapid successive writes to the same control are coalesced
+// so only the last value is written
+func (d *device) writeLoop() {
+	for {
+		select {
+		case <-d.loopCtx.Done():
+			return
+		case <-d.writeCh:
+		}
+		// the queued writes are dropped when shutting down
+		for d.loopCtx.Err() == nil {
+			dc := d.nextWrite()
+			if dc == nil {
+				break
+			}
+			d.write(dc, dc.takeWrite())
+		}
+	}
+}
+
+// write sets the value of the control on the device. The resulting
+// value of the control is published during the next send()
+func (d *device) write(dc *deviceControl, value string) {
+	deviceValue, err := dc.config.TransformControlValue(value)
+	if err == nil {
+		err = dc.settableParam.Set(d.ctx, d.commander, dc.config.Name, deviceValue)
+	}
+	if err != nil {
+		if devErr, ok := err.(*DeviceError); ok && d.errorChecker != nil {
+			d.setLastError(devErr)
+		}
+		select {
+		case <-d.ctx.Done():
+			// ignore errors if stopping
+		default:
+			wbgo.Error.Printf("failed to set %s/%s to %q: %v", d.portConfig.Name, dc.config.Name, value, err)
+		}
+		dc.failWrite()
+		return
+	}
+	// don't read back the value when shutting down
+	if dc.endWrite() && dc.config.ShouldPoll() && d.loopCtx.Err() == nil {
+		d.readBack(dc)
+	}
+}
+
+// readBack re-reads the parameter after its value was set. The
+// value that's read is published during the next send()
+func (d *device) readBack(dc *deviceControl) {
+	err := dc.settableParam.Query(d.ctx, d.commander, func(name string, v interface{}) {
+		d.control(name).setValueFromDevice(v)
+	})
+	if err != nil {
+		wbgo.Error.Printf("failed to read back %s from %q: %v", dc.settableParam.Name(), d.portConfig.Name, err)
+	}
+}
+
 func (d *device) IsVirtual() bool {
 	return false
 }
 
-func (d *device) close() {
-	d.commander.Close()
+// start starts polling the device using the specified commander
+// after the commander becomes ready. The device is stopped when
+// either stop() is called or parentCtx is cancelled
+func (d *device) start(parentCtx context.Context, commander Commander, pollTriggerCh chan struct{}) {
+	d.commander = commander
+	d.ctx, d.cancel = context.WithCancel(parentCtx)
+	d.loopCtx, d.stopLoops = context.WithCancel(d.ctx)
+	d.wg.Add(1)
+	go func() {
+		defer d.wg.Done()
+		if !d.waitForCommander() {
+			return
+		}
+		d.wg.Add(1)
+		go func() {
+			defer d.wg.Done()
+			d.writeLoop()
+		}()
+		d.pollLoop(pollTriggerCh)
+	}()
+}
+
+// waitForCommander waits for the commander to become ready.
+// If the port isn't available after maxPollDelay, the device
+// is reported as offline, with the read error set for 'online'
+// control till the device is polled after connecting. Returns
+// false if the device is stopped before the commander is ready
+func (d *device) waitForCommander() bool {
+	select {
+	case <-d.loopCtx.Done():
+		return false
+	case <-d.commander.Ready():
+		return true
+	case <-time.After(maxPollDelay):
+	}
+	wbgo.Warn.Printf("port %q of device %q is not available yet", d.portConfig.Port, d.portConfig.Name)
+	online := d.control(onlineControlName)
+	online.setReadError()
+	for {
+		d.updateStatus()
+		select {
+		case <-d.loopCtx.Done():
+			return false
+		case <-d.commander.Ready():
+			return true
+		case <-time.After(maxPollDelay):
+		}
+	}
+}
+
+// pollDelay returns the time to wait till the next
+// poll according to the schedule
+func (d *device) pollDelay() time.Duration {
+	if !d.idControl().wasPolled() {
+		// retry the identification
+		return 0
+	}
+	next, ok := d.scheduler.next()
+	if !ok {
+		return maxPollDelay
+	}
+	switch delay := next.Sub(d.clock.Now()); {
+	case delay < 0:
+		return 0
+	case delay > maxPollDelay:
+		return maxPollDelay
+	default:
+		return delay
+	}
+}
+
+// pollLoop polls the device until it's stopped. If pollTriggerCh
+// is specified, each poll waits for a value from it, otherwise
+// the loop sleeps till the next parameter is due, but no less
+// than minPollInterval between the polls
+func (d *device) pollLoop(pollTriggerCh chan struct{}) {
+	for {
+		nextAt := time.Now().Add(minPollInterval)
+		if pollTriggerCh != nil {
+			select {
+			case <-d.loopCtx.Done():
+				return
+			case <-pollTriggerCh:
+			}
+		} else {
+			select {
+			case <-d.loopCtx.Done():
+				return
+			default:
+			}
+		}
+		d.poll()
+		if pollTriggerCh != nil {
+			continue
+		}
+		now := time.Now()
+		if at := now.Add(d.pollDelay()); at.After(nextAt) {
+			nextAt = at
+		}
+		if nextAt.After(now) {
+			select {
+			case <-d.loopCtx.Done():
+				return
+			case <-time.After(nextAt.Sub(now)):
+			}
+		}
+	}
+}
+
+// stop stops polling the device and waits for any pending
+// device queries to finish
+func (d *device) stop() {
+	if d.cancel == nil {
+		return
+	}
+	d.cancel()
+	d.wg.Wait()
+}
+
+// shutdown stops polling the device and waits for the pending
+// device queries to finish until the deadline. The queries
+// that are still running at the deadline are aborted.
+// After that, the device is marked as offline
+func (d *device) shutdown(deadline time.Time) {
+	if d.cancel == nil {
+		return
+	}
+	d.stopLoops()
+	doneCh := make(chan struct{})
+	go func() {
+		d.wg.Wait()
+		close(doneCh)
+	}()
+	select {
+	case <-doneCh:
+	case <-time.After(time.Until(deadline)):
+		wbgo.Warn.Printf("aborting pending queries for device %q", d.DevName)
+		d.cancel()
+		<-doneCh
+	}
+	d.cancel()
+	d.control(onlineControlName).setValueIfChanged("0")
+}
+
+// unpublish removes the retained MQTT messages for the specified
+// controls of the device
+func (d *device) unpublish(controlNames []string) {
+	if d.client == nil {
+		return
+	}
+	for _, name := range controlNames {
+		for _, metaName := range controlMetaNames {
+			d.publishControlMeta(name, metaName, "")
+		}
+		d.client.Publish(wbgo.MQTTMessage{
+			Topic:    fmt.Sprintf("/devices/%s/controls/%s", d.DevName, name),
+			QoS:      1,
+			Retained: true,
+		})
+	}
+}
+
+// unpublishDevice removes all of the retained MQTT messages
+// for the device
+func (d *device) unpublishDevice() {
+	if d.client == nil {
+		return
+	}
+	d.unpublish(d.controlNames())
+	d.client.Publish(wbgo.MQTTMessage{
+		Topic:    fmt.Sprintf("/devices/%s/meta/name", d.DevName),
+		QoS:      1,
+		Retained: true,
+	})
+}
+
+func (d *device) controlNames() []string {
+	var r []string
+	for name := range d.controls {
+		r = append(r, name)
+	}
+	sort.Strings(r)
+	return r
+}
+
+// portCommander is a commander that's shared by the
+// devices that use the same port
+type portCommander struct {
+	Commander
+	settings PortSettings
+	refs     int
 }
 
 type Model struct {
 	wbgo.ModelBase
+	clock         Clock
+	client        wbgo.MQTTClient
 	cmdFactory    CommanderFactory
 	config        *DriverConfig
 	devs          []*device
+	commanders    map[string]*portCommander
 	readyCh       chan struct{}
-	stopCh        chan struct{}
-	stoppedCh     chan struct{}
+	ctx           context.Context
+	cancel        context.CancelFunc
 	pollTriggerCh chan struct{}
 }
 
 func NewModel(commanderFactory CommanderFactory, config *DriverConfig) *Model {
+	ctx, cancel := context.WithCancel(context.Background())
 	return &Model{
+		ctx:        ctx,
+		cancel:     cancel,
+		clock:      defaultClock,
 		cmdFactory: commanderFactory,
 		config:     config,
 		readyCh:    make(chan struct{}),
-		stopCh:     make(chan struct{}),
-		stoppedCh:  make(chan struct{}),
 	}
 }
 
+func (m *Model) SetClock(clock Clock) {
+	m.clock = clock
+}
+
+// SetMQTTClient sets the MQTT client that's used to publish
+// control metadata not handled by wbgo.Driver, such as meta/error.
+// This should be the same client that's used by the driver
+func (m *Model) SetMQTTClient(client wbgo.MQTTClient) {
+	m.client = client
+}
+
 func (m *Model) SetPollTriggerCh(pollTriggerCh chan struct{}) {
 	m.pollTriggerCh = pollTriggerCh
 }
 
+// checkSharedPorts makes sure that the devices sharing the same
+// port don't have conflicting line or safe state settings
+func checkSharedPorts(config *DriverConfig) error {
+	portSettings := make(map[string]*PortSettings)
+	for _, portConfig := range config.Ports {
+		prev, found := portSettings[portConfig.Port]
+		if !found {
+			portSettings[portConfig.Port] = portConfig.PortSettings
+			continue
+		}
+		// the commander which is shared by the devices uses
+		// the settings of the first one, so the others must
+		// not differ. The identification is done by each
+		// device separately, though
+		prevTiming, timing := prev.TimingSettings.Normalize(), portConfig.TimingSettings.Normalize()
+		prevTiming.IdentifyAttempts, timing.IdentifyAttempts = 0, 0
+		var conflict string
+		switch {
+		case prev.LineSettings.Normalize() != portConfig.LineSettings.Normalize():
+			conflict = "line settings"
+		case prevTiming != timing:
+			conflict = "timing settings"
+		case prev.LineTerminator() != portConfig.LineTerminator():
+			conflict = "line endings"
+		case prev.CommandDelayMs != portConfig.CommandDelayMs:
+			conflict = "command delays"
+		case !reflect.DeepEqual(prev.Setup, portConfig.Setup):
+			conflict = "setup commands"
+		case !reflect.DeepEqual(prev.SafeState, portConfig.SafeState) || prev.SafeStateOnReconnect != portConfig.SafeStateOnReconnect:
+			conflict = "safe state settings"
+		default:
+			continue
+		}
+		return fmt.Errorf("devices %q and %q share port %q but have conflicting %s", prev.Name, portConfig.Name, portConfig.Port, conflict)
+	}
+	return nil
+}
+
+// commanderSettings returns the port settings that are used by
+// the commander, i.e. without the device specific ones
+func commanderSettings(settings *PortSettings) PortSettings {
+	r := *settings
+	r.Name = ""
+	r.Title = ""
+	r.IdSubstring = ""
+	r.Protocol = ""
+	r.Resync = false
+	r.Prefix = ""
+	r.Address = 0
+	r.AddressFormat = ""
+	r.Framing = ""
+	r.CheckErrors = false
+	r.Checksum = false
+	r.Diagnostics = false
+	r.Channels = nil
+	r.ChannelSelect = ""
+	return r
+}
+
+// acquireCommander returns the commander for the port,
+// creating it if necessary
+func (m *Model) acquireCommander(settings *PortSettings) Commander {
+	pc, found := m.commanders[settings.Port]
+	if !found {
+		pc = &portCommander{
+			Commander: m.cmdFactory(settings),
+			settings:  commanderSettings(settings),
+		}
+		m.commanders[settings.Port] = pc
+		pc.Connect()
+	}
+	pc.refs++
+	return pc.Commander
+}
+
+// releaseCommander closes the commander for the port
+// if it's not used by any device anymore
+func (m *Model) releaseCommander(port string) {
+	pc := m.commanders[port]
+	pc.refs--
+	if pc.refs == 0 {
+		pc.Close()
+		delete(m.commanders, port)
+	}
+}
+
+// startDevice registers the device and starts polling it
+func (m *Model) startDevice(d *device) {
+	m.Observer.OnNewDevice(d)
+	d.start(m.ctx, m.acquireCommander(d.portConfig.PortSettings), m.pollTriggerCh)
+}
+
+// stopDevice stops polling the device and releases its commander
+func (m *Model) stopDevice(d *device) {
+	d.stop()
+	m.releaseCommander(d.portConfig.Port)
+}
+
 func (m *Model) Start() error {
 	if m.devs != nil {
 		return nil
@@ -320,82 +1138,182 @@ func (m *Model) Start() error {
 	if len(m.config.Ports) == 0 {
 		return errNoPortsDefined
 	}
-	m.devs = []*device{}
-	commanders := make(map[string]Commander)
+	if err := checkSharedPorts(m.config); err != nil {
+		return err
+	}
+	var devs []*device
 	for _, portConfig := range m.config.Ports {
-		commander, found := commanders[portConfig.Port]
-		if !found {
-			commander = m.cmdFactory(portConfig.PortSettings)
-			commanders[portConfig.Port] = commander
-		}
-		dev, err := newDevice(commander, portConfig, m.stopCh)
+		dev, err := newDevice(portConfig, m.clock, m.client)
 		if err != nil {
 			return fmt.Errorf("failed to set up device %q: %v", portConfig.Name, err)
 		}
-		m.devs = append(m.devs, dev)
-		m.Observer.OnNewDevice(dev)
+		devs = append(devs, dev)
 	}
-	if len(m.devs) == 0 {
+	if len(devs) == 0 {
 		return errNoPortsOpen
 	}
+	m.commanders = make(map[string]*portCommander)
+	m.devs = devs
+	for _, dev := range devs {
+		m.startDevice(dev)
+	}
 	go func() {
-		for _, d := range m.devs {
-			d.commander.Connect()
-		}
-		for _, d := range m.devs {
+		for _, d := range devs {
 			<-d.commander.Ready()
 		}
 		close(m.readyCh)
-		var wg sync.WaitGroup
-		for _, dev := range m.devs {
-			d := dev
-			wg.Add(1)
-			go func() {
-				defer wg.Done()
-			pollLoop:
-				for {
-					nextAt := time.Now().Add(minPollInterval)
-					if m.pollTriggerCh != nil {
-						select {
-						case <-m.stopCh:
-							break pollLoop
-						case <-m.pollTriggerCh:
-						}
-					} else {
-						select {
-						case <-m.stopCh:
-							break pollLoop
-						default:
-						}
-					}
-					d.poll()
-					now := time.Now()
-					if nextAt.After(now) {
-						select {
-						case <-m.stopCh:
-							break pollLoop
-						case <-time.After(nextAt.Sub(now)):
-						}
-					}
-				}
-			}()
-		}
-		wg.Wait()
-		close(m.stoppedCh)
 	}()
 	return nil
 }
 
+// Reload applies the new config to the running model. Only the
+// devices with changed configs are recreated, and new commanders
+// are only created for the ports with changed settings. The devices
+// that are removed from the config are also removed from MQTT.
+// Reload must be called from the driver goroutine
+func (m *Model) Reload(config *DriverConfig) error {
+	if m.devs == nil {
+		m.config = config
+		return nil
+	}
+	if len(config.Ports) == 0 {
+		return errNoPortsDefined
+	}
+	if err := checkSharedPorts(config); err != nil {
+		return err
+	}
+
+	newSettings := make(map[string]PortSettings)
+	for _, portConfig := range config.Ports {
+		if _, found := newSettings[portConfig.Port]; !found {
+			newSettings[portConfig.Port] = commanderSettings(portConfig.PortSettings)
+		}
+	}
+	replacedPorts := make(map[string]bool)
+	for port, pc := range m.commanders {
+		if settings, found := newSettings[port]; !found || !reflect.DeepEqual(settings, pc.settings) {
+			replacedPorts[port] = true
+		}
+	}
+
+	oldDevs := make(map[string]*device)
+	for _, d := range m.devs {
+		oldDevs[d.DevName] = d
+	}
+	var devs []*device
+	kept := make(map[*device]bool)
+	added := make(map[string]*device)
+	for _, portConfig := range config.Ports {
+		// GetControls() normalizes the control configs, so it
+		// must be called before comparing the port configs
+		if _, _, err := portConfig.GetControls(); err != nil {
+			return fmt.Errorf("failed to set up device %q: %v", portConfig.Name, err)
+		}
+		d, found := oldDevs[portConfig.Name]
+		if found && !replacedPorts[portConfig.Port] && reflect.DeepEqual(d.portConfig, portConfig) {
+			kept[d] = true
+			devs = append(devs, d)
+			continue
+		}
+		d, err := newDevice(portConfig, m.clock, m.client)
+		if err != nil {
+			return fmt.Errorf("failed to set up device %q: %v", portConfig.Name, err)
+		}
+		added[d.DevName] = d
+		devs = append(devs, d)
+	}
+
+	var stopped []*device
+	for _, d := range m.devs {
+		if kept[d] {
+			continue
+		}
+		wbgo.Debug.Printf("stopping device %q", d.DevName)
+		d.stop()
+		stopped = append(stopped, d)
+		newDev, found := added[d.DevName]
+		if !found {
+			m.Observer.RemoveDevice(d)
+			d.unpublishDevice()
+			continue
+		}
+		var removedControls []string
+		for _, name := range d.controlNames() {
+			if _, found := newDev.controls[name]; !found {
+				removedControls = append(removedControls, name)
+			}
+		}
+		d.unpublish(removedControls)
+	}
+	for port := range replacedPorts {
+		m.commanders[port].Close()
+		delete(m.commanders, port)
+	}
+	for _, d := range devs {
+		if !kept[d] {
+			wbgo.Debug.Printf("starting device %q", d.DevName)
+			m.startDevice(d)
+		}
+	}
+	// the commanders are released after the new devices are
+	// started so that they're not recreated needlessly
+	for _, d := range stopped {
+		if !replacedPorts[d.portConfig.Port] {
+			m.releaseCommander(d.portConfig.Port)
+		}
+	}
+	m.devs = devs
+	m.config = config
+	return nil
+}
+
+// Shutdown gracefully stops the model. It stops polling the
+// devices and gives the commands that are already being executed
+// the specified amount of time to finish. After that, the devices
+// are marked as offline in MQTT and the safe state commands are
+// sent to the ports that have them, which may take up to the same
+// amount of time. Shutdown must be called from the driver
+// goroutine, and it should be followed by Stop()
+func (m *Model) Shutdown(timeout time.Duration) {
+	if m.devs == nil {
+		return
+	}
+	deadline := time.Now().Add(timeout)
+	// stop all of the poll loops first so that the
+	// devices wind down in parallel
+	for _, d := range m.devs {
+		d.stopLoops()
+	}
+	for _, d := range m.devs {
+		d.shutdown(deadline)
+		d.send()
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	var wg sync.WaitGroup
+	for port, pc := range m.commanders {
+		wg.Add(1)
+		go func(port string, commander Commander) {
+			defer wg.Done()
+			if err := commander.SafeState(ctx); err != nil {
+				wbgo.Error.Printf("failed to put the devices on port %q into the safe state: %v", port, err)
+			}
+		}(port, pc.Commander)
+	}
+	wg.Wait()
+}
+
 func (m *Model) Stop() {
 	if m.devs == nil {
 		return
 	}
-	close(m.stopCh)
-	// this should interrupt the poll loop
+	// this aborts any pending device queries
+	// and stops the poll loops
+	m.cancel()
 	for _, d := range m.devs {
-		d.close()
+		m.stopDevice(d)
 	}
-	<-m.stoppedCh
 	m.devs = nil
 }
 
@@ -1,6 +1,12 @@
 package main
 
 import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
 	"time"
 
 	"github.com/contactless/wbgo"
@@ -44,10 +50,10 @@ func sampleConfig() *DriverConfig {
 							Name:  "mode",
 							Title: "Mode",
 							Type:  "text",
-							Enum: map[int]string{
-								0: "Foo",
-								1: "Bar",
-								2: "Baz",
+							Enum: map[string]string{
+								"0": "Foo",
+								"1": "Bar",
+								"2": "Baz",
 							},
 						},
 						ScpiName: "MODE",
@@ -74,6 +80,9 @@ type ModelSuite struct {
 	model         *Model
 	tester        *cmdTester
 	pollTriggerCh chan struct{}
+	// manualSend disables periodic sending of the
+	// control values by the driver
+	manualSend bool
 }
 
 func (s *ModelSuite) T() *testing.T {
@@ -82,22 +91,35 @@ func (s *ModelSuite) T() *testing.T {
 
 func (s *ModelSuite) SetupTest() {
 	s.Suite.SetupTest()
+	s.manualSend = false
 	s.FakeMQTTFixture = testutils.NewFakeMQTTFixture(s.T())
 }
 
 func (s *ModelSuite) Start(config *DriverConfig) {
+	s.startDriver(config, nil)
+	<-s.model.Ready()
+}
+
+// startDriver starts the driver without waiting for the model
+// to become ready. connectError, if specified, is returned
+// when connecting to the port
+func (s *ModelSuite) startDriver(config *DriverConfig, connectError error) {
 	s.tester = newCmdTester(s.T(), config.Ports[0].Port)
+	s.tester.connectError = connectError
 	s.model = NewModel(DefaultCommanderFactory(s.tester.connect), config)
+	s.model.SetClock(s.tester)
 	s.pollTriggerCh = make(chan struct{})
 	s.model.SetPollTriggerCh(s.pollTriggerCh)
 	s.client = s.Broker.MakeClient("tst")
 	s.client.Start()
-	s.driver = wbgo.NewDriver(s.model, s.Broker.MakeClient("driver"))
+	driverClient := s.Broker.MakeClient("driver")
+	s.model.SetMQTTClient(driverClient)
+	s.driver = wbgo.NewDriver(s.model, driverClient)
 	s.driver.SetPollInterval(50 * time.Millisecond)
+	s.driver.SetAutoPoll(!s.manualSend)
 	if err := s.driver.Start(); err != nil {
 		s.T().Fatalf("failed to start the driver: %v", err)
 	}
-	<-s.model.Ready()
 	s.Verify(
 		"driver -> /devices/sample/meta/name: [Sample Dev] (QoS 1, retained)",
 	)
@@ -114,17 +136,22 @@ func (s *ModelSuite) TearDownTest() {
 		)
 	}
 	s.Suite.TearDownTest()
+	resetTestLogging()
 }
 
-func (s *ModelSuite) verifyPoll() {
-	s.pollTriggerCh <- struct{}{}
-
-	s.tester.simpleChat("*IDN?", "some_dev_id")
-	s.tester.simpleChat("MEAS:VOLT?", "12.0")
-	s.tester.simpleChat("CURR?", "3.5")
-	s.tester.simpleChat("MODE?", "1")
+// resetTestLogging restores the default wbgo loggers so that the
+// tests running after the suite don't log into a finished test
+func resetTestLogging() {
+	wbgo.Error = log.New(os.Stderr, "ERROR: ", log.LstdFlags)
+	wbgo.Warn = log.New(os.Stderr, "WARNING: ", log.LstdFlags)
+	wbgo.Info = log.New(os.Stderr, "INFO: ", log.LstdFlags)
+	wbgo.SetDebugLogger(log.New(ioutil.Discard, "", 0), false)
+}
 
-	s.Verify(
+// firstPollMessages returns the messages that are expected
+// to be published after the first poll of the sample device
+func firstPollMessages(extra ...interface{}) []interface{} {
+	return append([]interface{}{
 		"driver -> /devices/sample/controls/id/meta/type: [text] (QoS 1, retained)",
 		"driver -> /devices/sample/controls/id/meta/readonly: [1] (QoS 1, retained)",
 		"driver -> /devices/sample/controls/id/meta/order: [1] (QoS 1, retained)",
@@ -151,7 +178,23 @@ func (s *ModelSuite) verifyPoll() {
 		"driver -> /devices/sample/controls/doit/meta/name: [Do it] (QoS 1, retained)",
 		"driver -> /devices/sample/controls/doit/meta/order: [5] (QoS 1, retained)",
 		"Subscribe -- driver: /devices/sample/controls/doit/on",
-	)
+		"driver -> /devices/sample/controls/online/meta/type: [switch] (QoS 1, retained)",
+		"driver -> /devices/sample/controls/online/meta/name: [Online] (QoS 1, retained)",
+		"driver -> /devices/sample/controls/online/meta/readonly: [1] (QoS 1, retained)",
+		"driver -> /devices/sample/controls/online/meta/order: [6] (QoS 1, retained)",
+		"driver -> /devices/sample/controls/online: [1] (QoS 1, retained)",
+	}, extra...)
+}
+
+func (s *ModelSuite) verifyPoll(extra ...interface{}) {
+	s.pollTriggerCh <- struct{}{}
+
+	s.tester.simpleChat("*IDN?", "some_dev_id")
+	s.tester.simpleChat("MEAS:VOLT?", "12.0")
+	s.tester.simpleChat("CURR?", "3.5")
+	s.tester.simpleChat("MODE?", "1")
+
+	s.Verify(firstPollMessages(extra...)...)
 }
 
 func (s *ModelSuite) TestPoll() {
@@ -194,17 +237,228 @@ func (s *ModelSuite) TestPollWithResync() {
 	}
 }
 
+func (s *ModelSuite) TestPollIntervals() {
+	config := sampleConfig()
+	config.Ports[0].Parameters[0].Polling().Priority = 1
+	config.Ports[0].Parameters[1].Polling().PollInterval = 10 * time.Second
+	config.Ports[0].Parameters[2].Polling().ReadOnce = true
+	s.Start(config)
+	s.verifyPoll()
+
+	s.pollTriggerCh <- struct{}{}
+	// 'current' is not due yet, 'mode' is only read once
+	s.tester.simpleChat("MEAS:VOLT?", "12.0")
+	s.Verify(
+		"driver -> /devices/sample/controls/voltage: [12.0] (QoS 1, retained)",
+	)
+
+	s.tester.elapse(10 * time.Second)
+	s.pollTriggerCh <- struct{}{}
+	s.tester.simpleChat("MEAS:VOLT?", "12.1")
+	s.tester.simpleChat("CURR?", "3.4")
+	s.Verify(
+		"driver -> /devices/sample/controls/voltage: [12.1] (QoS 1, retained)",
+		"driver -> /devices/sample/controls/current: [3.4] (QoS 1, retained)",
+	)
+}
+
+func (s *ModelSuite) TestPollIntervalsWithResync() {
+	config := sampleConfig()
+	config.Ports[0].Resync = true
+	for _, paramSpec := range config.Ports[0].Parameters {
+		paramSpec.Polling().PollInterval = 10 * time.Second
+	}
+	s.Start(config)
+	s.verifyPoll()
+
+	// no parameters are due, so the device isn't
+	// identified again. The second trigger makes
+	// sure the first poll is finished
+	s.pollTriggerCh <- struct{}{}
+	s.pollTriggerCh <- struct{}{}
+	s.tester.elapse(10 * time.Second)
+	s.pollTriggerCh <- struct{}{}
+	s.tester.simpleChat("*IDN?", "some_dev_id")
+	s.tester.simpleChat("MEAS:VOLT?", "12.1")
+	s.tester.simpleChat("CURR?", "3.4")
+	s.tester.simpleChat("MODE?", "1")
+	s.Verify(
+		"driver -> /devices/sample/controls/voltage: [12.1] (QoS 1, retained)",
+		"driver -> /devices/sample/controls/current: [3.4] (QoS 1, retained)",
+		"driver -> /devices/sample/controls/mode: [Bar] (QoS 1, retained)",
+	)
+}
+
+func (s *ModelSuite) TestPollPriority() {
+	config := sampleConfig()
+	config.Ports[0].Parameters[2].Polling().Priority = 2
+	config.Ports[0].Parameters[1].Polling().Priority = 1
+	s.manualSend = true
+	s.Start(config)
+	s.pollTriggerCh <- struct{}{}
+	s.tester.simpleChat("*IDN?", "some_dev_id")
+	s.tester.simpleChat("MODE?", "1")
+	s.tester.simpleChat("CURR?", "3.5")
+	s.tester.simpleChat("MEAS:VOLT?", "12.0")
+	// make sure the first poll cycle is finished
+	s.pollTriggerCh <- struct{}{}
+	s.driver.Poll()
+	s.Verify(firstPollMessages()...)
+
+	s.tester.simpleChat("MODE?", "2")
+	s.tester.simpleChat("CURR?", "3.6")
+	s.tester.simpleChat("MEAS:VOLT?", "12.1")
+	s.pollTriggerCh <- struct{}{}
+	s.driver.Poll()
+	s.Verify(
+		"driver -> /devices/sample/controls/voltage: [12.1] (QoS 1, retained)",
+		"driver -> /devices/sample/controls/current: [3.6] (QoS 1, retained)",
+		"driver -> /devices/sample/controls/mode: [Baz] (QoS 1, retained)",
+	)
+	// finish the next poll cycle which is already started
+	// so it doesn't access the connection after it's closed
+	s.tester.simpleChat("MODE?", "2")
+	s.tester.simpleChat("CURR?", "3.6")
+	s.tester.simpleChat("MEAS:VOLT?", "12.1")
+}
+
+func (s *ModelSuite) TestReadError() {
+	s.Start(sampleConfig())
+	s.verifyPoll()
+
+	// the device doesn't respond anymore
+	s.tester.fc.setReadTime(s.tester.time.Add(time.Hour))
+	s.pollTriggerCh <- struct{}{}
+	s.tester.expectCommand("MEAS:VOLT?")
+	s.tester.expectCommand("CURR?")
+	s.tester.expectCommand("MODE?")
+	s.Verify(
+		"driver -> /devices/sample/controls/voltage/meta/error: [r] (QoS 1, retained)",
+		"driver -> /devices/sample/controls/current/meta/error: [r] (QoS 1, retained)",
+		"driver -> /devices/sample/controls/mode/meta/error: [r] (QoS 1, retained)",
+	)
+	s.EnsureGotErrors()
+
+	// the device is back, errors are cleared
+	s.tester.fc.setReadTime(s.tester.time)
+	s.pollTriggerCh <- struct{}{}
+	s.tester.simpleChat("MEAS:VOLT?", "12.0")
+	s.tester.simpleChat("CURR?", "3.5")
+	s.tester.simpleChat("MODE?", "0")
+	s.Verify(
+		"driver -> /devices/sample/controls/voltage: [12.0] (QoS 1, retained)",
+		"driver -> /devices/sample/controls/voltage/meta/error: [] (QoS 1, retained)",
+		"driver -> /devices/sample/controls/current: [3.5] (QoS 1, retained)",
+		"driver -> /devices/sample/controls/current/meta/error: [] (QoS 1, retained)",
+		"driver -> /devices/sample/controls/mode: [Foo] (QoS 1, retained)",
+		"driver -> /devices/sample/controls/mode/meta/error: [] (QoS 1, retained)",
+	)
+}
+
+func (s *ModelSuite) TestOffline() {
+	s.Start(sampleConfig())
+	s.verifyPoll()
+
+	s.tester.fc.setPendingError(errors.New("oops"))
+	s.pollTriggerCh <- struct{}{}
+	s.Verify(
+		"driver -> /devices/sample/controls/voltage/meta/error: [r] (QoS 1, retained)",
+		"driver -> /devices/sample/controls/current/meta/error: [r] (QoS 1, retained)",
+		"driver -> /devices/sample/controls/mode/meta/error: [r] (QoS 1, retained)",
+		"driver -> /devices/sample/controls/online: [0] (QoS 1, retained)",
+	)
+	s.EnsureGotErrors()
+}
+
+func (s *ModelSuite) TestPortUnavailable() {
+	s.startDriver(sampleConfig(), errors.New("connection refused"))
+	s.Verify(
+		"driver -> /devices/sample/controls/online/meta/type: [switch] (QoS 1, retained)",
+		"driver -> /devices/sample/controls/online/meta/name: [Online] (QoS 1, retained)",
+		"driver -> /devices/sample/controls/online/meta/readonly: [1] (QoS 1, retained)",
+		"driver -> /devices/sample/controls/online/meta/order: [1] (QoS 1, retained)",
+		"driver -> /devices/sample/controls/online: [0] (QoS 1, retained)",
+		"driver -> /devices/sample/controls/online/meta/error: [r] (QoS 1, retained)",
+	)
+	s.EnsureGotWarnings()
+
+	// the port becomes available
+	s.tester.Lock()
+	s.tester.connectError = nil
+	s.tester.Unlock()
+	s.tester.elapse(time.Minute)
+	<-s.model.Ready()
+	s.pollTriggerCh <- struct{}{}
+	s.tester.simpleChat("*IDN?", "some_dev_id")
+	s.tester.simpleChat("MEAS:VOLT?", "12.0")
+	s.tester.simpleChat("CURR?", "3.5")
+	s.tester.simpleChat("MODE?", "1")
+	s.Verify(
+		"driver -> /devices/sample/controls/id/meta/type: [text] (QoS 1, retained)",
+		"driver -> /devices/sample/controls/id/meta/readonly: [1] (QoS 1, retained)",
+		"driver -> /devices/sample/controls/id/meta/order: [2] (QoS 1, retained)",
+		"driver -> /devices/sample/controls/id: [some_dev_id] (QoS 1, retained)",
+		"driver -> /devices/sample/controls/voltage/meta/type: [voltage] (QoS 1, retained)",
+		"driver -> /devices/sample/controls/voltage/meta/name: [Measured voltage] (QoS 1, retained)",
+		"driver -> /devices/sample/controls/voltage/meta/units: [V] (QoS 1, retained)",
+		"driver -> /devices/sample/controls/voltage/meta/readonly: [1] (QoS 1, retained)",
+		"driver -> /devices/sample/controls/voltage/meta/order: [3] (QoS 1, retained)",
+		"driver -> /devices/sample/controls/voltage: [12.0] (QoS 1, retained)",
+		"driver -> /devices/sample/controls/current/meta/type: [current] (QoS 1, retained)",
+		"driver -> /devices/sample/controls/current/meta/name: [Current] (QoS 1, retained)",
+		"driver -> /devices/sample/controls/current/meta/units: [A] (QoS 1, retained)",
+		"driver -> /devices/sample/controls/current/meta/writable: [1] (QoS 1, retained)",
+		"driver -> /devices/sample/controls/current/meta/order: [4] (QoS 1, retained)",
+		"driver -> /devices/sample/controls/current: [3.5] (QoS 1, retained)",
+		"Subscribe -- driver: /devices/sample/controls/current/on",
+		"driver -> /devices/sample/controls/mode/meta/type: [text] (QoS 1, retained)",
+		"driver -> /devices/sample/controls/mode/meta/name: [Mode] (QoS 1, retained)",
+		"driver -> /devices/sample/controls/mode/meta/readonly: [1] (QoS 1, retained)",
+		"driver -> /devices/sample/controls/mode/meta/order: [5] (QoS 1, retained)",
+		"driver -> /devices/sample/controls/mode: [Bar] (QoS 1, retained)",
+		"driver -> /devices/sample/controls/doit/meta/type: [pushbutton] (QoS 1, retained)",
+		"driver -> /devices/sample/controls/doit/meta/name: [Do it] (QoS 1, retained)",
+		"driver -> /devices/sample/controls/doit/meta/order: [6] (QoS 1, retained)",
+		"Subscribe -- driver: /devices/sample/controls/doit/on",
+		"driver -> /devices/sample/controls/online: [1] (QoS 1, retained)",
+		"driver -> /devices/sample/controls/online/meta/error: [] (QoS 1, retained)",
+	)
+}
+
+func (s *ModelSuite) TestDiagnostics() {
+	config := sampleConfig()
+	config.Ports[0].Diagnostics = true
+	s.Start(config)
+	s.verifyPoll(
+		"driver -> /devices/sample/controls/reconnectAttempts/meta/type: [value] (QoS 1, retained)",
+		"driver -> /devices/sample/controls/reconnectAttempts/meta/name: [Reconnect attempts] (QoS 1, retained)",
+		"driver -> /devices/sample/controls/reconnectAttempts/meta/readonly: [1] (QoS 1, retained)",
+		"driver -> /devices/sample/controls/reconnectAttempts/meta/order: [7] (QoS 1, retained)",
+		"driver -> /devices/sample/controls/reconnectAttempts: [0] (QoS 1, retained)",
+		"driver -> /devices/sample/controls/reconnectBackoff/meta/type: [value] (QoS 1, retained)",
+		"driver -> /devices/sample/controls/reconnectBackoff/meta/name: [Reconnect backoff] (QoS 1, retained)",
+		"driver -> /devices/sample/controls/reconnectBackoff/meta/units: [s] (QoS 1, retained)",
+		"driver -> /devices/sample/controls/reconnectBackoff/meta/readonly: [1] (QoS 1, retained)",
+		"driver -> /devices/sample/controls/reconnectBackoff/meta/order: [8] (QoS 1, retained)",
+		"driver -> /devices/sample/controls/reconnectBackoff: [0] (QoS 1, retained)",
+	)
+}
+
 func (s *ModelSuite) TestSet() {
 	s.Start(sampleConfig())
 	s.verifyPoll()
-	s.client.Publish(wbgo.MQTTMessage{"/devices/sample/controls/current/on", "3.6", 1, false})
+	s.client.Publish(wbgo.MQTTMessage{Topic: "/devices/sample/controls/current/on", Payload: "3.6", QoS: 1})
 	s.tester.simpleChat("CURR 3.6; *OPC?", "1")
+	// the value is read back after it's set
+	s.tester.simpleChat("CURR?", "3.6")
 
 	s.Verify(
 		"tst -> /devices/sample/controls/current/on: [3.6] (QoS 1)",
 		"driver -> /devices/sample/controls/current: [3.6] (QoS 1, retained)",
+		"driver -> /devices/sample/controls/current: [3.6] (QoS 1, retained)",
 	)
-	s.client.Publish(wbgo.MQTTMessage{"/devices/sample/controls/doit/on", "1", 1, false})
+	s.client.Publish(wbgo.MQTTMessage{Topic: "/devices/sample/controls/doit/on", Payload: "1", QoS: 1})
+	// buttons aren't read back
 	s.tester.simpleChat("DOIT; *OPC?", "1")
 
 	s.Verify(
@@ -214,6 +468,249 @@ func (s *ModelSuite) TestSet() {
 	)
 }
 
+func (s *ModelSuite) TestSetError() {
+	s.Start(sampleConfig())
+	s.verifyPoll()
+	s.client.Publish(wbgo.MQTTMessage{Topic: "/devices/sample/controls/current/on", Payload: "3.6", QoS: 1})
+	s.tester.simpleChat("CURR 3.6; *OPC?", "0")
+
+	// the control is reverted to the value that was read from the device
+	s.Verify(
+		"tst -> /devices/sample/controls/current/on: [3.6] (QoS 1)",
+		"driver -> /devices/sample/controls/current: [3.6] (QoS 1, retained)",
+		"driver -> /devices/sample/controls/current: [3.5] (QoS 1, retained)",
+		"driver -> /devices/sample/controls/current/meta/error: [w] (QoS 1, retained)",
+	)
+	s.EnsureGotErrors()
+
+	s.client.Publish(wbgo.MQTTMessage{Topic: "/devices/sample/controls/current/on", Payload: "3.7", QoS: 1})
+	s.tester.simpleChat("CURR 3.7; *OPC?", "1")
+	s.tester.simpleChat("CURR?", "3.7")
+	s.Verify(
+		"tst -> /devices/sample/controls/current/on: [3.7] (QoS 1)",
+		"driver -> /devices/sample/controls/current: [3.7] (QoS 1, retained)",
+		"driver -> /devices/sample/controls/current: [3.7] (QoS 1, retained)",
+		"driver -> /devices/sample/controls/current/meta/error: [] (QoS 1, retained)",
+	)
+}
+
+func (s *ModelSuite) TestCheckErrors() {
+	config := sampleConfig()
+	config.Ports[0].CheckErrors = true
+	s.Start(config)
+	s.pollTriggerCh <- struct{}{}
+	s.tester.simpleChat("*IDN?", "some_dev_id")
+	s.tester.simpleChat("MEAS:VOLT?", "12.0")
+	s.tester.simpleChat("CURR?", "3.5")
+	s.tester.simpleChat("MODE?", "1")
+	s.tester.simpleChat("SYST:ERR?", `0,"No error"`)
+	s.Verify(firstPollMessages(
+		"driver -> /devices/sample/controls/lastError/meta/type: [text] (QoS 1, retained)",
+		"driver -> /devices/sample/controls/lastError/meta/name: [Last error] (QoS 1, retained)",
+		"driver -> /devices/sample/controls/lastError/meta/readonly: [1] (QoS 1, retained)",
+		"driver -> /devices/sample/controls/lastError/meta/order: [7] (QoS 1, retained)",
+		"driver -> /devices/sample/controls/lastError: [] (QoS 1, retained)",
+	)...)
+
+	// the device accepts the value but reports an error
+	s.client.Publish(wbgo.MQTTMessage{Topic: "/devices/sample/controls/current/on", Payload: "100", QoS: 1})
+	s.tester.simpleChat("CURR 100; *OPC?", "1")
+	s.tester.simpleChat("SYST:ERR?", `-222,"Data out of range"`)
+	s.tester.simpleChat("SYST:ERR?", `0,"No error"`)
+	s.Verify(
+		"tst -> /devices/sample/controls/current/on: [100] (QoS 1)",
+		"driver -> /devices/sample/controls/current: [100] (QoS 1, retained)",
+		"driver -> /devices/sample/controls/current: [3.5] (QoS 1, retained)",
+		"driver -> /devices/sample/controls/current/meta/error: [w] (QoS 1, retained)",
+		`driver -> /devices/sample/controls/lastError: [-222,"Data out of range"] (QoS 1, retained)`,
+	)
+	s.EnsureGotErrors()
+
+	// the errors are also checked on each poll cycle
+	s.pollTriggerCh <- struct{}{}
+	s.tester.simpleChat("MEAS:VOLT?", "12.0")
+	s.tester.simpleChat("CURR?", "3.5")
+	s.tester.simpleChat("MODE?", "1")
+	s.tester.simpleChat("SYST:ERR?", `-113,"Undefined header"`)
+	s.tester.simpleChat("SYST:ERR?", `0,"No error"`)
+	s.Verify(
+		"driver -> /devices/sample/controls/voltage: [12.0] (QoS 1, retained)",
+		"driver -> /devices/sample/controls/current: [3.5] (QoS 1, retained)",
+		"driver -> /devices/sample/controls/mode: [Bar] (QoS 1, retained)",
+		`driver -> /devices/sample/controls/lastError: [-113,"Undefined header"] (QoS 1, retained)`,
+	)
+	s.EnsureGotErrors()
+}
+
+func (s *ModelSuite) TestCheckErrorsWithPollIntervals() {
+	config := sampleConfig()
+	config.Ports[0].CheckErrors = true
+	for _, paramSpec := range config.Ports[0].Parameters {
+		paramSpec.Polling().PollInterval = 10 * time.Second
+	}
+	s.Start(config)
+	s.pollTriggerCh <- struct{}{}
+	s.tester.simpleChat("*IDN?", "some_dev_id")
+	s.tester.simpleChat("MEAS:VOLT?", "12.0")
+	s.tester.simpleChat("CURR?", "3.5")
+	s.tester.simpleChat("MODE?", "1")
+	s.tester.simpleChat("SYST:ERR?", `0,"No error"`)
+	s.Verify(firstPollMessages(
+		"driver -> /devices/sample/controls/lastError/meta/type: [text] (QoS 1, retained)",
+		"driver -> /devices/sample/controls/lastError/meta/name: [Last error] (QoS 1, retained)",
+		"driver -> /devices/sample/controls/lastError/meta/readonly: [1] (QoS 1, retained)",
+		"driver -> /devices/sample/controls/lastError/meta/order: [7] (QoS 1, retained)",
+		"driver -> /devices/sample/controls/lastError: [] (QoS 1, retained)",
+	)...)
+
+	// the errors aren't checked when no
+	// parameters are due
+	s.pollTriggerCh <- struct{}{}
+	s.pollTriggerCh <- struct{}{}
+	s.tester.elapse(10 * time.Second)
+	s.pollTriggerCh <- struct{}{}
+	s.tester.simpleChat("MEAS:VOLT?", "12.1")
+	s.tester.simpleChat("CURR?", "3.5")
+	s.tester.simpleChat("MODE?", "1")
+	s.tester.simpleChat("SYST:ERR?", `0,"No error"`)
+	s.Verify(
+		"driver -> /devices/sample/controls/voltage: [12.1] (QoS 1, retained)",
+		"driver -> /devices/sample/controls/current: [3.5] (QoS 1, retained)",
+		"driver -> /devices/sample/controls/mode: [Bar] (QoS 1, retained)",
+	)
+}
+
+func (s *ModelSuite) TestControlMeta() {
+	config := sampleConfig()
+	min, max, precision := 0.0, 5.0, 2
+	current := config.Ports[0].Parameters[1].ListControls()[0]
+	current.Min = &min
+	current.Max = &max
+	current.Precision = &precision
+	current.Order = 10
+	s.Start(config)
+	s.pollTriggerCh <- struct{}{}
+	s.tester.simpleChat("*IDN?", "some_dev_id")
+	s.tester.simpleChat("MEAS:VOLT?", "12.0")
+	s.tester.simpleChat("CURR?", "3.5")
+	s.tester.simpleChat("MODE?", "1")
+	var expected []interface{}
+	for _, msg := range firstPollMessages() {
+		switch msg {
+		case "driver -> /devices/sample/controls/current: [3.5] (QoS 1, retained)":
+			expected = append(expected, "driver -> /devices/sample/controls/current/meta/max: [5] (QoS 1, retained)", msg)
+		case "Subscribe -- driver: /devices/sample/controls/current/on":
+			expected = append(expected, msg,
+				"driver -> /devices/sample/controls/current/meta/min: [0] (QoS 1, retained)",
+				"driver -> /devices/sample/controls/current/meta/precision: [2] (QoS 1, retained)",
+				"driver -> /devices/sample/controls/current/meta/order: [10] (QoS 1, retained)")
+		default:
+			expected = append(expected, msg)
+		}
+	}
+	s.Verify(expected...)
+
+	// out of range values aren't sent to the device.
+	// The write fails and the value is reverted
+	s.client.Publish(wbgo.MQTTMessage{Topic: "/devices/sample/controls/current/on", Payload: "5.5", QoS: 1})
+	s.Verify(
+		"tst -> /devices/sample/controls/current/on: [5.5] (QoS 1)",
+		"driver -> /devices/sample/controls/current: [3.5] (QoS 1, retained)",
+		"driver -> /devices/sample/controls/current/meta/error: [w] (QoS 1, retained)",
+	)
+	s.WaitForErrors()
+
+	s.client.Publish(wbgo.MQTTMessage{Topic: "/devices/sample/controls/current/on", Payload: "4.5", QoS: 1})
+	s.tester.simpleChat("CURR 4.5; *OPC?", "1")
+	s.tester.simpleChat("CURR?", "4.5")
+	s.Verify(
+		"tst -> /devices/sample/controls/current/on: [4.5] (QoS 1)",
+		"driver -> /devices/sample/controls/current: [4.5] (QoS 1, retained)",
+		"driver -> /devices/sample/controls/current: [4.5] (QoS 1, retained)",
+		"driver -> /devices/sample/controls/current/meta/error: [] (QoS 1, retained)",
+	)
+}
+
+func (s *ModelSuite) TestSetEnum() {
+	config := sampleConfig()
+	config.Ports[0].Parameters[2].ListControls()[0].Writable = true
+	s.Start(config)
+	s.pollTriggerCh <- struct{}{}
+	s.tester.simpleChat("*IDN?", "some_dev_id")
+	s.tester.simpleChat("MEAS:VOLT?", "12.0")
+	s.tester.simpleChat("CURR?", "3.5")
+	s.tester.simpleChat("MODE?", "1")
+	var expected []interface{}
+	for _, msg := range firstPollMessages() {
+		switch msg {
+		case "driver -> /devices/sample/controls/mode/meta/readonly: [1] (QoS 1, retained)":
+			expected = append(expected, "driver -> /devices/sample/controls/mode/meta/writable: [1] (QoS 1, retained)")
+		case "driver -> /devices/sample/controls/mode: [Bar] (QoS 1, retained)":
+			expected = append(expected, msg, "Subscribe -- driver: /devices/sample/controls/mode/on")
+		default:
+			expected = append(expected, msg)
+		}
+	}
+	s.Verify(expected...)
+
+	// enum names are translated to the device values
+	s.client.Publish(wbgo.MQTTMessage{Topic: "/devices/sample/controls/mode/on", Payload: "Baz", QoS: 1})
+	s.tester.simpleChat("MODE 2; *OPC?", "1")
+	s.tester.simpleChat("MODE?", "2")
+	s.Verify(
+		"tst -> /devices/sample/controls/mode/on: [Baz] (QoS 1)",
+		"driver -> /devices/sample/controls/mode: [Baz] (QoS 1, retained)",
+		"driver -> /devices/sample/controls/mode: [Baz] (QoS 1, retained)",
+	)
+
+	// the device values can be used too. wbgo echoes the
+	// value as is, but the name is published after reading
+	// the value back
+	s.client.Publish(wbgo.MQTTMessage{Topic: "/devices/sample/controls/mode/on", Payload: "0", QoS: 1})
+	s.tester.simpleChat("MODE 0; *OPC?", "1")
+	s.tester.simpleChat("MODE?", "0")
+	s.Verify(
+		"tst -> /devices/sample/controls/mode/on: [0] (QoS 1)",
+		"driver -> /devices/sample/controls/mode: [0] (QoS 1, retained)",
+		"driver -> /devices/sample/controls/mode: [Foo] (QoS 1, retained)",
+	)
+
+	// unknown names are rejected
+	s.client.Publish(wbgo.MQTTMessage{Topic: "/devices/sample/controls/mode/on", Payload: "Qux", QoS: 1})
+	s.Verify(
+		"tst -> /devices/sample/controls/mode/on: [Qux] (QoS 1)",
+	)
+	s.WaitForErrors()
+}
+
+func (s *ModelSuite) TestWriteCoalescing() {
+	s.Start(sampleConfig())
+	s.verifyPoll()
+	s.client.Publish(wbgo.MQTTMessage{Topic: "/devices/sample/controls/current/on", Payload: "3.6", QoS: 1})
+	s.tester.expectCommand("CURR 3.6; *OPC?")
+	s.Verify(
+		"tst -> /devices/sample/controls/current/on: [3.6] (QoS 1)",
+		"driver -> /devices/sample/controls/current: [3.6] (QoS 1, retained)",
+	)
+	// MQTT messages are still handled while the write is in progress
+	for _, v := range []string{"3.7", "3.8", "3.9"} {
+		s.client.Publish(wbgo.MQTTMessage{Topic: "/devices/sample/controls/current/on", Payload: v, QoS: 1})
+		s.Verify(
+			"tst -> /devices/sample/controls/current/on: ["+v+"] (QoS 1)",
+			"driver -> /devices/sample/controls/current: ["+v+"] (QoS 1, retained)",
+		)
+	}
+	s.tester.writeResponse("1")
+
+	// only the last value is written, and the value
+	// is read back after that
+	s.tester.simpleChat("CURR 3.9; *OPC?", "1")
+	s.tester.simpleChat("CURR?", "3.9")
+	s.Verify(
+		"driver -> /devices/sample/controls/current: [3.9] (QoS 1, retained)",
+	)
+}
+
 func (s *ModelSuite) TestReadWriteConflict() {
 	s.Start(sampleConfig())
 	s.verifyPoll()
@@ -221,10 +718,11 @@ func (s *ModelSuite) TestReadWriteConflict() {
 
 	s.tester.simpleChat("MEAS:VOLT?", "12.0")
 	s.tester.expectCommand("CURR?")
-	s.client.Publish(wbgo.MQTTMessage{"/devices/sample/controls/current/on", "3.6", 1, false})
+	s.client.Publish(wbgo.MQTTMessage{Topic: "/devices/sample/controls/current/on", Payload: "3.6", QoS: 1})
 	s.tester.writeResponse("3.5")
 	s.tester.unorderedChat(map[string]string{
 		"CURR 3.6; *OPC?": "1",
+		"CURR?":           "3.6",
 		"MODE?":           "0",
 	})
 
@@ -234,10 +732,337 @@ func (s *ModelSuite) TestReadWriteConflict() {
 		"tst -> /devices/sample/controls/current/on: [3.6] (QoS 1)",
 		"driver -> /devices/sample/controls/voltage: [12.0] (QoS 1, retained)",
 		"driver -> /devices/sample/controls/current: [3.6] (QoS 1, retained)",
+		"driver -> /devices/sample/controls/current: [3.6] (QoS 1, retained)",
 		"driver -> /devices/sample/controls/mode: [Foo] (QoS 1, retained)",
 	)
 }
 
+// startShutdown initiates the shutdown of the model and waits
+// for the device loops to stop. It returns a channel that's
+// closed when the shutdown is complete
+func (s *ModelSuite) startShutdown(timeout time.Duration) chan struct{} {
+	// the model state must only be accessed from the driver goroutine
+	loopDoneChCh := make(chan (<-chan struct{}), 1)
+	s.driver.CallSync(func() {
+		loopDoneChCh <- s.model.devs[0].loopCtx.Done()
+	})
+	loopDoneCh := <-loopDoneChCh
+	doneCh := make(chan struct{})
+	go func() {
+		s.driver.CallSync(func() {
+			s.model.Shutdown(timeout)
+		})
+		close(doneCh)
+	}()
+	<-loopDoneCh
+	return doneCh
+}
+
+func (s *ModelSuite) TestShutdown() {
+	s.Start(sampleConfig())
+	s.verifyPoll()
+	s.client.Publish(wbgo.MQTTMessage{Topic: "/devices/sample/controls/current/on", Payload: "3.6", QoS: 1})
+	s.tester.expectCommand("CURR 3.6; *OPC?")
+	s.Verify(
+		"tst -> /devices/sample/controls/current/on: [3.6] (QoS 1)",
+		"driver -> /devices/sample/controls/current: [3.6] (QoS 1, retained)",
+	)
+	doneCh := s.startShutdown(5 * time.Second)
+	// the command that's being executed is allowed
+	// to finish, but the value is not read back
+	s.tester.writeResponse("1")
+	<-doneCh
+	s.Verify(
+		"driver -> /devices/sample/controls/online: [0] (QoS 1, retained)",
+	)
+}
+
+func (s *ModelSuite) TestShutdownTimeout() {
+	s.Start(sampleConfig())
+	s.verifyPoll()
+	s.client.Publish(wbgo.MQTTMessage{Topic: "/devices/sample/controls/current/on", Payload: "3.6", QoS: 1})
+	s.tester.expectCommand("CURR 3.6; *OPC?")
+	s.Verify(
+		"tst -> /devices/sample/controls/current/on: [3.6] (QoS 1)",
+		"driver -> /devices/sample/controls/current: [3.6] (QoS 1, retained)",
+	)
+	// the device doesn't respond, so the command is aborted
+	<-s.startShutdown(100 * time.Millisecond)
+	s.Verify(
+		"driver -> /devices/sample/controls/current: [3.5] (QoS 1, retained)",
+		"driver -> /devices/sample/controls/current/meta/error: [w] (QoS 1, retained)",
+		"driver -> /devices/sample/controls/online: [0] (QoS 1, retained)",
+	)
+	s.EnsureGotWarnings()
+}
+
+func (s *ModelSuite) TestShutdownSafeState() {
+	config := sampleConfig()
+	config.Ports[0].SafeState = []*SetupItem{
+		{
+			Command:  "OUTP 0; *OPC?",
+			Response: "1",
+		},
+	}
+	s.Start(config)
+	s.verifyPoll()
+	doneCh := s.startShutdown(5 * time.Second)
+	s.tester.simpleChat("OUTP 0; *OPC?", "1")
+	<-doneCh
+	s.Verify(
+		"driver -> /devices/sample/controls/online: [0] (QoS 1, retained)",
+	)
+}
+
+func (s *ModelSuite) TestSafeStateFailureOnReconnect() {
+	config := sampleConfig()
+	config.Ports[0].SafeState = []*SetupItem{
+		{
+			Command:  "OUTP 0; *OPC?",
+			Response: "1",
+		},
+	}
+	config.Ports[0].SafeStateOnReconnect = true
+	s.Start(config)
+	s.verifyPoll()
+
+	s.tester.fc.setPendingError(errors.New("oops"))
+	s.pollTriggerCh <- struct{}{}
+	s.Verify(
+		"driver -> /devices/sample/controls/voltage/meta/error: [r] (QoS 1, retained)",
+		"driver -> /devices/sample/controls/current/meta/error: [r] (QoS 1, retained)",
+		"driver -> /devices/sample/controls/mode/meta/error: [r] (QoS 1, retained)",
+		"driver -> /devices/sample/controls/online: [0] (QoS 1, retained)",
+	)
+	s.EnsureGotErrors()
+
+	// the device doesn't enter the safe state after reconnecting,
+	// but it's still polled
+	<-s.tester.connectCh // the initial connection
+	s.tester.elapse(10 * time.Second)
+	<-s.tester.connectCh
+	s.tester.simpleChat("OUTP 0; *OPC?", "0")
+	// the commander is set before the model becomes ready
+	commander := s.model.devs[0].commander
+	testutils.WaitFor(s.T(), func() bool {
+		return commander.Diagnostics().Connected
+	})
+	s.pollTriggerCh <- struct{}{}
+	s.tester.simpleChat("MEAS:VOLT?", "12.0")
+	s.tester.simpleChat("CURR?", "3.5")
+	s.tester.simpleChat("MODE?", "1")
+	s.Verify(
+		"driver -> /devices/sample/controls/voltage: [12.0] (QoS 1, retained)",
+		"driver -> /devices/sample/controls/voltage/meta/error: [] (QoS 1, retained)",
+		"driver -> /devices/sample/controls/current: [3.5] (QoS 1, retained)",
+		"driver -> /devices/sample/controls/current/meta/error: [] (QoS 1, retained)",
+		"driver -> /devices/sample/controls/mode: [Bar] (QoS 1, retained)",
+		"driver -> /devices/sample/controls/mode/meta/error: [] (QoS 1, retained)",
+		"driver -> /devices/sample/controls/online: [1] (QoS 1, retained)",
+		"driver -> /devices/sample/controls/online/meta/error: [w] (QoS 1, retained)",
+	)
+	s.EnsureGotErrors()
+}
+
+func (s *ModelSuite) reload(config *DriverConfig) {
+	errCh := make(chan error)
+	s.driver.CallSync(func() {
+		errCh <- s.model.Reload(config)
+	})
+	if err := <-errCh; err != nil {
+		s.T().Fatalf("Reload() failed: %v", err)
+	}
+}
+
+func unsubscribeMessages(devName string, controlNames ...string) []interface{} {
+	var r []interface{}
+	for _, name := range controlNames {
+		r = append(r, fmt.Sprintf("Unsubscribe -- driver: /devices/%s/controls/%s/on", devName, name))
+	}
+	return r
+}
+
+func unpublishMessages(devName string, controlNames ...string) []interface{} {
+	var r []interface{}
+	for _, name := range controlNames {
+		for _, metaName := range controlMetaNames {
+			r = append(r, fmt.Sprintf("driver -> /devices/%s/controls/%s/meta/%s: [] (QoS 1, retained)", devName, name, metaName))
+		}
+		r = append(r, fmt.Sprintf("driver -> /devices/%s/controls/%s: [] (QoS 1, retained)", devName, name))
+	}
+	return r
+}
+
+func (s *ModelSuite) TestReloadUnchanged() {
+	s.Start(sampleConfig())
+	s.verifyPoll()
+	s.reload(sampleConfig())
+
+	// the device keeps polling
+	s.pollTriggerCh <- struct{}{}
+	s.tester.simpleChat("MEAS:VOLT?", "12.0")
+	s.tester.simpleChat("CURR?", "3.5")
+	s.tester.simpleChat("MODE?", "0")
+	s.Verify(
+		"driver -> /devices/sample/controls/voltage: [12.0] (QoS 1, retained)",
+		"driver -> /devices/sample/controls/current: [3.5] (QoS 1, retained)",
+		"driver -> /devices/sample/controls/mode: [Foo] (QoS 1, retained)",
+	)
+	s.tester.verifyConnectCount(1)
+}
+
+func (s *ModelSuite) TestReloadChangedDevice() {
+	s.Start(sampleConfig())
+	s.verifyPoll()
+
+	config := sampleConfig()
+	config.Ports[0].Title = "New Title"
+	// remove 'doit' control
+	config.Ports[0].Parameters = config.Ports[0].Parameters[:3]
+	s.reload(config)
+	msgs := unpublishMessages("sample", "doit")
+	msgs = append(msgs, unsubscribeMessages("sample", "id", "voltage", "current", "mode", "doit", "online")...)
+	s.Verify(append(msgs, "driver -> /devices/sample/meta/name: [New Title] (QoS 1, retained)")...)
+
+	// the device is identified again
+	s.pollTriggerCh <- struct{}{}
+	s.tester.simpleChat("*IDN?", "some_dev_id")
+	s.tester.simpleChat("MEAS:VOLT?", "12.0")
+	s.tester.simpleChat("CURR?", "3.5")
+	s.tester.simpleChat("MODE?", "1")
+	msgs = nil
+	for _, msg := range firstPollMessages() {
+		switch {
+		case strings.Contains(msg.(string), "/doit"):
+		case strings.Contains(msg.(string), "online/meta/order"):
+			msgs = append(msgs, "driver -> /devices/sample/controls/online/meta/order: [5] (QoS 1, retained)")
+		default:
+			msgs = append(msgs, msg)
+		}
+	}
+	s.Verify(msgs...)
+
+	// the port settings are the same, so there's no reconnect
+	s.tester.verifyConnectCount(1)
+}
+
+func (s *ModelSuite) TestReloadChangedPortSettings() {
+	s.Start(sampleConfig())
+	s.verifyPoll()
+
+	config := sampleConfig()
+	config.Ports[0].CommandTimeoutMs = 5000
+	s.reload(config)
+	s.Verify(append(
+		unsubscribeMessages("sample", "id", "voltage", "current", "mode", "doit", "online"),
+		"driver -> /devices/sample/meta/name: [Sample Dev] (QoS 1, retained)",
+	)...)
+	s.verifyPoll()
+	s.tester.verifyConnectCount(2)
+}
+
+func (s *ModelSuite) TestReloadRemovedDevice() {
+	s.Start(sampleConfig())
+	s.verifyPoll()
+
+	config := sampleConfig()
+	config.Ports[0].Name = "sample2"
+	s.reload(config)
+	msgs := unsubscribeMessages("sample", "id", "voltage", "current", "mode", "doit", "online")
+	msgs = append(msgs, unpublishMessages("sample", "current", "doit", "id", "mode", "online", "voltage")...)
+	s.Verify(append(msgs,
+		"driver -> /devices/sample/meta/name: [] (QoS 1, retained)",
+		"driver -> /devices/sample2/meta/name: [Sample Dev] (QoS 1, retained)",
+	)...)
+	s.tester.verifyConnectCount(1)
+}
+
+func TestSharedPortLineSettingsConflict(t *testing.T) {
+	config := sampleConfig()
+	port2 := *config.Ports[0]
+	settings2 := *port2.PortSettings
+	settings2.Name = "sample2"
+	settings2.BaudRate = 9600
+	port2.PortSettings = &settings2
+	config.Ports = append(config.Ports, &port2)
+	model := NewModel(DefaultCommanderFactory(nil), config)
+	// default baud rate is 9600 so the settings match
+	if err := checkSharedPorts(model.config); err != nil {
+		t.Errorf("checkSharedPorts() failed for matching settings: %v", err)
+	}
+
+	settings2.BaudRate = 19200
+	err := model.Start()
+	expectedErr := `devices "sample" and "sample2" share port "localhost:10010" but have conflicting line settings`
+	switch {
+	case err == nil:
+		t.Errorf("Start() didn't fail for conflicting line settings")
+	case err.Error() != expectedErr:
+		t.Errorf("unexpected error %q (expected %q)", err, expectedErr)
+	}
+}
+
+func TestSharedPortConflicts(t *testing.T) {
+	for _, testCase := range []struct {
+		conflict string
+		modify   func(settings *PortSettings)
+	}{
+		{"", func(settings *PortSettings) {
+			// each device is identified separately
+			settings.IdentifyAttempts = 5
+		}},
+		{"", func(settings *PortSettings) {
+			// crlf is the default line ending
+			settings.LineEnding = "crlf"
+		}},
+		{"timing settings", func(settings *PortSettings) {
+			settings.CommandTimeoutMs = 500
+		}},
+		{"line endings", func(settings *PortSettings) {
+			settings.LineEnding = "cr"
+		}},
+		{"command delays", func(settings *PortSettings) {
+			settings.CommandDelayMs = 10
+		}},
+		{"setup commands", func(settings *PortSettings) {
+			settings.Setup = []*SetupItem{
+				{
+					Command: ":SYST:REM",
+				},
+			}
+		}},
+		{"safe state settings", func(settings *PortSettings) {
+			settings.SafeState = []*SetupItem{
+				{
+					Command: "OUTP 0",
+				},
+			}
+		}},
+	} {
+		config := sampleConfig()
+		port2 := *config.Ports[0]
+		settings2 := *port2.PortSettings
+		settings2.Name = "sample2"
+		testCase.modify(&settings2)
+		port2.PortSettings = &settings2
+		config.Ports = append(config.Ports, &port2)
+		err := checkSharedPorts(config)
+		switch {
+		case testCase.conflict == "":
+			if err != nil {
+				t.Errorf("checkSharedPorts() failed for matching settings: %v", err)
+			}
+		case err == nil:
+			t.Errorf("checkSharedPorts() didn't fail for conflicting %s", testCase.conflict)
+		default:
+			expectedErr := `devices "sample" and "sample2" share port "localhost:10010" but have conflicting ` + testCase.conflict
+			if err.Error() != expectedErr {
+				t.Errorf("unexpected error %q (expected %q)", err, expectedErr)
+			}
+		}
+	}
+}
+
 func TestModelSuite(t *testing.T) {
 	testutils.RunSuites(t, new(ModelSuite))
 }
@@ -1,11 +1,54 @@
 package main
 
-import "fmt"
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// CommanderDiagnostics contains the information about
+// the state of the commander
+type CommanderDiagnostics struct {
+	// Connected is true if the connection to the device
+	// is established
+	Connected bool
+	// ReconnectAttempts is the number of reconnection attempts
+	// made since the connection was lost
+	ReconnectAttempts int
+	// ReconnectBackoff is the current delay before the next
+	// reconnection attempt
+	ReconnectBackoff time.Duration
+	// SafeStateFailed is true if the safe state commands
+	// failed after the last reconnection
+	SafeStateFailed bool
+}
+
+// CommandPriority specifies the order in which the queued
+// commands are executed
+type CommandPriority int
+
+const (
+	// PriorityBackground is used for polling the devices
+	PriorityBackground CommandPriority = iota
+	// PriorityInteractive is used for the commands initiated
+	// by the user, such as setting the control values. These
+	// commands are executed before any pending background ones
+	PriorityInteractive
+)
 
 type Commander interface {
 	Connect()
 	Ready() <-chan struct{}
-	Query(query string, fixedResponseSize int) (string, error)
+	// Query sends the text command and reads the response
+	// using the framer supplied by the protocol. If framer
+	// is nil, the response is read up to the line ending
+	Query(ctx context.Context, query string, framer Framer, priority CommandPriority) (string, error)
+	// Exchange sends a binary request frame and reads the
+	// response frame using the framer supplied by the protocol
+	Exchange(ctx context.Context, request []byte, framer Framer, priority CommandPriority) ([]byte, error)
+	// SafeState puts the devices on the port into the safe state
+	SafeState(ctx context.Context) error
+	Diagnostics() CommanderDiagnostics
 	Close()
 }
 
@@ -13,15 +56,32 @@ type QueryHandler func(string, interface{})
 
 type Parameter interface {
 	Name() string
-	Query(Commander, QueryHandler) error
-	Set(Commander, string, interface{}) error
+	Query(context.Context, Commander, QueryHandler) error
+	Set(context.Context, Commander, string, interface{}) error
 }
 
 type Protocol interface {
-	Identify(Commander) (string, error)
+	Identify(context.Context, Commander) (string, error)
 	Parameter(ParameterSpec) (Parameter, error)
 }
 
+// Addresser is implemented by the protocols that address
+// the text commands to the devices themselves, so several
+// devices can share the same bus. The commander sends
+// the commands as is
+type Addresser interface {
+	// Address returns the command addressed to the device
+	Address(command string) string
+}
+
+// ErrorChecker is implemented by the protocols that can
+// retrieve the errors reported by the device
+type ErrorChecker interface {
+	// CheckErrors reads the pending device errors, returning
+	// them as *DeviceError if there are any
+	CheckErrors(context.Context, Commander) error
+}
+
 type ProtocolFactory func(*PortConfig) (Protocol, error)
 
 var protocols map[string]ProtocolFactory = make(map[string]ProtocolFactory)
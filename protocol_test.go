@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"reflect"
 	"testing"
 )
@@ -38,7 +39,7 @@ func (pt *protocolTester) param(paramIndex int) Parameter {
 func (pt *protocolTester) verifyQuery(paramIndex int, expectedResult map[string]interface{}) {
 	param := pt.param(paramIndex)
 	r := make(map[string]interface{})
-	if err := param.Query(pt.commander, func(name string, value interface{}) {
+	if err := param.Query(context.Background(), pt.commander, func(name string, value interface{}) {
 		r[name] = value
 	}); err != nil {
 		pt.t.Fatalf("Query(): %v", err)
@@ -50,14 +51,14 @@ func (pt *protocolTester) verifyQuery(paramIndex int, expectedResult map[string]
 
 func (pt *protocolTester) verifySet(paramIndex int, controlName string, value interface{}) {
 	param := pt.param(paramIndex)
-	if err := param.Set(pt.commander, controlName, value); err != nil {
+	if err := param.Set(context.Background(), pt.commander, controlName, value); err != nil {
 		pt.t.Fatalf("Set(): %v", err)
 	}
 }
 
 func (pt *protocolTester) verifyQueryError(paramIndex int, errStr string) {
 	param := pt.param(paramIndex)
-	err := param.Query(pt.commander, func(string, interface{}) {
+	err := param.Query(context.Background(), pt.commander, func(string, interface{}) {
 		pt.t.Errorf("unexpected query handler call")
 	})
 	if err == nil {
@@ -70,7 +71,7 @@ func (pt *protocolTester) verifyQueryError(paramIndex int, errStr string) {
 
 func (pt *protocolTester) verifySetError(paramIndex int, controlName string, value interface{}, errStr string) {
 	param := pt.param(paramIndex)
-	err := param.Set(pt.commander, controlName, value)
+	err := param.Set(context.Background(), pt.commander, controlName, value)
 	if err == nil {
 		pt.t.Errorf("no error received for param %d", paramIndex)
 	}
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// telnet commands and options (RFC 854, RFC 856, RFC 858)
+const (
+	telnetSE   = 240
+	telnetSB   = 250
+	telnetWILL = 251
+	telnetWONT = 252
+	telnetDO   = 253
+	telnetDONT = 254
+	telnetIAC  = 255
+
+	telnetOptBinary  = 0
+	telnetOptSGA     = 3
+	telnetOptComPort = 44
+)
+
+// RFC 2217 subcommands. The server responds to them
+// using the same subcommands plus rfc2217ServerOffset
+const (
+	rfc2217SetBaudRate  = 1
+	rfc2217SetDataSize  = 2
+	rfc2217SetParity    = 3
+	rfc2217SetStopSize  = 4
+	rfc2217ServerOffset = 100
+)
+
+var rfc2217Parities = map[string]byte{
+	"N": 1,
+	"O": 2,
+	"E": 3,
+}
+
+const (
+	telnetStateData = iota
+	telnetStateIAC
+	telnetStateOption
+	telnetStateSB
+	telnetStateSBIAC
+)
+
+// telnetDecoder removes telnet commands from the data stream.
+// The commands may be split between the chunks of data
+type telnetDecoder struct {
+	state int
+	cmd   byte
+	sb    []byte
+	// onOption is called for the option negotiation
+	// commands (WILL, WONT, DO, DONT)
+	onOption func(cmd, option byte)
+	// onSubnegotiation is called for the subnegotiation data
+	// without the surrounding IAC SB and IAC SE
+	onSubnegotiation func(data []byte)
+}
+
+// decode returns the data with telnet commands removed
+func (d *telnetDecoder) decode(in []byte) []byte {
+	var out []byte
+	for _, b := range in {
+		switch d.state {
+		case telnetStateData:
+			if b == telnetIAC {
+				d.state = telnetStateIAC
+			} else {
+				out = append(out, b)
+			}
+		case telnetStateIAC:
+			switch b {
+			case telnetIAC:
+				out = append(out, b)
+				d.state = telnetStateData
+			case telnetWILL, telnetWONT, telnetDO, telnetDONT:
+				d.cmd = b
+				d.state = telnetStateOption
+			case telnetSB:
+				d.sb = nil
+				d.state = telnetStateSB
+			default:
+				// NOP and the like
+				d.state = telnetStateData
+			}
+		case telnetStateOption:
+			if d.onOption != nil {
+				d.onOption(d.cmd, b)
+			}
+			d.state = telnetStateData
+		case telnetStateSB:
+			if b == telnetIAC {
+				d.state = telnetStateSBIAC
+			} else {
+				d.sb = append(d.sb, b)
+			}
+		case telnetStateSBIAC:
+			switch b {
+			case telnetIAC:
+				d.sb = append(d.sb, b)
+				d.state = telnetStateSB
+			case telnetSE:
+				if d.onSubnegotiation != nil {
+					d.onSubnegotiation(d.sb)
+				}
+				d.sb = nil
+				d.state = telnetStateData
+			default:
+				// malformed subnegotiation, drop it
+				d.sb = nil
+				d.state = telnetStateData
+			}
+		}
+	}
+	return out
+}
+
+// telnetEscape doubles IAC bytes in the data
+func telnetEscape(data []byte) []byte {
+	return bytes.Replace(data, []byte{telnetIAC}, []byte{telnetIAC, telnetIAC}, -1)
+}
+
+// telnetSubnegotiation builds IAC SB <data> IAC SE sequence
+func telnetSubnegotiation(data ...byte) []byte {
+	r := []byte{telnetIAC, telnetSB}
+	r = append(r, telnetEscape(data)...)
+	return append(r, telnetIAC, telnetSE)
+}
+
+// rfc2217Conn is a connection to a serial port of a terminal
+// server that supports RFC 2217 (Telnet COM Port Control).
+// The telnet commands are handled transparently, so it can
+// be used the same way as raw TCP connections
+type rfc2217Conn struct {
+	netWrapper
+	decoder  telnetDecoder
+	writeMtx sync.Mutex
+	// sent contains the option negotiation commands that
+	// were sent, so they're not repeated in replies
+	sent map[[2]byte]bool
+	// acks contains the com port subcommands that
+	// were acknowledged by the server
+	acks    map[byte]bool
+	refused bool
+	pending []byte
+	buf     []byte
+}
+
+func newRfc2217Conn(conn net.Conn) *rfc2217Conn {
+	c := &rfc2217Conn{
+		netWrapper: netWrapper{conn},
+		sent:       make(map[[2]byte]bool),
+		acks:       make(map[byte]bool),
+		buf:        make([]byte, 1024),
+	}
+	c.decoder.onOption = c.handleOption
+	c.decoder.onSubnegotiation = c.handleSubnegotiation
+	return c
+}
+
+func (c *rfc2217Conn) writeRaw(data []byte) error {
+	c.writeMtx.Lock()
+	defer c.writeMtx.Unlock()
+	_, err := c.netWrapper.Write(data)
+	return err
+}
+
+// sendOption sends the option negotiation command
+// unless it was already sent
+func (c *rfc2217Conn) sendOption(cmd, option byte) error {
+	key := [2]byte{cmd, option}
+	if c.sent[key] {
+		return nil
+	}
+	c.sent[key] = true
+	return c.writeRaw([]byte{telnetIAC, cmd, option})
+}
+
+func (c *rfc2217Conn) handleOption(cmd, option byte) {
+	supported := option == telnetOptBinary || option == telnetOptSGA || option == telnetOptComPort
+	switch {
+	case option == telnetOptComPort && (cmd == telnetDONT || cmd == telnetWONT):
+		c.refused = true
+	case cmd == telnetDO && supported:
+		c.sendOption(telnetWILL, option)
+	case cmd == telnetDO:
+		c.sendOption(telnetWONT, option)
+	case cmd == telnetWILL && supported:
+		c.sendOption(telnetDO, option)
+	case cmd == telnetWILL:
+		c.sendOption(telnetDONT, option)
+	}
+}
+
+func (c *rfc2217Conn) handleSubnegotiation(data []byte) {
+	// other subcommands such as NOTIFY-LINESTATE are ignored
+	if len(data) >= 2 && data[0] == telnetOptComPort && data[1] > rfc2217ServerOffset {
+		c.acks[data[1]-rfc2217ServerOffset] = true
+	}
+}
+
+// readRaw reads the data from the connection, handling
+// the telnet commands
+func (c *rfc2217Conn) readRaw() error {
+	n, err := c.netWrapper.Read(c.buf)
+	if n > 0 {
+		c.pending = append(c.pending, c.decoder.decode(c.buf[:n])...)
+	}
+	return err
+}
+
+func (c *rfc2217Conn) Read(b []byte) (int, error) {
+	for len(c.pending) == 0 {
+		if err := c.readRaw(); err != nil && len(c.pending) == 0 {
+			return 0, err
+		}
+	}
+	n := copy(b, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+func (c *rfc2217Conn) Write(b []byte) (int, error) {
+	if err := c.writeRaw(telnetEscape(b)); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// negotiate sets up the serial line of the terminal server
+// using the line settings, waiting for the server to
+// acknowledge them
+func (c *rfc2217Conn) negotiate(lineSettings LineSettings, timeout time.Duration) error {
+	lineSettings = lineSettings.Normalize()
+	for _, option := range [][2]byte{
+		{telnetWILL, telnetOptBinary},
+		{telnetDO, telnetOptBinary},
+		{telnetDO, telnetOptSGA},
+		{telnetWILL, telnetOptComPort},
+	} {
+		if err := c.sendOption(option[0], option[1]); err != nil {
+			return err
+		}
+	}
+	baudRate := make([]byte, 4)
+	binary.BigEndian.PutUint32(baudRate, uint32(lineSettings.BaudRate))
+	var commands []byte
+	commands = append(commands, telnetSubnegotiation(append([]byte{telnetOptComPort, rfc2217SetBaudRate}, baudRate...)...)...)
+	commands = append(commands, telnetSubnegotiation(telnetOptComPort, rfc2217SetDataSize, byte(lineSettings.DataBits))...)
+	commands = append(commands, telnetSubnegotiation(telnetOptComPort, rfc2217SetParity, rfc2217Parities[lineSettings.Parity])...)
+	commands = append(commands, telnetSubnegotiation(telnetOptComPort, rfc2217SetStopSize, byte(lineSettings.StopBits))...)
+	if err := c.writeRaw(commands); err != nil {
+		return err
+	}
+
+	if err := c.SetDeadline(time.Now().Add(timeout)); err != nil {
+		return err
+	}
+	for !c.acks[rfc2217SetBaudRate] || !c.acks[rfc2217SetDataSize] || !c.acks[rfc2217SetParity] || !c.acks[rfc2217SetStopSize] {
+		err := c.readRaw()
+		switch {
+		case c.refused:
+			return errors.New("rfc2217: the server doesn't support com port control")
+		case err == ErrTimeout:
+			return errors.New("rfc2217: timed out waiting for the server to set up the serial line")
+		case err != nil:
+			return fmt.Errorf("rfc2217: %v", err)
+		}
+	}
+	return c.SetDeadline(time.Time{})
+}
+
+func dialRfc2217(address string, settings *PortSettings) (*rfc2217Conn, error) {
+	conn, err := net.DialTimeout("tcp", address, settings.TcpTimeout())
+	if err != nil {
+		return nil, err
+	}
+	c := newRfc2217Conn(conn)
+	if err := c.negotiate(settings.LineSettings, settings.TcpTimeout()); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return c, nil
+}
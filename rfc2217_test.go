@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// fakeRfc2217Server is a minimal RFC 2217 server that
+// acknowledges the com port settings and echoes the data
+type fakeRfc2217Server struct {
+	listener  net.Listener
+	refuse    bool
+	settingCh chan []byte
+	dataCh    chan []byte
+}
+
+func newFakeRfc2217Server(t *testing.T, refuse bool) *fakeRfc2217Server {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen(): %v", err)
+	}
+	s := &fakeRfc2217Server{
+		listener:  listener,
+		refuse:    refuse,
+		settingCh: make(chan []byte, 10),
+		dataCh:    make(chan []byte, 10),
+	}
+	go s.serve()
+	return s
+}
+
+func (s *fakeRfc2217Server) serve() {
+	conn, err := s.listener.Accept()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	decoder := telnetDecoder{
+		onOption: func(cmd, option byte) {
+			switch {
+			case cmd == telnetWILL && option == telnetOptComPort && s.refuse:
+				conn.Write([]byte{telnetIAC, telnetDONT, option})
+			case cmd == telnetWILL:
+				conn.Write([]byte{telnetIAC, telnetDO, option})
+			}
+		},
+		onSubnegotiation: func(data []byte) {
+			if data[0] != telnetOptComPort {
+				return
+			}
+			s.settingCh <- append([]byte{}, data[1:]...)
+			ack := append([]byte{data[0], data[1] + rfc2217ServerOffset}, data[2:]...)
+			// add a line state notification that
+			// must be ignored by the client
+			conn.Write(append(telnetSubnegotiation(ack...), telnetSubnegotiation(telnetOptComPort, 106, 0x60)...))
+		},
+	}
+	buf := make([]byte, 1024)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return
+		}
+		data := decoder.decode(buf[:n])
+		if len(data) == 0 {
+			continue
+		}
+		s.dataCh <- data
+		// echo the data, splitting it in the middle of
+		// an escaped IAC and inserting a NOP command
+		echo := append([]byte{telnetIAC, 241}, telnetEscape(data)...)
+		conn.Write(echo[:3])
+		time.Sleep(10 * time.Millisecond)
+		conn.Write(echo[3:])
+	}
+}
+
+func (s *fakeRfc2217Server) close() {
+	s.listener.Close()
+}
+
+func TestRfc2217(t *testing.T) {
+	s := newFakeRfc2217Server(t, false)
+	defer s.close()
+	conn, err := connect(&PortSettings{
+		Port: "rfc2217://" + s.listener.Addr().String(),
+		LineSettings: LineSettings{
+			BaudRate: 19200,
+			DataBits: 7,
+			Parity:   "E",
+			StopBits: 2,
+		},
+	})
+	if err != nil {
+		t.Fatalf("connect(): %v", err)
+	}
+	defer conn.Close()
+
+	var settings [][]byte
+	for i := 0; i < 4; i++ {
+		settings = append(settings, <-s.settingCh)
+	}
+	baudRate := make([]byte, 4)
+	binary.BigEndian.PutUint32(baudRate, 19200)
+	expectedSettings := [][]byte{
+		append([]byte{rfc2217SetBaudRate}, baudRate...),
+		{rfc2217SetDataSize, 7},
+		{rfc2217SetParity, 3},
+		{rfc2217SetStopSize, 2},
+	}
+	if !reflect.DeepEqual(settings, expectedSettings) {
+		t.Errorf("bad com port settings %v (expected %v)", settings, expectedSettings)
+	}
+
+	data := []byte{'a', telnetIAC, 'b', '\r', '\n'}
+	if _, err := conn.Write(data); err != nil {
+		t.Fatalf("Write(): %v", err)
+	}
+	if received := <-s.dataCh; !bytes.Equal(received, data) {
+		t.Errorf("the server received %q instead of %q", received, data)
+	}
+	conn.(*rfc2217Conn).SetDeadline(time.Now().Add(3 * time.Second))
+	echo := make([]byte, len(data))
+	if _, err := io.ReadFull(conn, echo); err != nil {
+		t.Fatalf("ReadFull(): %v", err)
+	}
+	if !bytes.Equal(echo, data) {
+		t.Errorf("received %q instead of %q", echo, data)
+	}
+}
+
+func TestRfc2217Refused(t *testing.T) {
+	s := newFakeRfc2217Server(t, true)
+	defer s.close()
+	_, err := connect(&PortSettings{Port: "rfc2217://" + s.listener.Addr().String()})
+	expectedErr := "rfc2217: the server doesn't support com port control"
+	switch {
+	case err == nil:
+		t.Errorf("connect() didn't fail")
+	case err.Error() != expectedErr:
+		t.Errorf("unexpected error %q (expected %q)", err, expectedErr)
+	}
+}
@@ -1,102 +1,360 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"strconv"
 	"strings"
 
 	"github.com/contactless/wbgo"
 )
 
-const (
-	// FIXME: don't hardcode these values, use config
-	scpiIdentifyNumAttempts = 10
-)
-
 type scpiParameterSpec struct {
-	Control  ControlConfig `yaml:",inline"`
-	ScpiName string
+	Control      ControlConfig `yaml:",inline"`
+	PollSettings `yaml:",inline"`
+	ScpiName     string
+	// Numeric specifies that the value is a number. Numeric
+	// values read from the device are normalized, e.g.
+	// '+1.23400E+01' becomes '12.34'. Specifying Scale,
+	// Offset or Min/Max of the control implies Numeric.
+	// The values outside Min/Max are rejected instead of
+	// being clamped, so a mistyped setpoint doesn't silently
+	// become the limit. The control then reverts to the value
+	// read from the device and gets the write error
+	Numeric bool
+	// Scale and Offset are applied to the device values
+	// as value*scale + offset. Zero scale means 1
+	Scale  float64
+	Offset float64
+	// WriteFormat is the fmt format of the values that are
+	// written to the device, e.g. '%.2f'
+	WriteFormat string
+	// Controls specifies the controls for the queries that
+	// return several values at once, such as MEAS:ALL?.
+	// The values are assigned to the controls in order.
+	// Numeric, Scale and Offset apply to all of the values.
+	// Such parameters can't be used to set values
+	Controls []*ControlConfig
+	// Separator separates the values in the responses
+	// to the multi-value queries. Default is ','
+	Separator string
+	// PerChannel specifies that the parameter is instantiated
+	// for each channel of the port. '{ch}' in ScpiName is
+	// replaced with the channel number, e.g. 'SOUR{ch}:VOLT',
+	// and '_<channel>' is appended to the control names.
+	// ScpiName containing '{ch}' implies PerChannel
+	PerChannel bool
+	// channelSelect is the command that selects the channel
+	// of the per-channel parameter instance
+	channelSelect string
 }
 
-var _ ParameterSpec = &scpiParameterSpec{}
+var _ ChannelParameterSpec = &scpiParameterSpec{}
+
+func (spec *scpiParameterSpec) ForChannels(channels []int, selectCommand string) ([]ParameterSpec, error) {
+	if !spec.PerChannel && !strings.Contains(spec.ScpiName, channelPlaceholder) {
+		return []ParameterSpec{spec}, nil
+	}
+	if len(channels) == 0 {
+		return nil, fmt.Errorf("%s: no channels specified for per-channel parameter", spec.ScpiName)
+	}
+	var r []ParameterSpec
+	for _, ch := range channels {
+		chSpec := *spec
+		chSpec.ScpiName = channelTemplate(spec.ScpiName, ch)
+		chSpec.channelSelect = channelTemplate(selectCommand, ch)
+		if spec.isMultiValue() {
+			chSpec.Controls = make([]*ControlConfig, len(spec.Controls))
+			for i, control := range spec.Controls {
+				chSpec.Controls[i] = control.ForChannel(ch)
+			}
+		} else {
+			chSpec.Control = *spec.Control.ForChannel(ch)
+		}
+		r = append(r, &chSpec)
+	}
+	return r, nil
+}
+
+// channelCommand prepends the channel selection command, if any,
+// to the command. The resulting compound command is executed
+// as a single item of the commander queue, so no other
+// commands can be sent between selecting the channel and
+// the command itself
+func (spec *scpiParameterSpec) channelCommand(cmd string) string {
+	switch {
+	case spec.channelSelect == "":
+		return cmd
+	case strings.HasPrefix(cmd, ":") || strings.HasPrefix(cmd, "*"):
+		return spec.channelSelect + ";" + cmd
+	default:
+		// the leading colon resets the command tree
+		// path, e.g. 'INST:NSEL 2;:MEAS:VOLT?'
+		return spec.channelSelect + ";:" + cmd
+	}
+}
+
+func (spec *scpiParameterSpec) isMultiValue() bool {
+	return len(spec.Controls) > 0
+}
 
 func (spec *scpiParameterSpec) ListControls() []*ControlConfig {
+	if spec.isMultiValue() {
+		return spec.Controls
+	}
 	return []*ControlConfig{&spec.Control}
 }
 
 func (spec *scpiParameterSpec) ShouldPoll() bool {
-	return spec.Control.ShouldPoll()
+	for _, control := range spec.ListControls() {
+		if control.ShouldPoll() {
+			return true
+		}
+	}
+	return false
 }
 
 func (spec *scpiParameterSpec) Settable() bool {
-	return spec.Control.Writable
+	return !spec.isMultiValue() && spec.Control.Writable
 }
 
 func (spec *scpiParameterSpec) Validate() error {
-	if err := spec.Control.Validate(); err != nil {
+	if spec.isMultiValue() && spec.Control.Name != "" {
+		return fmt.Errorf("%s: can't specify both name and controls", spec.ScpiName)
+	}
+	for _, control := range spec.ListControls() {
+		if err := control.Validate(); err != nil {
+			return err
+		}
+		if spec.isMultiValue() && control.Writable {
+			return fmt.Errorf("%s: multi-value parameter control %q can't be writable", spec.ScpiName, control.Name)
+		}
+	}
+	if err := spec.PollSettings.Validate(); err != nil {
 		return err
 	}
 	if spec.ScpiName == "" {
 		return errors.New("scpiName not specified")
 	}
+	if spec.WriteFormat != "" {
+		var sample interface{} = "1"
+		if spec.isNumeric(&spec.Control) {
+			sample = 1.0
+		}
+		if strings.Contains(fmt.Sprintf(spec.WriteFormat, sample), "%!") {
+			return fmt.Errorf("%s: bad write format %q", spec.ScpiName, spec.WriteFormat)
+		}
+	}
+	return nil
+}
+
+func (spec *scpiParameterSpec) isNumeric(control *ControlConfig) bool {
+	return spec.Numeric || spec.Scale != 0 || spec.Offset != 0 || control.Min != nil || control.Max != nil
+}
+
+func (spec *scpiParameterSpec) scale() float64 {
+	if spec.Scale == 0 {
+		return 1
+	}
+	return spec.Scale
+}
+
+func (spec *scpiParameterSpec) separator() string {
+	if spec.Separator == "" {
+		return ","
+	}
+	return spec.Separator
+}
+
+// fromDevice converts the value of the control
+// received from the device
+func (spec *scpiParameterSpec) fromDevice(control *ControlConfig, v string) (string, error) {
+	switch {
+	case control.Type == "switch":
+		switch strings.ToUpper(v) {
+		case "ON", "1":
+			return "1", nil
+		case "OFF", "0":
+			return "0", nil
+		}
+		return "", fmt.Errorf("%s: bad switch value %q", spec.ScpiName, v)
+	case spec.isNumeric(control):
+		n, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+		if err != nil {
+			return "", fmt.Errorf("%s: bad numeric value %q", spec.ScpiName, v)
+		}
+		// limit the precision to avoid rounding artifacts
+		// caused by scaling
+		return strconv.FormatFloat(n*spec.scale()+spec.Offset, 'g', 12, 64), nil
+	}
+	return v, nil
+}
+
+// toDevice converts the value to be written to the device
+func (spec *scpiParameterSpec) toDevice(value interface{}) (string, error) {
+	v := fmt.Sprintf("%v", value)
+	switch {
+	case spec.Control.Type == "switch":
+		switch strings.ToUpper(v) {
+		case "ON", "1":
+			return "ON", nil
+		case "OFF", "0":
+			return "OFF", nil
+		}
+		return "", fmt.Errorf("%s: bad switch value %q", spec.ScpiName, v)
+	case spec.isNumeric(&spec.Control):
+		n, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return "", fmt.Errorf("%s: bad numeric value %q", spec.ScpiName, v)
+		}
+		n = (n - spec.Offset) / spec.scale()
+		if spec.WriteFormat != "" {
+			return fmt.Sprintf(spec.WriteFormat, n), nil
+		}
+		return strconv.FormatFloat(n, 'g', 12, 64), nil
+	case spec.WriteFormat != "":
+		return fmt.Sprintf(spec.WriteFormat, v), nil
+	}
+	return v, nil
+}
+
+const (
+	scpiErrorQuery = "SYST:ERR?"
+	// scpiMaxErrors limits the number of error queue entries
+	// read at once, in case the device keeps reporting errors
+	scpiMaxErrors = 32
+)
+
+// checkScpiErrors drains the error queue of the device
+func checkScpiErrors(ctx context.Context, c Commander, addr Addresser, priority CommandPriority) error {
+	var errs []string
+	for i := 0; i < scpiMaxErrors; i++ {
+		r, err := c.Query(ctx, addr.Address(scpiErrorQuery), nil, priority)
+		if err != nil {
+			return err
+		}
+		// the response looks like '-222,"Data out of range"'
+		code, err := strconv.Atoi(strings.TrimSpace(strings.SplitN(r, ",", 2)[0]))
+		if err != nil {
+			return fmt.Errorf("bad error queue response %q", r)
+		}
+		if code == 0 {
+			break
+		}
+		errs = append(errs, r)
+	}
+	if len(errs) > 0 {
+		return &DeviceError{errs}
+	}
 	return nil
 }
 
 type scpiParameter struct {
+	*scpiParameterSpec
 	scpiName, name string
 	skipValue      bool
-	prefix         string
+	addr           Addresser
+	checkErrors    bool
 }
 
 var _ Parameter = &scpiParameter{}
 
 func (p *scpiParameter) Name() string { return p.scpiName }
 
-func (p *scpiParameter) Query(c Commander, handler QueryHandler) error {
-	v, err := c.Query(p.scpiName+"?", 0)
+func (p *scpiParameter) Query(ctx context.Context, c Commander, handler QueryHandler) error {
+	r, err := c.Query(ctx, p.addr.Address(p.channelCommand(p.scpiName+"?")), nil, PriorityBackground)
 	if err != nil {
 		return err
 	}
-	handler(p.name, v)
+	if !p.isMultiValue() {
+		v, err := p.fromDevice(&p.Control, r)
+		if err != nil {
+			return err
+		}
+		handler(p.name, v)
+		return nil
+	}
+	// e.g. MEAS:ALL? -> '+1.20000E+01,+3.50000E+00'
+	parts := strings.Split(r, p.separator())
+	if len(parts) != len(p.Controls) {
+		return fmt.Errorf("%s: expected %d values, got %d", p.scpiName, len(p.Controls), len(parts))
+	}
+	values := make([]string, len(parts))
+	for i, part := range parts {
+		if values[i], err = p.fromDevice(p.Controls[i], strings.TrimSpace(part)); err != nil {
+			return err
+		}
+	}
+	// don't update any controls in case of bad values
+	for i, v := range values {
+		handler(p.Controls[i].Name, v)
+	}
 	return nil
 }
 
-func (p *scpiParameter) Set(c Commander, name string, value interface{}) error {
+func (p *scpiParameter) Set(ctx context.Context, c Commander, name string, value interface{}) error {
 	if name != p.name {
 		return fmt.Errorf("unknown control name %q", name)
 	}
 	var q string
-	// FIXME: instead of prefix, should use slave addr (and build the whole command)
 	if p.skipValue {
-		q = fmt.Sprintf("%s; %s*OPC?", p.scpiName, p.prefix)
+		q = fmt.Sprintf("%s; *OPC?", p.scpiName)
 	} else {
-		q = fmt.Sprintf("%s %s; %s*OPC?", p.scpiName, value, p.prefix)
+		v, err := p.toDevice(value)
+		if err != nil {
+			return err
+		}
+		q = fmt.Sprintf("%s %s; *OPC?", p.scpiName, v)
 	}
-	if r, err := c.Query(q, 0); err != nil {
+	if r, err := c.Query(ctx, p.addr.Address(p.channelCommand(q)), nil, PriorityInteractive); err != nil {
 		return err
 	} else if r != "1" {
 		return fmt.Errorf("unexpected set response %q", r)
 	}
+	if p.checkErrors {
+		// many devices accept bad values such as out of
+		// range setpoints, only reporting them in the
+		// error queue
+		return checkScpiErrors(ctx, c, p.addr, PriorityInteractive)
+	}
 	return nil
 }
 
 type scpiProtocol struct {
-	idSubstring, prefix string
+	idSubstring string
+	// addressPrefix is prepended to the commands
+	// to address them to the device
+	addressPrefix    string
+	identifyAttempts int
+	checkErrors      bool
 }
 
 var _ Protocol = &scpiProtocol{}
+var _ ErrorChecker = &scpiProtocol{}
+var _ Addresser = &scpiProtocol{}
 
 func newScpiProtocol(config *PortConfig) (Protocol, error) {
-	return &scpiProtocol{config.IdSubstring, config.Prefix}, nil
+	if config.Address < 0 {
+		return nil, fmt.Errorf("bad SCPI address %d", config.Address)
+	}
+	return &scpiProtocol{config.IdSubstring, config.AddressPrefix(), config.NumIdentifyAttempts(), config.CheckErrors}, nil
+}
+
+func (p *scpiProtocol) Address(command string) string {
+	return p.addressPrefix + command
 }
 
-func (p *scpiProtocol) Identify(c Commander) (r string, err error) {
-	for i := 0; i < scpiIdentifyNumAttempts; i++ {
-		r, err = c.Query("*IDN?", 0)
+func (p *scpiProtocol) Identify(ctx context.Context, c Commander) (r string, err error) {
+	for i := 0; i < p.identifyAttempts; i++ {
+		r, err = c.Query(ctx, p.Address("*IDN?"), nil, PriorityBackground)
 		switch {
 		case err == ErrTimeout:
 			wbgo.Error.Print("Identify() timeout")
 			continue
+		case ctx.Err() != nil:
+			// cancelled
+			return "", err
 		case err != nil:
 			wbgo.Error.Printf("Identify() error: %v", err)
 			return "", err
@@ -115,13 +373,19 @@ func (p *scpiProtocol) Parameter(spec ParameterSpec) (Parameter, error) {
 		return nil, errors.New("SCPI parameter spec expected")
 	}
 	return &scpiParameter{
-		scpiName:  scpiSpec.ScpiName,
-		name:      scpiSpec.Control.Name,
-		skipValue: scpiSpec.Control.Type == "pushbutton", // FIXME
-		prefix:    p.prefix,
+		scpiParameterSpec: scpiSpec,
+		scpiName:          scpiSpec.ScpiName,
+		name:              scpiSpec.Control.Name,
+		skipValue:         scpiSpec.Control.Type == "pushbutton", // FIXME
+		addr:              p,
+		checkErrors:       p.checkErrors,
 	}, nil
 }
 
+func (p *scpiProtocol) CheckErrors(ctx context.Context, c Commander) error {
+	return checkScpiErrors(ctx, c, p, PriorityBackground)
+}
+
 func init() {
 	RegisterProtocol("scpi", newScpiProtocol, &scpiParameterSpec{})
 }
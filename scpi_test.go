@@ -1,8 +1,11 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"reflect"
+	"strings"
 	"testing"
 	"time"
 )
@@ -44,7 +47,7 @@ func verifyQuery(t *testing.T, commander Commander, param Parameter, expectedNam
 	var r string
 	var err1 error
 	handlerCalled := false
-	err := param.Query(commander, func(name string, value interface{}) {
+	err := param.Query(context.Background(), commander, func(name string, value interface{}) {
 		if name != expectedName {
 			err1 = fmt.Errorf("bad param name %q instead of expected %q", name, expectedName)
 		} else if handlerCalled {
@@ -64,8 +67,9 @@ func verifyQuery(t *testing.T, commander Commander, param Parameter, expectedNam
 
 func TestScpi(t *testing.T) {
 	tester, commander, protocol := prepareScpiTest(t)
+	defer commander.Close()
 	tester.chat("*IDN?", "IZNAKURNOZH", func() (string, error) {
-		return protocol.Identify(commander)
+		return protocol.Identify(context.Background(), commander)
 	})
 	param, err := protocol.Parameter(scpiPortConfig.Parameters[0])
 	if err != nil {
@@ -75,15 +79,16 @@ func TestScpi(t *testing.T) {
 		return verifyQuery(t, commander, param, "current1")
 	})
 	tester.acceptSetCommand("CURR 3.4; *OPC?", "1", func() error {
-		return param.Set(commander, "current1", "3.4")
+		return param.Set(context.Background(), commander, "current1", "3.4")
 	})
 }
 
 func TestScpiBadIdn(t *testing.T) {
 	tester, commander, protocol := prepareScpiTest(t)
+	defer commander.Close()
 	errCh := make(chan error)
 	go func() {
-		_, err := protocol.Identify(commander)
+		_, err := protocol.Identify(context.Background(), commander)
 		errCh <- err
 	}()
 
@@ -122,7 +127,7 @@ func TestScpiWithFakeCommander(t *testing.T) {
 	pt := newProtocolTester(t, scpiConfig)
 
 	pt.commander.enqueue("*IDN?", "IZNAKURNOZH")
-	id, err := pt.protocol.Identify(pt.commander)
+	id, err := pt.protocol.Identify(context.Background(), pt.commander)
 	if err != nil {
 		t.Fatalf("Identify(): %v", err)
 	}
@@ -139,3 +144,300 @@ func TestScpiWithFakeCommander(t *testing.T) {
 	pt.verifySet(0, "current1", "3.4")
 	pt.commander.verifyAndFlush()
 }
+
+func TestScpiIdentifyAttempts(t *testing.T) {
+	pt := newProtocolTester(t, strings.Replace(scpiConfig, "idsubstring:", "identifyattempts: 2\n  idsubstring:", 1))
+	pt.commander.enqueue("*IDN?", "wrongresponse", "*IDN?", "wrongagain")
+	_, err := pt.protocol.Identify(context.Background(), pt.commander)
+	expectedErr := `bad id string "wrongagain" (expected it to contain "IZNAKURNOZH")`
+	switch {
+	case err == nil:
+		t.Errorf("Identify() didn't fail")
+	case err.Error() != expectedErr:
+		t.Errorf("unexpected error %q (expected %q)", err, expectedErr)
+	}
+	pt.commander.verifyAndFlush()
+}
+
+func TestScpiCheckErrors(t *testing.T) {
+	pt := newProtocolTester(t, strings.Replace(scpiConfig, "idsubstring:", "checkerrors: true\n  idsubstring:", 1))
+
+	pt.commander.enqueue("CURR 3.4; *OPC?", "1", "SYST:ERR?", `0,"No error"`)
+	pt.verifySet(0, "current1", "3.4")
+	pt.commander.verifyAndFlush()
+
+	pt.commander.enqueue(
+		"CURR 100; *OPC?", "1",
+		"SYST:ERR?", `-222,"Data out of range"`,
+		"SYST:ERR?", `-221,"Settings conflict"`,
+		"SYST:ERR?", `+0,"No error"`)
+	pt.verifySetError(0, "current1", "100", `device error: -222,"Data out of range"; -221,"Settings conflict"`)
+	pt.commander.verifyAndFlush()
+
+	checker, ok := pt.protocol.(ErrorChecker)
+	if !ok {
+		t.Fatalf("SCPI protocol doesn't support error checking")
+	}
+	pt.commander.enqueue("SYST:ERR?", `0,"No error"`)
+	if err := checker.CheckErrors(context.Background(), pt.commander); err != nil {
+		t.Errorf("CheckErrors(): %v", err)
+	}
+	pt.commander.enqueue("SYST:ERR?", "whatever")
+	switch err := checker.CheckErrors(context.Background(), pt.commander); {
+	case err == nil:
+		t.Errorf("CheckErrors() didn't fail")
+	case err.Error() != `bad error queue response "whatever"`:
+		t.Errorf("unexpected error %q", err)
+	}
+	pt.commander.verifyAndFlush()
+}
+
+var scpiConversionConfig = `
+ports:
+- name: somedev
+  port: someport
+  protocol: scpi
+  parameters:
+  - name: voltage
+    title: Voltage
+    units: V
+    writable: true
+    scpiname: VOLT
+    numeric: true
+    writeformat: "%.3f"
+  - name: current
+    title: Current
+    units: mA
+    writable: true
+    scpiname: CURR
+    scale: 1000
+  - name: output
+    title: Output
+    type: switch
+    writable: true
+    scpiname: OUTP
+  - name: mode
+    title: Mode
+    type: text
+    writable: true
+    scpiname: MODE
+    writeformat: "'%s'"
+`
+
+func TestScpiValueConversion(t *testing.T) {
+	pt := newProtocolTester(t, scpiConversionConfig)
+
+	pt.commander.enqueue("VOLT?", "+1.23400E+01")
+	pt.verifyQuery(0, map[string]interface{}{"voltage": "12.34"})
+	pt.commander.enqueue("VOLT 5.000; *OPC?", "1")
+	pt.verifySet(0, "voltage", "5")
+	pt.verifySetError(0, "voltage", "abc", `VOLT: bad numeric value "abc"`)
+
+	pt.commander.enqueue("CURR?", "1.2E-01")
+	pt.verifyQuery(1, map[string]interface{}{"current": "120"})
+	pt.commander.enqueue("CURR 0.25; *OPC?", "1")
+	pt.verifySet(1, "current", "250")
+
+	pt.commander.enqueue("OUTP?", "ON")
+	pt.verifyQuery(2, map[string]interface{}{"output": "1"})
+	pt.commander.enqueue("OUTP?", "0")
+	pt.verifyQuery(2, map[string]interface{}{"output": "0"})
+	pt.commander.enqueue("OUTP ON; *OPC?", "1")
+	pt.verifySet(2, "output", "1")
+	pt.commander.enqueue("OUTP OFF; *OPC?", "1")
+	pt.verifySet(2, "output", "0")
+	pt.commander.enqueue("OUTP?", "WHATEVER")
+	pt.verifyQueryError(2, `OUTP: bad switch value "WHATEVER"`)
+
+	pt.commander.enqueue("MODE?", "FIX")
+	pt.verifyQuery(3, map[string]interface{}{"mode": "FIX"})
+	pt.commander.enqueue("MODE 'LIST'; *OPC?", "1")
+	pt.verifySet(3, "mode", "LIST")
+	pt.commander.verifyAndFlush()
+}
+
+var scpiMultiValueConfig = `
+ports:
+- name: somedev
+  port: someport
+  protocol: scpi
+  parameters:
+  - scpiname: MEAS:ALL
+    numeric: true
+    controls:
+    - name: voltage
+      title: Voltage
+      units: V
+    - name: current
+      title: Current
+      units: A
+  - scpiname: STAT
+    separator: ";"
+    controls:
+    - name: output
+      title: Output
+      type: switch
+    - name: mode
+      title: Mode
+      type: text
+      enum:
+        CV: Constant voltage
+        CC: Constant current
+`
+
+func TestScpiMultiValue(t *testing.T) {
+	pt := newProtocolTester(t, scpiMultiValueConfig)
+
+	pt.commander.enqueue("MEAS:ALL?", "+1.20000E+01, +3.50000E+00")
+	pt.verifyQuery(0, map[string]interface{}{"voltage": "12", "current": "3.5"})
+	pt.commander.enqueue("MEAS:ALL?", "+1.20000E+01")
+	pt.verifyQueryError(0, "MEAS:ALL: expected 2 values, got 1")
+	pt.commander.enqueue("MEAS:ALL?", "+1.20000E+01,abc")
+	pt.verifyQueryError(0, `MEAS:ALL: bad numeric value "abc"`)
+
+	pt.commander.enqueue("STAT?", "ON;CV")
+	pt.verifyQuery(1, map[string]interface{}{"output": "1", "mode": "CV"})
+	pt.commander.verifyAndFlush()
+
+	if pt.portConfig.Parameters[0].Settable() {
+		t.Errorf("multi-value parameter is settable")
+	}
+	for _, testCase := range []struct{ old, new, errStr string }{
+		{"  - scpiname: MEAS:ALL", "  - name: foo\n    scpiname: MEAS:ALL", "MEAS:ALL: can't specify both name and controls"},
+		{"      units: V", "      units: V\n      writable: true", `MEAS:ALL: multi-value parameter control "voltage" can't be writable`},
+	} {
+		_, err := ParseDriverConfig([]byte(strings.Replace(scpiMultiValueConfig, testCase.old, testCase.new, -1)))
+		switch {
+		case err == nil:
+			t.Errorf("replacement %q -> %q didn't cause an error", testCase.old, testCase.new)
+		case err.Error() != testCase.errStr:
+			t.Errorf("bad error after replacing %q -> %q: %q (expected %q)", testCase.old, testCase.new, err, testCase.errStr)
+		}
+	}
+}
+
+var scpiChannelConfig = `
+ports:
+- name: somedev
+  port: someport
+  protocol: scpi
+  channels: [1, 2]
+  channelselect: INST:NSEL {ch}
+  parameters:
+  - name: voltage
+    title: Voltage
+    units: V
+    writable: true
+    scpiname: VOLT
+    perchannel: true
+  - name: mvoltage
+    title: Measured Voltage
+    units: V
+    scpiname: MEAS{ch}:VOLT
+  - name: output
+    title: Output
+    type: switch
+    scpiname: OUTP
+`
+
+func TestScpiChannels(t *testing.T) {
+	pt := newProtocolTester(t, scpiChannelConfig)
+	var names []string
+	for _, spec := range pt.portConfig.Parameters {
+		for _, control := range spec.ListControls() {
+			names = append(names, control.Name+": "+control.Title)
+		}
+	}
+	expectedNames := []string{
+		"voltage_1: Voltage 1",
+		"voltage_2: Voltage 2",
+		"mvoltage_1: Measured Voltage 1",
+		"mvoltage_2: Measured Voltage 2",
+		"output: Output",
+	}
+	if !reflect.DeepEqual(names, expectedNames) {
+		t.Fatalf("bad controls %#v (expected %#v)", names, expectedNames)
+	}
+
+	// the channel is selected within the same command line
+	pt.commander.enqueue("INST:NSEL 2;:VOLT?", "5.000")
+	pt.verifyQuery(1, map[string]interface{}{"voltage_2": "5.000"})
+	pt.commander.enqueue("INST:NSEL 1;:VOLT 3.4; *OPC?", "1")
+	pt.verifySet(0, "voltage_1", "3.4")
+	pt.commander.enqueue("INST:NSEL 2;:MEAS2:VOLT?", "4.999")
+	pt.verifyQuery(3, map[string]interface{}{"mvoltage_2": "4.999"})
+	pt.commander.enqueue("OUTP?", "1")
+	pt.verifyQuery(4, map[string]interface{}{"output": "1"})
+	pt.commander.verifyAndFlush()
+
+	for _, testCase := range []struct{ old, new, errStr string }{
+		{"  channels: [1, 2]\n", "", `port "somedev": channel select command specified without channels`},
+		{"  channels: [1, 2]\n  channelselect: INST:NSEL {ch}\n", "", `port "somedev": VOLT: no channels specified for per-channel parameter`},
+		{"channels: [1, 2]", "channels: [1, 1]", `port "somedev": duplicate channel 1`},
+		{"INST:NSEL {ch}", "INST:NSEL", `port "somedev": channel select command "INST:NSEL" doesn't contain {ch}`},
+	} {
+		_, err := ParseDriverConfig([]byte(strings.Replace(scpiChannelConfig, testCase.old, testCase.new, -1)))
+		switch {
+		case err == nil:
+			t.Errorf("replacement %q -> %q didn't cause an error", testCase.old, testCase.new)
+		case err.Error() != testCase.errStr:
+			t.Errorf("bad error after replacing %q -> %q: %q (expected %q)", testCase.old, testCase.new, err, testCase.errStr)
+		}
+	}
+}
+
+func TestScpiAddressing(t *testing.T) {
+	config := strings.Replace(scpiConfig, "idsubstring:", "address: 5\n  addressformat: \"ADDR {addr};\"\n  checkerrors: true\n  idsubstring:", 1)
+	pt := newProtocolTester(t, config)
+
+	pt.commander.enqueue("ADDR 5;*IDN?", "IZNAKURNOZH")
+	if _, err := pt.protocol.Identify(context.Background(), pt.commander); err != nil {
+		t.Fatalf("Identify(): %v", err)
+	}
+	pt.commander.enqueue("ADDR 5;CURR?", "3.500")
+	pt.verifyQuery(0, map[string]interface{}{"current1": "3.500"})
+	pt.commander.enqueue(
+		"ADDR 5;CURR 3.4; *OPC?", "1",
+		"ADDR 5;SYST:ERR?", `0,"No error"`)
+	pt.verifySet(0, "current1", "3.4")
+	pt.commander.verifyAndFlush()
+
+	// the deprecated prefix is still supported
+	pt = newProtocolTester(t, strings.Replace(scpiConfig, "idsubstring:", "prefix: \":5:\"\n  idsubstring:", 1))
+	pt.commander.enqueue(":5:CURR?", "3.500")
+	pt.verifyQuery(0, map[string]interface{}{"current1": "3.500"})
+	pt.commander.enqueue(":5:CURR 3.4; *OPC?", "1")
+	pt.verifySet(0, "current1", "3.4")
+	pt.commander.verifyAndFlush()
+
+	_, err := ParseDriverConfig([]byte(strings.Replace(config, "idsubstring:", "prefix: \":5:\"\n  idsubstring:", 1)))
+	expectedErr := `port "somedev": can't specify both prefix and address format`
+	switch {
+	case err == nil:
+		t.Errorf("no error for both prefix and address format")
+	case err.Error() != expectedErr:
+		t.Errorf("unexpected error %q (expected %q)", err, expectedErr)
+	}
+
+	// the setup commands used to be prefixed, so
+	// the deprecated prefix can't be used with them
+	_, err = ParseDriverConfig([]byte(strings.Replace(scpiConfig, "idsubstring:", "prefix: \":5:\"\n  setup:\n  - command: SYST:REM\n  idsubstring:", 1)))
+	expectedErr = `port "somedev": setup commands aren't prefixed, use address format and include the address in the setup commands`
+	switch {
+	case err == nil:
+		t.Errorf("no error for prefix with setup commands")
+	case err.Error() != expectedErr:
+		t.Errorf("unexpected error %q (expected %q)", err, expectedErr)
+	}
+
+	// the protocols that don't address the commands
+	// themselves don't accept the prefix
+	_, err = ParseDriverConfig([]byte(strings.Replace(ernConfig, "idsubstring:", "prefix: \":5:\"\n  idsubstring:", 1)))
+	expectedErr = `port "ern": protocol "ern" doesn't support prefix and address format`
+	switch {
+	case err == nil:
+		t.Errorf("no error for prefix with ERN protocol")
+	case err.Error() != expectedErr:
+		t.Errorf("unexpected error %q (expected %q)", err, expectedErr)
+	}
+}
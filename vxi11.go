@@ -0,0 +1,416 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	rpcCall           = 0
+	rpcReply          = 1
+	rpcVersion        = 2
+	rpcMsgAccepted    = 0
+	rpcSuccess        = 0
+	rpcLastFragment   = 0x80000000
+	rpcMaxRecordSize  = 16 * 1024 * 1024
+	portmapperProgram = 100000
+	portmapperVersion = 2
+	portmapperGetPort = 3
+	ipProtoTcp        = 6
+
+	vxi11CoreProgram  = 0x0607af
+	vxi11CoreVersion  = 1
+	vxi11CreateLink   = 10
+	vxi11DeviceWrite  = 11
+	vxi11DeviceRead   = 12
+	vxi11DeviceClear  = 15
+	vxi11DestroyLink  = 23
+	vxi11FlagEnd      = 8
+	vxi11ReasonEnd    = 4
+	vxi11ErrIOTimeout = 15
+	vxi11MaxReadSize  = 65536
+	// vxi11DefaultIOTimeout is used when there's no deadline
+	vxi11DefaultIOTimeout = 10 * time.Second
+	vxi11DefaultDevice    = "inst0"
+)
+
+// vxi11PortmapperPort is the port of the portmapper service
+// that's used to find the VXI-11 core channel port
+var vxi11PortmapperPort = 111
+
+// xdrEncoder encodes the data in XDR format (RFC 4506)
+type xdrEncoder struct {
+	data []byte
+}
+
+func (e *xdrEncoder) uint32(v uint32) *xdrEncoder {
+	e.data = append(e.data, 0, 0, 0, 0)
+	binary.BigEndian.PutUint32(e.data[len(e.data)-4:], v)
+	return e
+}
+
+func (e *xdrEncoder) opaque(data []byte) *xdrEncoder {
+	e.uint32(uint32(len(data)))
+	e.data = append(e.data, data...)
+	for len(e.data)%4 != 0 {
+		e.data = append(e.data, 0)
+	}
+	return e
+}
+
+// xdrDecoder decodes the data in XDR format. After the first
+// error, all the values that are returned are zero
+type xdrDecoder struct {
+	data []byte
+	err  error
+}
+
+func (d *xdrDecoder) uint32() uint32 {
+	if d.err != nil {
+		return 0
+	}
+	if len(d.data) < 4 {
+		d.err = errors.New("xdr: data too short")
+		return 0
+	}
+	v := binary.BigEndian.Uint32(d.data)
+	d.data = d.data[4:]
+	return v
+}
+
+func (d *xdrDecoder) opaque() []byte {
+	n := int(d.uint32())
+	if d.err != nil {
+		return nil
+	}
+	padded := (n + 3) &^ 3
+	if n < 0 || padded > len(d.data) {
+		d.err = errors.New("xdr: bad opaque data length")
+		return nil
+	}
+	v := d.data[:n]
+	d.data = d.data[padded:]
+	return v
+}
+
+// parseRpcRecord returns the size of the complete record in the
+// buffer, including the record marks of all of its fragments
+func parseRpcRecord(buf []byte) (int, error) {
+	size := 0
+	for {
+		if len(buf) < size+4 {
+			return 0, nil
+		}
+		mark := binary.BigEndian.Uint32(buf[size:])
+		size += 4 + int(mark&^rpcLastFragment)
+		switch {
+		case size > rpcMaxRecordSize:
+			return 0, errors.New("rpc: record too large")
+		case len(buf) < size:
+			return 0, nil
+		case mark&rpcLastFragment != 0:
+			return size, nil
+		}
+	}
+}
+
+// rpcRecordData returns the contents of the record
+// without the record marks
+func rpcRecordData(record []byte) []byte {
+	var data []byte
+	for len(record) >= 4 {
+		n := int(binary.BigEndian.Uint32(record) &^ rpcLastFragment)
+		data = append(data, record[4:4+n]...)
+		record = record[4+n:]
+	}
+	return data
+}
+
+// rpcRecord makes a single fragment record out of the data
+func rpcRecord(data []byte) []byte {
+	r := make([]byte, 4, len(data)+4)
+	binary.BigEndian.PutUint32(r, rpcLastFragment|uint32(len(data)))
+	return append(r, data...)
+}
+
+// rpcClient is a minimal ONC RPC (RFC 5531) client over TCP
+type rpcClient struct {
+	conn   net.Conn
+	reader *messageReader
+	xid    uint32
+}
+
+func dialRpc(address string, timeout time.Duration) (*rpcClient, error) {
+	conn, err := net.DialTimeout("tcp", address, timeout)
+	if err != nil {
+		return nil, err
+	}
+	return &rpcClient{
+		conn:   conn,
+		reader: newMessageReader(conn, parseRpcRecord),
+		xid:    uint32(time.Now().UnixNano()),
+	}, nil
+}
+
+// call invokes the remote procedure. The replies to the
+// earlier calls, e.g. the ones that timed out, are skipped
+func (c *rpcClient) call(prog, vers, proc uint32, args []byte) (*xdrDecoder, error) {
+	c.xid++
+	e := &xdrEncoder{}
+	e.uint32(c.xid).uint32(rpcCall).uint32(rpcVersion).uint32(prog).uint32(vers).uint32(proc)
+	// AUTH_NONE credentials and verifier
+	e.uint32(0).opaque(nil).uint32(0).opaque(nil)
+	e.data = append(e.data, args...)
+	if _, err := c.conn.Write(rpcRecord(e.data)); err != nil {
+		if isNetTimeout(err) {
+			return nil, ErrTimeout
+		}
+		return nil, err
+	}
+	for {
+		record, err := c.reader.read()
+		if err != nil {
+			return nil, err
+		}
+		d := &xdrDecoder{data: rpcRecordData(record)}
+		if xid := d.uint32(); xid != c.xid {
+			continue
+		}
+		msgType, replyStat := d.uint32(), d.uint32()
+		// skip the verifier
+		d.uint32()
+		d.opaque()
+		acceptStat := d.uint32()
+		switch {
+		case d.err != nil:
+			return nil, fmt.Errorf("rpc: malformed reply: %v", d.err)
+		case msgType != rpcReply:
+			return nil, fmt.Errorf("rpc: unexpected message type %d", msgType)
+		case replyStat != rpcMsgAccepted:
+			return nil, errors.New("rpc: call rejected")
+		case acceptStat != rpcSuccess:
+			return nil, fmt.Errorf("rpc: call failed with status %d", acceptStat)
+		}
+		return d, nil
+	}
+}
+
+// vxi11Conn is a connection to a VXI-11 instrument
+type vxi11Conn struct {
+	rpc         *rpcClient
+	lid         uint32
+	maxRecvSize int
+	// deadlineMtx protects deadline, which is set by
+	// the commander when the command is cancelled
+	// while the response is being read
+	deadlineMtx sync.Mutex
+	deadline    time.Time
+	// stale is set if a read timed out, so the
+	// response may still be pending
+	stale   bool
+	pending []byte
+}
+
+var _ MessageConnection = &vxi11Conn{}
+
+func dialVxi11(address string, settings *PortSettings) (*vxi11Conn, error) {
+	address, device := splitAddress(address, 0, vxi11DefaultDevice)
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	if port == "0" {
+		p, err := vxi11CorePort(host, settings.TcpTimeout())
+		if err != nil {
+			return nil, fmt.Errorf("vxi11: portmapper: %v", err)
+		}
+		address = net.JoinHostPort(host, fmt.Sprint(p))
+	}
+	rpc, err := dialRpc(address, settings.TcpTimeout())
+	if err != nil {
+		return nil, err
+	}
+	c := &vxi11Conn{rpc: rpc}
+	c.SetDeadline(time.Now().Add(settings.CommandTimeout()))
+	if err := c.createLink(device); err != nil {
+		rpc.conn.Close()
+		return nil, err
+	}
+	c.SetDeadline(time.Time{})
+	return c, nil
+}
+
+// vxi11CorePort finds the port of the VXI-11 core channel
+func vxi11CorePort(host string, timeout time.Duration) (uint32, error) {
+	rpc, err := dialRpc(net.JoinHostPort(host, fmt.Sprint(vxi11PortmapperPort)), timeout)
+	if err != nil {
+		return 0, err
+	}
+	defer rpc.conn.Close()
+	rpc.conn.SetDeadline(time.Now().Add(timeout))
+	args := &xdrEncoder{}
+	args.uint32(vxi11CoreProgram).uint32(vxi11CoreVersion).uint32(ipProtoTcp).uint32(0)
+	d, err := rpc.call(portmapperProgram, portmapperVersion, portmapperGetPort, args.data)
+	if err != nil {
+		return 0, err
+	}
+	port := d.uint32()
+	switch {
+	case d.err != nil:
+		return 0, d.err
+	case port == 0:
+		return 0, errors.New("VXI-11 core channel is not registered")
+	}
+	return port, nil
+}
+
+func (c *vxi11Conn) ioTimeout() uint32 {
+	c.deadlineMtx.Lock()
+	deadline := c.deadline
+	c.deadlineMtx.Unlock()
+	if deadline.IsZero() {
+		return uint32(vxi11DefaultIOTimeout / time.Millisecond)
+	}
+	if d := time.Until(deadline); d > 0 {
+		return uint32(d / time.Millisecond)
+	}
+	return 0
+}
+
+func (c *vxi11Conn) call(proc uint32, args *xdrEncoder) (*xdrDecoder, error) {
+	d, err := c.rpc.call(vxi11CoreProgram, vxi11CoreVersion, proc, args.data)
+	if err != nil {
+		return nil, err
+	}
+	switch errCode := d.uint32(); {
+	case d.err != nil:
+		return nil, fmt.Errorf("vxi11: malformed reply: %v", d.err)
+	case errCode == vxi11ErrIOTimeout:
+		return nil, ErrTimeout
+	case errCode != 0:
+		return nil, fmt.Errorf("vxi11: device error %d", errCode)
+	}
+	return d, nil
+}
+
+func (c *vxi11Conn) createLink(device string) error {
+	args := &xdrEncoder{}
+	// client id, lock device, lock timeout, device name
+	args.uint32(0).uint32(0).uint32(0).opaque([]byte(device))
+	d, err := c.call(vxi11CreateLink, args)
+	if err != nil {
+		return err
+	}
+	c.lid = d.uint32()
+	// skip the abort port
+	d.uint32()
+	c.maxRecvSize = int(d.uint32())
+	if d.err != nil {
+		return fmt.Errorf("vxi11: malformed create_link reply: %v", d.err)
+	}
+	if c.maxRecvSize <= 0 {
+		c.maxRecvSize = 1024
+	}
+	return nil
+}
+
+func (c *vxi11Conn) SetDeadline(t time.Time) error {
+	c.deadlineMtx.Lock()
+	c.deadline = t
+	c.deadlineMtx.Unlock()
+	return c.rpc.conn.SetDeadline(t)
+}
+
+// Write sends the data as a single message, setting
+// END flag on its last chunk
+func (c *vxi11Conn) Write(b []byte) (int, error) {
+	written := 0
+	for {
+		chunk, flags := b[written:], uint32(0)
+		if len(chunk) > c.maxRecvSize {
+			chunk = chunk[:c.maxRecvSize]
+		} else {
+			flags = vxi11FlagEnd
+		}
+		args := &xdrEncoder{}
+		args.uint32(c.lid).uint32(c.ioTimeout()).uint32(0).uint32(flags).opaque(chunk)
+		d, err := c.call(vxi11DeviceWrite, args)
+		if err != nil {
+			return written, err
+		}
+		written += int(d.uint32())
+		switch {
+		case d.err != nil:
+			return written, fmt.Errorf("vxi11: malformed device_write reply: %v", d.err)
+		case written >= len(b):
+			return len(b), nil
+		}
+	}
+}
+
+func (c *vxi11Conn) ReadMessage() ([]byte, error) {
+	var msg []byte
+	for {
+		args := &xdrEncoder{}
+		// request size, io timeout, lock timeout, flags, term char
+		args.uint32(c.lid).uint32(vxi11MaxReadSize).uint32(c.ioTimeout()).uint32(0).uint32(0).uint32(0)
+		d, err := c.call(vxi11DeviceRead, args)
+		if err != nil {
+			c.stale = true
+			return nil, err
+		}
+		reason, data := d.uint32(), d.opaque()
+		if d.err != nil {
+			return nil, fmt.Errorf("vxi11: malformed device_read reply: %v", d.err)
+		}
+		msg = append(msg, data...)
+		if reason&vxi11ReasonEnd != 0 {
+			return msg, nil
+		}
+	}
+}
+
+func (c *vxi11Conn) Read(b []byte) (int, error) {
+	if len(c.pending) == 0 {
+		msg, err := c.ReadMessage()
+		if err != nil {
+			return 0, err
+		}
+		c.pending = msg
+	}
+	n := copy(b, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+// DeviceClear clears the input and output buffers of the device
+func (c *vxi11Conn) DeviceClear() error {
+	args := &xdrEncoder{}
+	// flags, lock timeout, io timeout
+	args.uint32(c.lid).uint32(0).uint32(0).uint32(c.ioTimeout())
+	if _, err := c.call(vxi11DeviceClear, args); err != nil {
+		return err
+	}
+	c.pending = nil
+	c.stale = false
+	return nil
+}
+
+func (c *vxi11Conn) Drain() error {
+	c.pending = nil
+	if !c.stale {
+		return nil
+	}
+	return c.DeviceClear()
+}
+
+func (c *vxi11Conn) Close() error {
+	c.SetDeadline(time.Now().Add(tcpTimeout))
+	args := &xdrEncoder{}
+	c.call(vxi11DestroyLink, args.uint32(c.lid))
+	return c.rpc.conn.Close()
+}
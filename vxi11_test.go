@@ -0,0 +1,220 @@
+package main
+
+import (
+	"context"
+	"net"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeVxi11Server serves both the portmapper and the VXI-11
+// core channel on the same port. It responds to '*IDN?' and
+// doesn't respond to 'HANG?', returning the responses in
+// small chunks with END indicator only on the last one.
+// Like the real instruments, it waits before reporting that
+// there's no response, but only for a half of the io timeout,
+// so the reply doesn't race with the client deadline
+type fakeVxi11Server struct {
+	listener net.Listener
+	eventCh  chan string
+}
+
+func newFakeVxi11Server(t *testing.T) *fakeVxi11Server {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen(): %v", err)
+	}
+	s := &fakeVxi11Server{
+		listener: listener,
+		eventCh:  make(chan string, 100),
+	}
+	go s.serve()
+	return s
+}
+
+func (s *fakeVxi11Server) port() int {
+	return s.listener.Addr().(*net.TCPAddr).Port
+}
+
+func (s *fakeVxi11Server) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		go s.handle(conn)
+	}
+}
+
+func (s *fakeVxi11Server) handle(conn net.Conn) {
+	defer conn.Close()
+	reader := newMessageReader(conn, parseRpcRecord)
+	var input, output string
+	for {
+		record, err := reader.read()
+		if err != nil {
+			return
+		}
+		d := &xdrDecoder{data: rpcRecordData(record)}
+		xid := d.uint32()
+		// message type, rpc version
+		d.uint32()
+		d.uint32()
+		prog, _, proc := d.uint32(), d.uint32(), d.uint32()
+		// credentials and verifier
+		d.uint32()
+		d.opaque()
+		d.uint32()
+		d.opaque()
+		reply := &xdrEncoder{}
+		reply.uint32(xid).uint32(rpcReply).uint32(rpcMsgAccepted).uint32(0).opaque(nil).uint32(rpcSuccess)
+		switch {
+		case prog == portmapperProgram && proc == portmapperGetPort:
+			s.eventCh <- "getport"
+			reply.uint32(uint32(s.port()))
+		case prog != vxi11CoreProgram:
+			return
+		case proc == vxi11CreateLink:
+			// client id, lock device, lock timeout
+			d.uint32()
+			d.uint32()
+			d.uint32()
+			s.eventCh <- "create_link " + string(d.opaque())
+			// error, link id, abort port, max recv size
+			reply.uint32(0).uint32(42).uint32(0).uint32(4)
+		case proc == vxi11DeviceWrite:
+			// link id, io timeout, lock timeout
+			d.uint32()
+			d.uint32()
+			d.uint32()
+			flags, data := d.uint32(), d.opaque()
+			input += string(data)
+			if flags&vxi11FlagEnd != 0 {
+				s.eventCh <- "write " + strings.TrimSpace(input)
+				if strings.TrimSpace(input) == "*IDN?" {
+					output = "FAKE,VXI11,0,1.0\n"
+				}
+				input = ""
+			}
+			reply.uint32(0).uint32(uint32(len(data)))
+		case proc == vxi11DeviceRead && output == "":
+			// link id, request size, io timeout
+			d.uint32()
+			d.uint32()
+			s.eventCh <- "read"
+			time.Sleep(time.Duration(d.uint32()) * time.Millisecond / 2)
+			reply.uint32(vxi11ErrIOTimeout).uint32(0).opaque(nil)
+		case proc == vxi11DeviceRead:
+			chunk, reason := output, uint32(vxi11ReasonEnd)
+			if len(chunk) > 5 {
+				chunk, reason = chunk[:5], 0
+			}
+			output = output[len(chunk):]
+			reply.uint32(0).uint32(reason).opaque([]byte(chunk))
+		case proc == vxi11DeviceClear:
+			s.eventCh <- "clear"
+			input, output = "", ""
+			reply.uint32(0)
+		case proc == vxi11DestroyLink:
+			s.eventCh <- "destroy_link"
+			reply.uint32(0)
+		default:
+			return
+		}
+		if _, err := conn.Write(rpcRecord(reply.data)); err != nil {
+			return
+		}
+	}
+}
+
+func (s *fakeVxi11Server) verifyEvents(t *testing.T, expectedEvents ...string) {
+	var events []string
+	for range expectedEvents {
+		events = append(events, <-s.eventCh)
+	}
+	if !reflect.DeepEqual(events, expectedEvents) {
+		t.Errorf("bad server events %q (expected %q)", events, expectedEvents)
+	}
+}
+
+func (s *fakeVxi11Server) close() {
+	s.listener.Close()
+}
+
+func TestVxi11(t *testing.T) {
+	s := newFakeVxi11Server(t)
+	defer s.close()
+	oldPortmapperPort := vxi11PortmapperPort
+	vxi11PortmapperPort = s.port()
+	defer func() { vxi11PortmapperPort = oldPortmapperPort }()
+
+	commander := NewCommander(connect, &PortSettings{
+		Port:           "vxi11://127.0.0.1/gpib0,5",
+		TimingSettings: TimingSettings{CommandTimeoutMs: 300},
+	})
+	commander.Connect()
+	defer commander.Close()
+	<-commander.Ready()
+	s.verifyEvents(t, "getport", "create_link gpib0,5")
+
+	query := func(cmd string) (string, error) {
+		return commander.Query(context.Background(), cmd, nil, PriorityBackground)
+	}
+	if resp, err := query("*IDN?"); err != nil {
+		t.Errorf("Query(): %v", err)
+	} else if resp != "FAKE,VXI11,0,1.0" {
+		t.Errorf("bad response %q", resp)
+	}
+	s.verifyEvents(t, "write *IDN?")
+
+	if _, err := query("HANG?"); err != ErrTimeout {
+		t.Errorf("unexpected error value: %#v (expected ErrTimeout)", err)
+	}
+	s.verifyEvents(t, "write HANG?", "read")
+
+	// the device must be cleared after the timeout
+	if resp, err := query("*IDN?"); err != nil {
+		t.Errorf("Query(): %v", err)
+	} else if resp != "FAKE,VXI11,0,1.0" {
+		t.Errorf("bad response %q", resp)
+	}
+	s.verifyEvents(t, "clear", "write *IDN?")
+}
+
+func TestVxi11Cancel(t *testing.T) {
+	s := newFakeVxi11Server(t)
+	defer s.close()
+
+	commander := NewCommander(connect, &PortSettings{
+		Port:           "vxi11://127.0.0.1:" + strconv.Itoa(s.port()),
+		TimingSettings: TimingSettings{CommandTimeoutMs: 300},
+	})
+	commander.Connect()
+	defer commander.Close()
+	<-commander.Ready()
+	s.verifyEvents(t, "create_link inst0")
+
+	// cancel the query while the response is being read
+	ctx, cancel := context.WithCancel(context.Background())
+	errCh := make(chan error, 1)
+	go func() {
+		_, err := commander.Query(ctx, "HANG?", nil, PriorityBackground)
+		errCh <- err
+	}()
+	s.verifyEvents(t, "write HANG?", "read")
+	cancel()
+	if err := <-errCh; err != context.Canceled {
+		t.Errorf("unexpected error value: %#v (expected context.Canceled)", err)
+	}
+
+	// the device must be cleared after the cancelled read
+	if resp, err := commander.Query(context.Background(), "*IDN?", nil, PriorityBackground); err != nil {
+		t.Errorf("Query(): %v", err)
+	} else if resp != "FAKE,VXI11,0,1.0" {
+		t.Errorf("bad response %q", resp)
+	}
+	s.verifyEvents(t, "clear", "write *IDN?")
+}